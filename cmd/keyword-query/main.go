@@ -0,0 +1,355 @@
+// keyword-query runs a keyword query from the command line through the same query code as the Grafana
+// datasource, so a panel can be reproduced (and its conversions and transforms checked) without Grafana.
+//
+//	keyword-query -config archive.json -from now-1h -transform derivative dcs.AZ dcs.EL
+//
+// The config file holds the datasource's JSON settings, as entered in the datasource configuration page.
+//
+// There is no aggregation flag because a panel query has no aggregation setting of its own.  Values are
+// aggregated by the query type (-type stats, -percentiles, -type histogram) or by the rolling transforms
+// (-transform moving_average={"window": "1m"} and the like), and both are available here.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/KeckObservatory/keyword-grafana-datasource/pkg/plugin"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+)
+
+// stringList collects a flag given more than once
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ", ")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+func main() {
+	err := run(os.Args[1:], os.Stdout)
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "keyword-query: "+err.Error())
+		os.Exit(1)
+	}
+}
+
+// run parses the arguments and runs the query, writing to stdout unless an output file is given
+func run(args []string, stdout io.Writer) error {
+	var transforms stringList
+	flags := flag.NewFlagSet("keyword-query", flag.ContinueOnError)
+
+	configFile := flags.String("config", "", "JSON file of datasource settings")
+	archive := flags.String("backend", "", "archive backend: postgres, files or sqlite (overrides the config file)")
+	path := flags.String("path", "", "archive directory or SQLite file (overrides the config file)")
+	server := flags.String("server", "", "Postgres server (overrides the config file)")
+	port := flags.String("port", "", "Postgres port (overrides the config file)")
+	role := flags.String("role", "", "Postgres role (overrides the config file)")
+	database := flags.String("database", "", "Postgres database (overrides the config file)")
+
+	from := flags.String("from", "now-1h", "start of the time range: now, now-6h, 2024-03-01 or RFC 3339")
+	to := flags.String("to", "now", "end of the time range")
+	queryType := flags.String("type", "timeseries", "query type: timeseries, stats, histogram or staleness")
+	conversion := flags.String("conversion", "", "unit conversion, such as deg_to_arcsec")
+	scale := flags.Float64("scale", 0, "scale for the scale_offset conversion")
+	offset := flags.Float64("offset", 0, "offset for the scale_offset conversion")
+	calibrate := flags.String("calibrate", "", "calibration: always or never, automatic by default")
+	timeShift := flags.String("timeshift", "", "compare against another period, such as -1d")
+	percentiles := flags.String("percentiles", "", "comma separated percentiles for the stats query type")
+	bins := flags.Int("bins", 0, "number of histogram buckets")
+	binWidth := flags.Float64("binwidth", 0, "width of the histogram buckets")
+	timeWeighted := flags.Bool("timeweighted", false, "weight the histogram by time rather than samples")
+	threshold := flags.String("threshold", "", "staleness threshold such as 90s or 2h, 10m by default")
+	format := flags.String("format", "table", "output format: csv, json or table, or export as ndjson, arrow or fits")
+	output := flags.String("o", "", "write to this file rather than stdout")
+	list := flags.Bool("list", false, "list the unit conversions and transforms, then exit")
+	verbose := flags.Bool("v", false, "show the datasource's log on stderr")
+	flags.Var(&transforms, "transform", "transform step as name or name={json params}, may be repeated")
+
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: keyword-query [flags] service.KEYWORD...")
+		flags.PrintDefaults()
+	}
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	// The datasource logs every query, which is only wanted when looking into a problem
+	log.DefaultLogger = log.NewWithLevel(log.Error)
+	if *verbose {
+		log.DefaultLogger = log.NewWithLevel(log.Debug)
+	}
+
+	if *list {
+		return listRegistries(stdout)
+	}
+
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return fmt.Errorf("no keywords given")
+	}
+
+	// Start from the config file and apply any connection flags over it
+	settings := map[string]interface{}{}
+	if *configFile != "" {
+		content, err := os.ReadFile(*configFile)
+		if err != nil {
+			return err
+		}
+		err = json.Unmarshal(content, &settings)
+		if err != nil {
+			return fmt.Errorf("%s: %w", *configFile, err)
+		}
+	}
+	for key, value := range map[string]string{"backend": *archive, "path": *path, "server": *server, "port": *port, "role": *role, "database": *database} {
+		if value != "" {
+			settings[key] = value
+		}
+	}
+
+	// Build the query model exactly as the query editor would save it
+	model := map[string]interface{}{
+		"refId":            "A",
+		"queryText":        strings.Join(flags.Args(), ","),
+		"conversion":       *conversion,
+		"conversionScale":  *scale,
+		"conversionOffset": *offset,
+		"calibrate":        *calibrate,
+		"timeShift":        *timeShift,
+		"histogram": map[string]interface{}{
+			"bins":         *bins,
+			"binWidth":     *binWidth,
+			"timeWeighted": *timeWeighted,
+		},
+		"staleness": map[string]interface{}{
+			"threshold": *threshold,
+		},
+	}
+
+	steps, err := parseTransforms(transforms)
+	if err != nil {
+		return err
+	}
+	model["transforms"] = steps
+
+	if *percentiles != "" {
+		list := []float64{}
+		for _, p := range strings.Split(*percentiles, ",") {
+			v, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+			if err != nil {
+				return fmt.Errorf("invalid percentile: %s", p)
+			}
+			list = append(list, v)
+		}
+		model["percentiles"] = list
+	}
+
+	if *queryType == "timeseries" {
+		*queryType = plugin.QUERY_TYPE_TIMESERIES
+	}
+
+	now := time.Now()
+	timeRange := backend.TimeRange{}
+	timeRange.From, err = parseTime(*from, now)
+	if err != nil {
+		return err
+	}
+	timeRange.To, err = parseTime(*to, now)
+	if err != nil {
+		return err
+	}
+
+	settingsJSON, err := json.Marshal(settings)
+	if err != nil {
+		return err
+	}
+	modelJSON, err := json.Marshal(model)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	instance, err := plugin.NewDatasource(ctx, backend.DataSourceInstanceSettings{JSONData: settingsJSON})
+	if err != nil {
+		return err
+	}
+	ds := instance.(*plugin.KeywordDatasource)
+	defer ds.Dispose()
+
+	// The binary and streaming formats go through the datasource's export rather than a panel query
+	switch *format {
+	case plugin.EXPORT_NDJSON, plugin.EXPORT_ARROW, plugin.EXPORT_FITS:
+		if *queryType != plugin.QUERY_TYPE_TIMESERIES {
+			return fmt.Errorf("only time series can be exported as %s", *format)
+		}
+
+		return writeOutput(*output, stdout, func(out io.Writer) error {
+			return ds.Export(ctx, out, url.Values{
+				"query":  {string(modelJSON)},
+				"from":   {timeRange.From.Format(time.RFC3339Nano)},
+				"to":     {timeRange.To.Format(time.RFC3339Nano)},
+				"format": {*format},
+			})
+		})
+	}
+
+	// Run the query through the datasource just as Grafana would
+	resp, err := ds.QueryData(ctx, &backend.QueryDataRequest{
+		Queries: []backend.DataQuery{{
+			RefID:     "A",
+			QueryType: *queryType,
+			JSON:      modelJSON,
+			TimeRange: timeRange,
+		}},
+	})
+	if err != nil {
+		return err
+	}
+
+	res := resp.Responses["A"]
+	if res.Error != nil {
+		return res.Error
+	}
+
+	return writeOutput(*output, stdout, func(out io.Writer) error {
+		return writeFrames(out, res.Frames, *format)
+	})
+}
+
+// writeOutput runs write against stdout, or when a path is given against a temporary file beside it that
+// only replaces the path once everything has been written, so a failed query leaves no partial file behind
+func writeOutput(path string, stdout io.Writer, write func(io.Writer) error) (err error) {
+	if path == "" {
+		return write(stdout)
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+
+	// Temporary files are private, the output is made as os.Create would make it
+	err = f.Chmod(0o644)
+	if err != nil {
+		return err
+	}
+
+	err = write(f)
+	if err != nil {
+		return err
+	}
+
+	// Data the file system could not store only shows up as an error on close
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
+
+// parseTransforms reads transform steps given as name or name={json params}
+func parseTransforms(list []string) ([]plugin.TransformStep, error) {
+	steps := []plugin.TransformStep{}
+
+	for _, item := range list {
+		name, params, _ := strings.Cut(item, "=")
+		step := plugin.TransformStep{Name: strings.TrimSpace(name)}
+
+		if params != "" {
+			if !json.Valid([]byte(params)) {
+				return nil, fmt.Errorf("transform %s: params are not valid JSON: %s", step.Name, params)
+			}
+			step.Params = json.RawMessage(params)
+		}
+
+		steps = append(steps, step)
+	}
+
+	return steps, nil
+}
+
+// Layouts accepted for absolute times, times without a zone are UTC
+var timeLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02",
+}
+
+// parseTime reads a time as now, now minus a duration (days allowed), or an absolute time
+func parseTime(text string, now time.Time) (time.Time, error) {
+	text = strings.TrimSpace(text)
+
+	if text == "now" {
+		return now, nil
+	}
+
+	if ago, ok := strings.CutPrefix(text, "now-"); ok {
+		days := 0.0
+		if amount, ok := strings.CutSuffix(ago, "d"); ok {
+			v, err := strconv.ParseFloat(amount, 64)
+			if err != nil {
+				return time.Time{}, fmt.Errorf("invalid time: %s", text)
+			}
+			days, ago = v, "0s"
+		}
+
+		d, err := time.ParseDuration(ago)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid time: %s", text)
+		}
+
+		return now.Add(-d - time.Duration(days*24*float64(time.Hour))), nil
+	}
+
+	for _, layout := range timeLayouts {
+		t, err := time.Parse(layout, text)
+		if err == nil {
+			return t, nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("invalid time: %s", text)
+}
+
+// listRegistries prints the available unit conversions and transforms
+func listRegistries(w io.Writer) error {
+	fmt.Fprintln(w, "Unit conversions:")
+	for _, c := range plugin.UnitConversions() {
+		fmt.Fprintf(w, "  %-24s %s\n", c.Name, c.Label)
+	}
+
+	fmt.Fprintln(w, "Transforms:")
+	for _, t := range plugin.Transforms() {
+		fmt.Fprintf(w, "  %-24s %s\n", t.Name, t.Description)
+	}
+
+	return nil
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestArchive writes a file archive with dcs.AZ at 5, 10 and 15 one second apart and returns the
+// connection flags for it
+func newTestArchive(t *testing.T) []string {
+	t.Helper()
+
+	dir := t.TempDir()
+	err := os.WriteFile(filepath.Join(dir, "dcs.csv"),
+		[]byte("time,keyword,binvalue\n1700000000,AZ,5\n1700000001,AZ,10\n1700000002,AZ,15\n1700000001,EL,45\n"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return []string{"-backend", "files", "-path", dir, "-from", "2023-11-14T22:13:00Z", "-to", "2023-11-14T22:14:00Z"}
+}
+
+// outputFiles lists the directory, to check nothing is left behind
+func outputFiles(t *testing.T, dir string) []string {
+	t.Helper()
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	return names
+}
+
+func TestRun(t *testing.T) {
+	archive := newTestArchive(t)
+
+	var out bytes.Buffer
+	err := run(append(archive, "-format", "csv", "-conversion", "scale_offset", "-scale", "2", "dcs.AZ"), &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 4 || !strings.HasPrefix(lines[1], "10,") || !strings.HasPrefix(lines[3], "30,") {
+		t.Fatalf("expected a header and three converted rows, got %q", out.String())
+	}
+
+	// Aggregation is a query type or a transform, as in a panel
+	out.Reset()
+	err = run(append(archive, "-format", "csv", "-type", "stats", "-percentiles", "50", "dcs.AZ"), &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "10") {
+		t.Fatalf("expected the median in the stats, got %q", out.String())
+	}
+
+	out.Reset()
+	err = run(append(archive, "-format", "json", "-transform", `moving_average={"window": 2}`, "dcs.AZ"), &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "12.5") {
+		t.Fatalf("expected the moving average, got %q", out.String())
+	}
+
+	// The first sample has no spread, JSON cannot hold a NaN so it is written as null
+	out.Reset()
+	err = run(append(archive, "-format", "json", "-transform", `rolling_std={"window": 2}`, "dcs.AZ"), &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var frames []struct {
+		Rows []map[string]interface{} `json:"rows"`
+	}
+	if err = json.Unmarshal(out.Bytes(), &frames); err != nil {
+		t.Fatalf("expected valid JSON, got %v in %q", err, out.String())
+	}
+	if len(frames) != 1 || len(frames[0].Rows) != 3 || frames[0].Rows[0]["dcs.AZ"] != nil || frames[0].Rows[1]["dcs.AZ"] == nil {
+		t.Fatalf("expected a null then the rolling deviation, got %q", out.String())
+	}
+
+	out.Reset()
+	err = run([]string{"-list"}, &out)
+	if err != nil || !strings.Contains(out.String(), "deg_to_arcsec") || !strings.Contains(out.String(), "moving_average") {
+		t.Fatalf("expected the conversions and transforms to be listed, got %q, %v", out.String(), err)
+	}
+
+	for _, args := range [][]string{
+		archive,
+		append(archive, "-transform", "derivative={", "dcs.AZ"),
+		append(archive, "-from", "yesterday", "dcs.AZ"),
+		append(archive, "-format", "fits", "-type", "stats", "dcs.AZ"),
+	} {
+		if err = run(args, &out); err == nil {
+			t.Fatalf("%v: expected an error", args)
+		}
+	}
+}
+
+func TestRunOutputFile(t *testing.T) {
+	archive := newTestArchive(t)
+	dir := t.TempDir()
+	path := filepath.Join(dir, "az.ndjson")
+
+	var stdout bytes.Buffer
+	err := run(append(archive, "-format", "ndjson", "-o", path, "dcs.AZ"), &stdout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Count(string(content), "\n") != 3 || stdout.Len() != 0 {
+		t.Fatalf("expected three lines in the file and nothing on stdout, got %q and %q", content, stdout.String())
+	}
+
+	// A failed query leaves the existing file as it was, and no temporary file behind
+	for _, args := range [][]string{
+		{"-format", "csv", "dcs.NOPE"},
+		{"-format", "ndjson", "-transform", "nonsense", "dcs.AZ"},
+		{"-format", "ndjson", "dcs.NOPE"},
+	} {
+		format := args[1]
+		err = run(append(append(archive, "-o", path), args...), &stdout)
+		if err == nil {
+			t.Fatalf("%v: expected the query to fail", args)
+		}
+		after, _ := os.ReadFile(path)
+		if !bytes.Equal(after, content) {
+			t.Fatalf("%s: the failed query changed the output file to %q", format, after)
+		}
+		if names := outputFiles(t, dir); len(names) != 1 {
+			t.Fatalf("%s: expected only the output file, got %v", format, names)
+		}
+	}
+
+	// Nor is a file made where there was none
+	missing := filepath.Join(dir, "missing.csv")
+	if err = run(append(archive, "-format", "csv", "-o", missing, "dcs.NOPE"), &stdout); err == nil {
+		t.Fatal("expected an unknown keyword to fail")
+	}
+	if _, err = os.Stat(missing); !os.IsNotExist(err) {
+		t.Fatalf("expected no output file after a failed query, got %v", err)
+	}
+}
+
+func TestParseTime(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	cases := map[string]time.Time{
+		"now":                  now,
+		"now-90m":              now.Add(-90 * time.Minute),
+		"now-2d":               now.Add(-48 * time.Hour),
+		"now-0.5d":             now.Add(-12 * time.Hour),
+		"2024-02-01":           time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC),
+		"2024-02-01 06:30":     time.Date(2024, 2, 1, 6, 30, 0, 0, time.UTC),
+		"2024-02-01T06:30:15Z": time.Date(2024, 2, 1, 6, 30, 15, 0, time.UTC),
+	}
+	for text, expected := range cases {
+		got, err := parseTime(text, now)
+		if err != nil || !got.Equal(expected) {
+			t.Fatalf("%s: expected %v, got %v, %v", text, expected, got, err)
+		}
+	}
+
+	for _, text := range []string{"", "now-", "now-xd", "yesterday", "2024-13-01"} {
+		if _, err := parseTime(text, now); err == nil {
+			t.Fatalf("%q: expected an error", text)
+		}
+	}
+}
+
+func TestParseTransforms(t *testing.T) {
+	steps, err := parseTransforms([]string{"derivative", ` moving_average ={"window": 3}`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(steps) != 2 || steps[0].Name != "derivative" || steps[0].Params != nil ||
+		steps[1].Name != "moving_average" || string(steps[1].Params) != `{"window": 3}` {
+		t.Fatalf("unexpected steps: %+v", steps)
+	}
+
+	if _, err = parseTransforms([]string{"spectrum={window: hann}"}); err == nil {
+		t.Fatal("expected invalid JSON to fail")
+	}
+}
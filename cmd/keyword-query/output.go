@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// writeFrames writes the frames in the chosen format.  CSV and table output separate frames with a
+// blank line, each with its own header.
+func writeFrames(w io.Writer, frames data.Frames, format string) error {
+	switch format {
+	case "csv":
+		for i, frame := range frames {
+			if i > 0 {
+				fmt.Fprintln(w)
+			}
+
+			cw := csv.NewWriter(w)
+			cw.Write(columnNames(frame))
+			for row := 0; row < rowCount(frame); row++ {
+				cw.Write(rowText(frame, row))
+			}
+			cw.Flush()
+			if err := cw.Error(); err != nil {
+				return err
+			}
+		}
+
+	case "table":
+		for i, frame := range frames {
+			if i > 0 {
+				fmt.Fprintln(w)
+			}
+
+			tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(tw, strings.Join(columnNames(frame), "\t"))
+			for row := 0; row < rowCount(frame); row++ {
+				fmt.Fprintln(tw, strings.Join(rowText(frame, row), "\t"))
+			}
+			if err := tw.Flush(); err != nil {
+				return err
+			}
+		}
+
+	case "json":
+		// One object per frame with a row object per sample, keyed by column
+		out := []map[string]interface{}{}
+		for _, frame := range frames {
+			names := columnNames(frame)
+			rows := []map[string]interface{}{}
+			for row := 0; row < rowCount(frame); row++ {
+				values := map[string]interface{}{}
+				for i, field := range frame.Fields {
+					v, _ := field.ConcreteAt(row)
+					// JSON has no NaN or infinity, a transform's missing value is written as a null
+					if f, ok := v.(float64); ok && (math.IsNaN(f) || math.IsInf(f, 0)) {
+						v = nil
+					}
+					values[names[i]] = v
+				}
+				rows = append(rows, values)
+			}
+			out = append(out, map[string]interface{}{"name": frame.Name, "rows": rows})
+		}
+
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(out)
+
+	default:
+		return fmt.Errorf("unknown output format: %s", format)
+	}
+
+	return nil
+}
+
+// columnNames names the fields, the datasource leaves a series' value field unnamed so it takes the
+// frame's name
+func columnNames(frame *data.Frame) []string {
+	names := make([]string, len(frame.Fields))
+	for i, field := range frame.Fields {
+		names[i] = field.Name
+		if names[i] == "" {
+			names[i] = frame.Name
+		}
+		if field.Config != nil && field.Config.Unit != "" {
+			names[i] += " (" + field.Config.Unit + ")"
+		}
+	}
+	return names
+}
+
+func rowCount(frame *data.Frame) int {
+	rows, err := frame.RowLen()
+	if err != nil {
+		return 0
+	}
+	return rows
+}
+
+// rowText formats a row of a frame, nulls are left empty
+func rowText(frame *data.Frame, row int) []string {
+	text := make([]string, len(frame.Fields))
+	for i, field := range frame.Fields {
+		v, ok := field.ConcreteAt(row)
+		if !ok {
+			continue
+		}
+
+		switch v := v.(type) {
+		case time.Time:
+			text[i] = v.UTC().Format(time.RFC3339Nano)
+		case float64:
+			text[i] = strconv.FormatFloat(v, 'g', -1, 64)
+		default:
+			text[i] = fmt.Sprint(v)
+		}
+	}
+	return text
+}
@@ -0,0 +1,281 @@
+package plugin
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// The versioned resource API lives under this path, the unversioned paths remain for older query editors
+const API_PREFIX = "/api/v1"
+
+// Items in a page of a list unless the caller asks for a different number, and the most allowed
+const (
+	API_DEFAULT_LIMIT = 100
+	API_MAX_LIMIT     = 5000
+)
+
+// apiPage says which part of a list a response holds
+type apiPage struct {
+	Offset int `json:"offset"`
+	Limit  int `json:"limit"`
+	Total  int `json:"total"`
+}
+
+// apiBody is the body of every successful API response, lists also say which page they are
+type apiBody struct {
+	Data interface{} `json:"data"`
+	Page *apiPage    `json:"page,omitempty"`
+}
+
+// apiErrorBody is the body of every error response, the API's and the unversioned paths' alike, so that
+// {"error": ...} keeps working for callers that only look for the message
+type apiErrorBody struct {
+	Error  string `json:"error"`
+	Status int    `json:"status"`
+}
+
+// statusError is an error with the HTTP status it should be answered with
+type statusError struct {
+	status int
+	err    error
+}
+
+func (e *statusError) Error() string {
+	return e.err.Error()
+}
+
+func (e *statusError) Unwrap() error {
+	return e.err
+}
+
+// withStatus gives an error the HTTP status to answer it with
+func withStatus(status int, err error) error {
+	return &statusError{status: status, err: err}
+}
+
+// errorStatus is the status an error is answered with, fallback unless it was given one
+func errorStatus(err error, fallback int) int {
+	var se *statusError
+	if errors.As(err, &se) {
+		return se.status
+	}
+	return fallback
+}
+
+// writeError answers with the uniform error body
+func writeError(rw http.ResponseWriter, status int, err error) {
+	writeJSON(rw, status, apiErrorBody{Error: err.Error(), Status: status})
+}
+
+// allowMethods answers any method not listed with 405 and the methods that are allowed
+func allowMethods(handler http.HandlerFunc, methods ...string) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		for _, method := range methods {
+			if req.Method == method {
+				handler(rw, req)
+				return
+			}
+		}
+
+		rw.Header().Set("Allow", strings.Join(methods, ", "))
+		writeError(rw, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed on %s", req.Method, req.URL.Path))
+	}
+}
+
+// apiHandler answers an API call with the data to return, or an error carrying its status.  Errors without
+// a status are the archive's and are answered with 500.
+type apiHandler func(req *http.Request) (*apiBody, error)
+
+// apiRoute turns an apiHandler into a handler for the mux, checking the method first
+func apiRoute(handler apiHandler, methods ...string) http.HandlerFunc {
+	return allowMethods(func(rw http.ResponseWriter, req *http.Request) {
+		body, err := handler(req)
+		if err != nil {
+			status := errorStatus(err, http.StatusInternalServerError)
+			if status >= http.StatusInternalServerError {
+				logger(req.Context()).Error(fl()+"resource call failed", "url", req.URL.String(), "error", err)
+			} else {
+				logger(req.Context()).Debug(fl()+"resource call refused", "url", req.URL.String(), "error", err)
+			}
+			writeError(rw, status, err)
+			return
+		}
+
+		writeJSON(rw, http.StatusOK, body)
+	}, methods...)
+}
+
+// paginate picks out the page of a list asked for by the offset and limit parameters
+func paginate[T any](req *http.Request, list []T) (*apiBody, error) {
+	params := req.URL.Query()
+	page := apiPage{Limit: API_DEFAULT_LIMIT, Total: len(list)}
+
+	var err error
+	if text := params.Get("offset"); text != "" {
+		page.Offset, err = strconv.Atoi(text)
+		if err != nil || page.Offset < 0 {
+			return nil, withStatus(http.StatusBadRequest, fmt.Errorf("offset must be a number from 0"))
+		}
+	}
+	if text := params.Get("limit"); text != "" {
+		page.Limit, err = strconv.Atoi(text)
+		if err != nil || page.Limit < 1 || page.Limit > API_MAX_LIMIT {
+			return nil, withStatus(http.StatusBadRequest, fmt.Errorf("limit must be a number from 1 to %d", API_MAX_LIMIT))
+		}
+	}
+
+	start := min(page.Offset, len(list))
+	end := min(start+page.Limit, len(list))
+
+	return &apiBody{Data: list[start:end], Page: &page}, nil
+}
+
+// apiCatalog returns the keyword catalog, or why there is no archive to answer from
+func (ds *KeywordDatasource) apiCatalog() (*keywordCatalog, error) {
+	_, err := ds.archive()
+	if err != nil {
+		return nil, withStatus(http.StatusServiceUnavailable, err)
+	}
+	return ds.catalog, nil
+}
+
+// routeAPI binds the versioned API's paths
+func (ds *KeywordDatasource) routeAPI(handle func(path string, handler http.HandlerFunc)) {
+	handle(API_PREFIX+"/services", apiRoute(ds.apiServices, http.MethodGet))
+	handle(API_PREFIX+"/services/{service}/keywords", apiRoute(ds.apiServiceKeywords, http.MethodGet))
+	handle(API_PREFIX+"/keywords/{keyword}", apiRoute(ds.apiKeyword, http.MethodGet))
+	handle(API_PREFIX+"/search", apiRoute(ds.apiSearch, http.MethodGet))
+	handle(API_PREFIX+"/conversions", apiRoute(ds.apiConversions, http.MethodGet))
+	handle(API_PREFIX+"/transforms", apiRoute(ds.apiTransforms, http.MethodGet))
+	handle(API_PREFIX+"/catalog", apiRoute(ds.apiCatalogStatus, http.MethodGet, http.MethodPost))
+	handle(API_PREFIX+"/export", allowMethods(ds.handleResourceExport, http.MethodGet))
+
+	// Anything else under the prefix is answered in the same form rather than with the mux's plain text
+	handle(API_PREFIX+"/", func(rw http.ResponseWriter, req *http.Request) {
+		writeError(rw, http.StatusNotFound, fmt.Errorf("no such resource: %s", req.URL.Path))
+	})
+}
+
+// ServiceSummary is a service in the API's list of services
+type ServiceSummary struct {
+	Name     string `json:"name"`
+	Keywords int    `json:"keywords"`
+}
+
+// apiServices lists the services with the number of keywords each has
+func (ds *KeywordDatasource) apiServices(req *http.Request) (*apiBody, error) {
+	catalog, err := ds.apiCatalog()
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot, err := catalog.snapshot(req.Context())
+	if err != nil {
+		return nil, err
+	}
+
+	services := make([]ServiceSummary, 0, len(snapshot.services))
+	for _, service := range snapshot.services {
+		services = append(services, ServiceSummary{Name: service, Keywords: len(snapshot.metadata[service])})
+	}
+
+	return paginate(req, services)
+}
+
+// apiServiceKeywords lists a service's keywords with their metadata
+func (ds *KeywordDatasource) apiServiceKeywords(req *http.Request) (*apiBody, error) {
+	catalog, err := ds.apiCatalog()
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot, err := catalog.snapshot(req.Context())
+	if err != nil {
+		return nil, err
+	}
+
+	service := req.PathValue("service")
+	list, ok := snapshot.metadata[service]
+	if !ok {
+		return nil, withStatus(http.StatusNotFound, fmt.Errorf("unknown service: %s", service))
+	}
+
+	return paginate(req, list)
+}
+
+// apiKeyword describes a single service.keyword
+func (ds *KeywordDatasource) apiKeyword(req *http.Request) (*apiBody, error) {
+	catalog, err := ds.apiCatalog()
+	if err != nil {
+		return nil, err
+	}
+
+	key := req.PathValue("keyword")
+	service, keyword, err := splitKeyword(key)
+	if err != nil {
+		return nil, withStatus(http.StatusBadRequest, err)
+	}
+
+	list, err := catalog.Metadata(req.Context(), service)
+	if err != nil {
+		return nil, err
+	}
+	for _, meta := range list {
+		if meta.Keyword == keyword {
+			return &apiBody{Data: meta}, nil
+		}
+	}
+
+	return nil, withStatus(http.StatusNotFound, fmt.Errorf("unknown keyword: %s", key))
+}
+
+// apiSearch ranks the keywords matching q, a page at a time
+func (ds *KeywordDatasource) apiSearch(req *http.Request) (*apiBody, error) {
+	catalog, err := ds.apiCatalog()
+	if err != nil {
+		return nil, err
+	}
+
+	params := req.URL.Query()
+	query := strings.TrimSpace(params.Get("q"))
+	if query == "" {
+		return nil, withStatus(http.StatusBadRequest, fmt.Errorf("the search needs a q parameter"))
+	}
+
+	entries, err := ds.search.load(req.Context(), catalog)
+	if err != nil {
+		return nil, err
+	}
+
+	return paginate(req, searchEntries(entries, query, params.Get("service"), SEARCH_MAX_LIMIT))
+}
+
+// apiConversions lists the unit conversion registry
+func (ds *KeywordDatasource) apiConversions(req *http.Request) (*apiBody, error) {
+	return paginate(req, UnitConversions())
+}
+
+// apiTransforms lists the transform registry
+func (ds *KeywordDatasource) apiTransforms(req *http.Request) (*apiBody, error) {
+	return paginate(req, Transforms())
+}
+
+// apiCatalogStatus reports the keyword catalog, a POST reads the archive's metadata again first
+func (ds *KeywordDatasource) apiCatalogStatus(req *http.Request) (*apiBody, error) {
+	catalog, err := ds.apiCatalog()
+	if err != nil {
+		return nil, err
+	}
+
+	if req.Method == http.MethodPost {
+		err = catalog.refresh(req.Context())
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &apiBody{Data: catalog.status()}, nil
+}
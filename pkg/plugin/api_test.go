@@ -0,0 +1,178 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+// callAPI calls a resource path through the mux with any method and decodes the JSON response
+func callAPI(t *testing.T, ds *KeywordDatasource, method string, path string) (int, map[string][]string, map[string]interface{}) {
+	t.Helper()
+
+	var status int
+	var headers map[string][]string
+	var body map[string]interface{}
+
+	err := ds.CallResource(context.Background(),
+		&backend.CallResourceRequest{Method: method, Path: strings.SplitN(path, "?", 2)[0], URL: path},
+		backend.CallResourceResponseSenderFunc(func(res *backend.CallResourceResponse) error {
+			status = res.Status
+			headers = res.Headers
+			return json.Unmarshal(res.Body, &body)
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return status, headers, body
+}
+
+// apiList is the data of a list response with its page
+func apiList(t *testing.T, body map[string]interface{}) ([]interface{}, map[string]interface{}) {
+	t.Helper()
+
+	list, ok := body["data"].([]interface{})
+	page, _ := body["page"].(map[string]interface{})
+	if !ok || page == nil {
+		t.Fatalf("expected a list with a page, got %v", body)
+	}
+	return list, page
+}
+
+func TestAPIRoutes(t *testing.T) {
+	ds := newTestDatasource(t)
+
+	status, _, body := callAPI(t, ds, http.MethodGet, "/api/v1/services")
+	services, page := apiList(t, body)
+	if status != http.StatusOK || len(services) != 2 || page["total"] != 2.0 {
+		t.Fatalf("unexpected services %d: %v", status, body)
+	}
+	if first := services[0].(map[string]interface{}); first["name"] != "dcs" || first["keywords"] != 1.0 {
+		t.Fatalf("unexpected service: %v", first)
+	}
+
+	status, _, body = callAPI(t, ds, http.MethodGet, "/api/v1/services/dcs/keywords")
+	keywords, _ := apiList(t, body)
+	if status != http.StatusOK || len(keywords) != 1 || keywords[0].(map[string]interface{})["units"] != "deg" {
+		t.Fatalf("unexpected keywords %d: %v", status, body)
+	}
+
+	status, _, body = callAPI(t, ds, http.MethodGet, "/api/v1/keywords/dcs.AZ")
+	if meta, _ := body["data"].(map[string]interface{}); status != http.StatusOK || meta["description"] != "Telescope azimuth" {
+		t.Fatalf("unexpected keyword %d: %v", status, body)
+	}
+
+	status, _, body = callAPI(t, ds, http.MethodGet, "/api/v1/search?q=ramp")
+	results, _ := apiList(t, body)
+	if status != http.StatusOK || len(results) != 1 || results[0].(map[string]interface{})["keyword"] != "RAMP" {
+		t.Fatalf("unexpected search %d: %v", status, body)
+	}
+
+	for _, path := range []string{"/api/v1/conversions", "/api/v1/transforms"} {
+		status, _, body = callAPI(t, ds, http.MethodGet, path)
+		if list, _ := apiList(t, body); status != http.StatusOK || len(list) == 0 {
+			t.Fatalf("unexpected %s %d: %v", path, status, body)
+		}
+	}
+
+	for _, method := range []string{http.MethodGet, http.MethodPost} {
+		status, _, body = callAPI(t, ds, method, "/api/v1/catalog")
+		if catalog, _ := body["data"].(map[string]interface{}); status != http.StatusOK || catalog["keywords"] != 2.0 {
+			t.Fatalf("unexpected catalog from %s %d: %v", method, status, body)
+		}
+	}
+
+	from := strconv.FormatInt(testEpoch.UnixMilli(), 10)
+	to := strconv.FormatInt(testEpoch.Add(time.Second).UnixMilli(), 10)
+	status, headers, raw, _ := callResourceRaw(t, ds, "/api/v1/export?keyword=test.RAMP&from="+from+"&to="+to)
+	if status != http.StatusOK || headers["Content-Type"][0] != "text/csv" || !strings.HasPrefix(string(raw), "time,keyword,value\n") {
+		t.Fatalf("unexpected export %d %v: %s", status, headers, raw)
+	}
+
+	// The unversioned paths still answer the older query editors
+	for _, path := range []string{"/services", "/keywords?service=dcs", "/conversions", "/transforms", "/search?q=az", "/catalog"} {
+		status, _, body = callAPI(t, ds, http.MethodGet, path)
+		if status != http.StatusOK || body["error"] != nil {
+			t.Fatalf("unexpected %s %d: %v", path, status, body)
+		}
+	}
+}
+
+func TestAPIPagination(t *testing.T) {
+	ds := newTestDatasource(t)
+
+	_, _, body := callAPI(t, ds, http.MethodGet, "/api/v1/transforms")
+	all, _ := apiList(t, body)
+
+	_, _, body = callAPI(t, ds, http.MethodGet, "/api/v1/transforms?offset=1&limit=2")
+	list, page := apiList(t, body)
+	if len(list) != 2 || page["offset"] != 1.0 || page["limit"] != 2.0 || page["total"] != float64(len(all)) {
+		t.Fatalf("unexpected page: %v", body)
+	}
+	if list[0].(map[string]interface{})["name"] != all[1].(map[string]interface{})["name"] {
+		t.Fatalf("page does not start at the offset: %v", list)
+	}
+
+	// Past the end is an empty page rather than an error
+	_, _, body = callAPI(t, ds, http.MethodGet, "/api/v1/transforms?offset=1000")
+	if list, _ = apiList(t, body); len(list) != 0 {
+		t.Fatalf("expected an empty page, got %v", list)
+	}
+
+	for _, query := range []string{"offset=-1", "limit=0", "limit=5001", "limit=many"} {
+		status, _, body := callAPI(t, ds, http.MethodGet, "/api/v1/services?"+query)
+		if status != http.StatusBadRequest || body["status"] != 400.0 || body["error"] == nil {
+			t.Fatalf("expected a bad request for %s, got %d: %v", query, status, body)
+		}
+	}
+}
+
+func TestAPIErrors(t *testing.T) {
+	ds := newTestDatasource(t)
+
+	cases := []struct {
+		method string
+		path   string
+		status int
+	}{
+		{http.MethodGet, "/api/v1/services/nope/keywords", http.StatusNotFound},
+		{http.MethodGet, "/api/v1/keywords/dcs.NOPE", http.StatusNotFound},
+		{http.MethodGet, "/api/v1/keywords/AZ", http.StatusBadRequest},
+		{http.MethodGet, "/api/v1/search", http.StatusBadRequest},
+		{http.MethodGet, "/api/v1/export?keyword=test.RAMP", http.StatusBadRequest},
+		{http.MethodGet, "/api/v1/nothing", http.StatusNotFound},
+		{http.MethodPost, "/api/v1/services", http.StatusMethodNotAllowed},
+		{http.MethodDelete, "/api/v1/catalog", http.StatusMethodNotAllowed},
+		{http.MethodPost, "/services", http.StatusMethodNotAllowed},
+		{http.MethodPut, "/keywords?service=dcs", http.StatusMethodNotAllowed},
+		{http.MethodGet, "/keywords", http.StatusBadRequest},
+	}
+
+	for _, c := range cases {
+		status, headers, body := callAPI(t, ds, c.method, c.path)
+		if status != c.status || body["status"] != float64(c.status) || body["error"] == "" {
+			t.Fatalf("%s %s: expected %d, got %d: %v", c.method, c.path, c.status, status, body)
+		}
+		if c.status == http.StatusMethodNotAllowed && len(headers["Allow"]) == 0 {
+			t.Fatalf("%s %s: expected the allowed methods", c.method, c.path)
+		}
+	}
+
+	// Without an archive the API is unavailable rather than the request bad
+	config, _ := parseSettings([]byte(`{}`))
+	empty := newKeywordDatasource(config, nil)
+	for _, path := range []string{"/api/v1/services", "/services"} {
+		status, _, body := callAPI(t, empty, http.MethodGet, path)
+		if status != http.StatusServiceUnavailable || body["status"] != 503.0 {
+			t.Fatalf("%s: expected the archive to be unavailable, got %d: %v", path, status, body)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+)
+
+// ArchiveStore is where the datasource reads keywords from.  The Postgres keyword archive is the usual
+// one, the in-memory store serves fixtures for tests.  Values come back as the archived text so that the
+// parsing (sexagesimal and so on) and calibration are the same whatever the store.
+type ArchiveStore interface {
+	// Services lists every service in the archive, sorted
+	Services(ctx context.Context) ([]string, error)
+
+	// Keywords lists a service's keywords, sorted
+	Keywords(ctx context.Context, service string) ([]string, error)
+
+	// Samples returns a keyword's samples between from and to inclusive, in time order
+	Samples(ctx context.Context, service string, keyword string, from time.Time, to time.Time) ([]time.Time, []string, error)
+
+	// Latest returns a keyword's last sample at or before the time, ok is false if there is none
+	Latest(ctx context.Context, service string, keyword string, before time.Time) (t time.Time, value string, ok bool, err error)
+
+	// Metadata describes each of a service's keywords, sorted by keyword
+	Metadata(ctx context.Context, service string) ([]KeywordMetadata, error)
+
+	// Ping checks the archive can be reached
+	Ping(ctx context.Context) error
+
+	// Close releases any connections, the store is not used afterwards
+	Close() error
+}
+
+// KeywordMetadata is what the archive's metadata table says about a keyword
+type KeywordMetadata struct {
+	Service     string `json:"service"`
+	Keyword     string `json:"keyword"`
+	Units       string `json:"units,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+// The kinds of archive a datasource can read
+const (
+	BACKEND_POSTGRES = "postgres"
+	BACKEND_FILES    = "files"
+	BACKEND_SQLITE   = "sqlite"
+
+	// Several archives read as one, see federatedStore
+	BACKEND_FEDERATED = "federated"
+)
+
+// newArchiveStore opens the store the settings describe, Postgres unless another backend is chosen
+func newArchiveStore(settings *DatasourceSettings) (ArchiveStore, error) {
+	switch settings.Backend {
+	case "", BACKEND_POSTGRES:
+		return newPostgresStore(settings)
+	case BACKEND_FILES:
+		return newFileStore(settings)
+	case BACKEND_SQLITE:
+		return newSQLiteStore(settings)
+	case BACKEND_FEDERATED:
+		return newFederatedStore(settings)
+	default:
+		return nil, fmt.Errorf("unknown archive backend: %s", settings.Backend)
+	}
+}
+
+// keywordMetadata finds a single keyword in its service's metadata
+func keywordMetadata(ctx context.Context, store ArchiveStore, service string, keyword string) (KeywordMetadata, error) {
+	all, err := store.Metadata(ctx, service)
+	if err != nil {
+		return KeywordMetadata{}, err
+	}
+
+	for _, meta := range all {
+		if meta.Keyword == keyword {
+			return meta, nil
+		}
+	}
+
+	return KeywordMetadata{}, fmt.Errorf("no metadata for %s.%s", service, keyword)
+}
+
+// hasWildcard reports whether a name is a pattern, using the *, ? and [...] of path.Match
+func hasWildcard(name string) bool {
+	return strings.ContainsAny(name, "*?[")
+}
+
+// expandKeywords replaces service.keyword patterns such as "dcs.*" or "*.DISPSTA" with the keywords they
+// match, in the order given and without repeats.  Names without a wildcard are kept whether or not the
+// archive lists them.
+func expandKeywords(ctx context.Context, store ArchiveStore, keys []string) ([]string, error) {
+	var expanded []string
+	seen := map[string]bool{}
+	add := func(key string) {
+		if !seen[key] {
+			expanded = append(expanded, key)
+			seen[key] = true
+		}
+	}
+
+	for _, key := range keys {
+		if !hasWildcard(key) {
+			add(key)
+			continue
+		}
+
+		servicePattern, keywordPattern, err := splitKeyword(key)
+		if err != nil {
+			return nil, err
+		}
+
+		services := []string{servicePattern}
+		if hasWildcard(servicePattern) {
+			services, err = store.Services(ctx)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		for _, service := range services {
+			ok, err := path.Match(servicePattern, service)
+			if err != nil {
+				return nil, fmt.Errorf("invalid keyword pattern %s: %w", key, err)
+			}
+			if !ok {
+				continue
+			}
+
+			keywords, err := store.Keywords(ctx, service)
+			if err != nil {
+				return nil, err
+			}
+			for _, keyword := range keywords {
+				ok, err := path.Match(keywordPattern, keyword)
+				if err != nil {
+					return nil, fmt.Errorf("invalid keyword pattern %s: %w", key, err)
+				}
+				if ok {
+					add(service + "." + keyword)
+				}
+			}
+		}
+	}
+
+	return expanded, nil
+}
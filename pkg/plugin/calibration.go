@@ -0,0 +1,205 @@
+package plugin
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// Calibration converts the raw reading of a sensor keyword (a voltage, ADC counts, etc.) into physical units.
+// Exactly one of Polynomial, Table or Conversion is expected to be set.
+type Calibration struct {
+	// Polynomial coefficients, lowest order first: c0 + c1*x + c2*x² + ...
+	Polynomial []float64 `json:"polynomial,omitempty"`
+
+	// Piecewise-linear lookup table of [raw, calibrated] pairs in ascending raw order.  Values outside
+	// the table are clamped to the first or last calibrated value.
+	Table [][2]float64 `json:"table,omitempty"`
+
+	// Name of a conversion in the unit conversion registry
+	Conversion string `json:"conversion,omitempty"`
+
+	// Automatic calibrations are applied to every query of the keyword unless the query opts out
+	Automatic bool `json:"automatic"`
+
+	// Units of the calibrated value, informational only
+	Units string `json:"units,omitempty"`
+}
+
+// Query calibration modes, these are the values of queryModel.Calibrate
+const (
+	CALIBRATE_AUTO   = ""
+	CALIBRATE_ALWAYS = "always"
+	CALIBRATE_NEVER  = "never"
+)
+
+// calibrationCatalog holds the compiled calibrations of a datasource instance, keyed by service.keyword.
+// Entries that failed validation are kept in invalid so a query of that keyword reports the problem.
+type calibrationCatalog struct {
+	entries map[string]compiledCalibration
+	invalid map[string]error
+}
+
+type compiledCalibration struct {
+	automatic bool
+	apply     func(float64) float64
+	units     string
+}
+
+// newCalibrationCatalog validates and compiles the catalog from the datasource settings.  The returned
+// catalog is always usable, the error joins every problem found so it can be reported by CheckHealth.
+func newCalibrationCatalog(calibrations map[string]Calibration) (*calibrationCatalog, error) {
+	catalog := &calibrationCatalog{
+		entries: map[string]compiledCalibration{},
+		invalid: map[string]error{},
+	}
+
+	// Walk the keys in order so the joined error reads the same way every time
+	keys := make([]string, 0, len(calibrations))
+	for key := range calibrations {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var errs []error
+	for _, key := range keys {
+		apply, err := compileCalibration(key, calibrations[key])
+		if err != nil {
+			err = fmt.Errorf("calibration %s: %w", key, err)
+			catalog.invalid[key] = err
+			errs = append(errs, err)
+			continue
+		}
+
+		catalog.entries[key] = compiledCalibration{
+			automatic: calibrations[key].Automatic,
+			apply:     apply,
+			units:     calibrations[key].Units,
+		}
+	}
+
+	return catalog, errors.Join(errs...)
+}
+
+// compileCalibration checks a single calibration and returns the function that applies it
+func compileCalibration(key string, c Calibration) (func(float64) float64, error) {
+	// Keys are named the same way as the keywords of a query, whose names may themselves contain a dot
+	_, _, err := splitKeyword(key)
+	if err != nil {
+		return nil, err
+	}
+
+	set := 0
+	if len(c.Polynomial) > 0 {
+		set++
+	}
+	if len(c.Table) > 0 {
+		set++
+	}
+	if c.Conversion != "" {
+		set++
+	}
+	if set != 1 {
+		return nil, fmt.Errorf("exactly one of polynomial, table or conversion must be given")
+	}
+
+	switch {
+	case len(c.Polynomial) > 0:
+		coefficients := append([]float64(nil), c.Polynomial...)
+		return func(x float64) float64 {
+			// Horner's method, from the highest order coefficient down
+			y := 0.0
+			for i := len(coefficients) - 1; i >= 0; i-- {
+				y = y*x + coefficients[i]
+			}
+			return y
+		}, nil
+
+	case len(c.Table) > 0:
+		if len(c.Table) < 2 {
+			return nil, fmt.Errorf("table needs at least two points")
+		}
+		for i, point := range c.Table {
+			// NaN compares false against everything so would slip past the ordering check
+			if math.IsNaN(point[0]) || math.IsNaN(point[1]) {
+				return nil, fmt.Errorf("table point %d is not a number", i)
+			}
+			if i > 0 && point[0] <= c.Table[i-1][0] {
+				return nil, fmt.Errorf("table raw values must be strictly ascending (point %d)", i)
+			}
+		}
+		table := append([][2]float64(nil), c.Table...)
+		return func(x float64) float64 {
+			return interpolateTable(table, x)
+		}, nil
+
+	default:
+		conversion, err := LookupUnitConversion(c.Conversion, 0, 0)
+		if err != nil {
+			return nil, err
+		}
+		if conversion.Custom {
+			return nil, fmt.Errorf("conversion %s needs query parameters, use a polynomial instead", c.Conversion)
+		}
+		return conversion.Convert, nil
+	}
+}
+
+// interpolateTable looks up x in a piecewise-linear table, clamping at either end
+func interpolateTable(table [][2]float64, x float64) float64 {
+	// A NaN sample is in no segment, searching for it would run off the end of the table
+	if math.IsNaN(x) {
+		return x
+	}
+
+	if x <= table[0][0] {
+		return table[0][1]
+	}
+
+	last := len(table) - 1
+	if x >= table[last][0] {
+		return table[last][1]
+	}
+
+	// Find the first point above x, the segment is the one ending there
+	i := sort.Search(len(table), func(i int) bool { return table[i][0] > x })
+	x0, y0 := table[i-1][0], table[i-1][1]
+	x1, y1 := table[i][0], table[i][1]
+
+	return y0 + (x-x0)*(y1-y0)/(x1-x0)
+}
+
+// lookup returns the calibration to apply to a keyword for the given query mode, or nil if there is none
+func (c *calibrationCatalog) lookup(key string, mode string) (func(float64) float64, error) {
+	if c == nil || mode == CALIBRATE_NEVER {
+		return nil, nil
+	}
+
+	switch mode {
+	case CALIBRATE_AUTO, CALIBRATE_ALWAYS:
+	default:
+		return nil, fmt.Errorf("unknown calibration mode: %s", mode)
+	}
+
+	if err, ok := c.invalid[key]; ok {
+		return nil, err
+	}
+
+	entry, ok := c.entries[key]
+	if !ok || (mode == CALIBRATE_AUTO && !entry.automatic) {
+		return nil, nil
+	}
+
+	return entry.apply, nil
+}
+
+// units returns the units of a keyword's calibrated values if the query mode applies a calibration to it
+func (c *calibrationCatalog) units(key string, mode string) (string, bool) {
+	apply, err := c.lookup(key, mode)
+	if err != nil || apply == nil {
+		return "", false
+	}
+
+	return c.entries[key].units, true
+}
@@ -0,0 +1,110 @@
+package plugin
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestCalibrationApply(t *testing.T) {
+	table := [][2]float64{{0, 10}, {1, 20}, {3, 0}}
+
+	cases := []struct {
+		name        string
+		calibration Calibration
+		raw         float64
+		expected    float64
+	}{
+		// c0 + c1*x + c2*x²
+		{"constant", Calibration{Polynomial: []float64{5}}, 3, 5},
+		{"linear", Calibration{Polynomial: []float64{1, 2}}, 3, 7},
+		{"quadratic", Calibration{Polynomial: []float64{1, -2, 0.5}}, 4, 1},
+		{"negative", Calibration{Polynomial: []float64{0, 0, 0, 1}}, -2, -8},
+		// Linear between the points, exact on them
+		{"on a point", Calibration{Table: table}, 1, 20},
+		{"first segment", Calibration{Table: table}, 0.25, 12.5},
+		{"falling segment", Calibration{Table: table}, 2.5, 5},
+		// Clamped to the calibrated value at either end rather than extrapolated
+		{"below the table", Calibration{Table: table}, -5, 10},
+		{"above the table", Calibration{Table: table}, 100, 0},
+		// A conversion from the registry
+		{"conversion", Calibration{Conversion: "c_to_k"}, 20, 293.15},
+	}
+
+	for _, c := range cases {
+		apply, err := compileCalibration("dcs.AZ", c.calibration)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if got := apply(c.raw); math.Abs(got-c.expected) > 1e-9 {
+			t.Fatalf("%s: expected %v for %v, got %v", c.name, c.expected, c.raw, got)
+		}
+	}
+
+	// A missing sample stays missing whatever the form
+	for _, calibration := range []Calibration{{Table: table}, {Polynomial: []float64{1, 2}}} {
+		apply, err := compileCalibration("dcs.AZ", calibration)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := apply(math.NaN()); !math.IsNaN(got) {
+			t.Fatalf("%+v: expected NaN, got %v", calibration, got)
+		}
+	}
+}
+
+func TestCalibrationValidation(t *testing.T) {
+	cases := []struct {
+		name        string
+		key         string
+		calibration Calibration
+		expected    string
+	}{
+		{"no service", "AZ", Calibration{Polynomial: []float64{1}}, "service.keyword"},
+		{"empty keyword", "dcs.", Calibration{Polynomial: []float64{1}}, "service.keyword"},
+		{"nothing", "dcs.AZ", Calibration{}, "exactly one"},
+		{"two forms", "dcs.AZ", Calibration{Polynomial: []float64{1}, Conversion: "c_to_k"}, "exactly one"},
+		{"one point", "dcs.AZ", Calibration{Table: [][2]float64{{0, 1}}}, "two points"},
+		{"unsorted", "dcs.AZ", Calibration{Table: [][2]float64{{0, 1}, {2, 3}, {1, 2}}}, "ascending (point 2)"},
+		{"duplicate", "dcs.AZ", Calibration{Table: [][2]float64{{0, 1}, {0, 2}}}, "ascending (point 1)"},
+		{"NaN raw", "dcs.AZ", Calibration{Table: [][2]float64{{0, 1}, {math.NaN(), 2}, {3, 4}}}, "point 1 is not a number"},
+		{"NaN calibrated", "dcs.AZ", Calibration{Table: [][2]float64{{0, math.NaN()}, {1, 2}}}, "point 0 is not a number"},
+		{"unknown conversion", "dcs.AZ", Calibration{Conversion: "nope"}, "unknown unit conversion"},
+		{"custom conversion", "dcs.AZ", Calibration{Conversion: UNIT_CONVERSION_SCALE_OFFSET}, "query parameters"},
+	}
+
+	for _, c := range cases {
+		_, err := compileCalibration(c.key, c.calibration)
+		if err == nil || !strings.Contains(err.Error(), c.expected) {
+			t.Fatalf("%s: expected an error containing %q, got %v", c.name, c.expected, err)
+		}
+	}
+
+	// A keyword whose name has a dot in it is split on the first one, the same as in a query
+	if _, err := compileCalibration("dcs.AZ.RAW", Calibration{Polynomial: []float64{1}}); err != nil {
+		t.Fatalf("expected a dotted keyword to be accepted, got %v", err)
+	}
+
+	// A bad entry is reported on its own and for queries of that keyword, the rest of the catalog still works
+	catalog, err := newCalibrationCatalog(map[string]Calibration{
+		"dcs.AZ": {Polynomial: []float64{0, 2}, Automatic: true, Units: "arcsec"},
+		"dcs.EL": {},
+	})
+	if err == nil || !strings.Contains(err.Error(), "calibration dcs.EL") {
+		t.Fatalf("expected the bad entry to be reported, got %v", err)
+	}
+	if _, err = catalog.lookup("dcs.EL", CALIBRATE_AUTO); err == nil {
+		t.Fatalf("expected a query of the bad entry to fail")
+	}
+
+	apply, err := catalog.lookup("dcs.AZ", CALIBRATE_AUTO)
+	if err != nil || apply == nil || apply(3) != 6 {
+		t.Fatalf("expected the automatic calibration to apply, got %v", err)
+	}
+	if apply, _ = catalog.lookup("dcs.AZ", CALIBRATE_NEVER); apply != nil {
+		t.Fatalf("expected never to skip the calibration")
+	}
+	if units, ok := catalog.units("dcs.AZ", CALIBRATE_ALWAYS); !ok || units != "arcsec" {
+		t.Fatalf("expected the calibrated units, got %q", units)
+	}
+}
@@ -0,0 +1,316 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// How long the keyword catalog is kept before it is read again, unless the settings say otherwise
+const CATALOG_DEFAULT_REFRESH = 10 * time.Minute
+
+// A keyword missing from the catalog reads it again, but no more often than this, so that a keyword added
+// since the last refresh can be queried straight away without a typo rereading the metadata on every query
+const CATALOG_MISS_REFRESH = 30 * time.Second
+
+// Most added or removed keywords named in the refresh log line, the counts are always given
+const CATALOG_LOG_CHANGES = 20
+
+// catalogSnapshot is the catalog as read at one time, it is not changed once made
+type catalogSnapshot struct {
+	services []string
+	metadata map[string][]KeywordMetadata
+	keywords int
+	loaded   time.Time
+
+	// Counts the refreshes, so that what is built from the catalog knows when to rebuild
+	generation int
+}
+
+// has reports whether a service.keyword is in the snapshot
+func (s *catalogSnapshot) has(service string, keyword string) bool {
+	list := s.metadata[service]
+	i := sort.Search(len(list), func(i int) bool { return list[i].Keyword >= keyword })
+	return i < len(list) && list[i].Keyword == keyword
+}
+
+// catalogChanges are the keywords added and removed between two refreshes
+type catalogChanges struct {
+	Added   []string `json:"added"`
+	Removed []string `json:"removed"`
+}
+
+// CatalogStatus is what the /catalog resource reports
+type CatalogStatus struct {
+	Loaded         *time.Time     `json:"loaded,omitempty"`
+	RefreshSeconds float64        `json:"refreshSeconds"`
+	Services       int            `json:"services"`
+	Keywords       int            `json:"keywords"`
+	LastChanges    catalogChanges `json:"lastChanges"`
+}
+
+// keywordCatalog holds every service and keyword of the archive, with their metadata, so that the
+// dropdowns, validation and wildcards do not go to the metadata table each time.  It is read on first use
+// and again once it is older than the refresh interval, or when asked.  Samples and everything else pass
+// through to the archive.
+type keywordCatalog struct {
+	ArchiveStore
+	settings *DatasourceSettings
+
+	// How often to read the metadata again, zero only refreshes when asked
+	every time.Duration
+
+	mu      sync.Mutex
+	current *catalogSnapshot
+	changes catalogChanges
+}
+
+func newKeywordCatalog(store ArchiveStore, settings *DatasourceSettings, every time.Duration) *keywordCatalog {
+	return &keywordCatalog{ArchiveStore: store, settings: settings, every: every}
+}
+
+// snapshot returns the catalog, reading the archive if it has never been read or has expired.  A failed
+// refresh keeps the previous catalog rather than leaving the dropdowns empty.
+func (c *keywordCatalog) snapshot(ctx context.Context) (*catalogSnapshot, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	expired := c.current != nil && c.every > 0 && time.Since(c.current.loaded) >= c.every
+	cacheResult("catalog", c.current != nil && !expired)
+	if c.current != nil && !expired {
+		return c.current, nil
+	}
+
+	err := c.refreshLocked(ctx)
+	if err != nil {
+		if c.current == nil {
+			return nil, err
+		}
+		logger(ctx).Warn(fl()+"keyword catalog refresh failed, keeping the previous one", "loaded", c.current.loaded,
+			"error", err)
+	}
+
+	return c.current, nil
+}
+
+// refresh reads the archive's metadata again now
+func (c *keywordCatalog) refresh(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.refreshLocked(ctx)
+}
+
+// refreshLocked reads the metadata of every service and notes what changed, the lock must be held
+func (c *keywordCatalog) refreshLocked(ctx context.Context) error {
+	ctx, span := startSpan(ctx, "refresh catalog")
+	var err error
+	defer func() { endSpan(span, err) }()
+
+	start := time.Now()
+	defer observeArchive(c.settings, "catalog", start)
+
+	services, err := c.ArchiveStore.Services(ctx)
+	if err != nil {
+		return err
+	}
+
+	// A service whose metadata cannot be read keeps what the previous catalog had for it, so that an archive
+	// of a federation being down leaves its keywords in place rather than holding back every other service.
+	// Only every service failing fails the refresh.
+	previous := c.current
+	next := &catalogSnapshot{
+		services: services,
+		metadata: make(map[string][]KeywordMetadata, len(services)),
+		loaded:   time.Now(),
+	}
+	var failures []error
+	for _, service := range services {
+		list, metaErr := c.ArchiveStore.Metadata(ctx, service)
+		if metaErr != nil {
+			failures = append(failures, fmt.Errorf("%s: %w", service, metaErr))
+			if previous != nil {
+				list = previous.metadata[service]
+			}
+			logger(ctx).Warn(fl()+"cannot read a service's metadata, keeping the previous", "service", service,
+				"keywords", len(list), "error", metaErr)
+		} else {
+			// The archive orders the keywords by its collation, which need not match Go's byte order that
+			// has() searches in, so sort a copy rather than the store's own list
+			list = append([]KeywordMetadata(nil), list...)
+			sort.Slice(list, func(i, j int) bool { return list[i].Keyword < list[j].Keyword })
+		}
+		next.metadata[service] = list
+		next.keywords += len(list)
+	}
+	if len(failures) > 0 && len(failures) == len(services) {
+		err = errors.Join(failures...)
+		return err
+	}
+
+	if previous != nil {
+		next.generation = previous.generation + 1
+		c.changes = compareCatalogs(previous, next)
+	}
+	c.current = next
+	span.SetAttributes(ATTR_ROWS.Int(next.keywords))
+
+	if previous == nil {
+		logger(ctx).Info(fl()+"keyword catalog loaded", "services", len(services), "keywords", next.keywords,
+			"duration", time.Since(start))
+	} else if len(c.changes.Added) > 0 || len(c.changes.Removed) > 0 {
+		logger(ctx).Info(fl()+"keyword catalog changed", "services", len(services), "keywords", next.keywords,
+			"added", len(c.changes.Added), "removed", len(c.changes.Removed),
+			"addedKeywords", firstNames(c.changes.Added, CATALOG_LOG_CHANGES),
+			"removedKeywords", firstNames(c.changes.Removed, CATALOG_LOG_CHANGES))
+	} else {
+		logger(ctx).Debug(fl()+"keyword catalog unchanged", "keywords", next.keywords, "duration", time.Since(start))
+	}
+
+	return nil
+}
+
+// compareCatalogs lists the service.keyword names only in the newer catalog and only in the older one
+func compareCatalogs(older *catalogSnapshot, newer *catalogSnapshot) catalogChanges {
+	changes := catalogChanges{Added: []string{}, Removed: []string{}}
+
+	for service, list := range newer.metadata {
+		for _, meta := range list {
+			if !older.has(service, meta.Keyword) {
+				changes.Added = append(changes.Added, service+"."+meta.Keyword)
+			}
+		}
+	}
+	for service, list := range older.metadata {
+		for _, meta := range list {
+			if !newer.has(service, meta.Keyword) {
+				changes.Removed = append(changes.Removed, service+"."+meta.Keyword)
+			}
+		}
+	}
+
+	sort.Strings(changes.Added)
+	sort.Strings(changes.Removed)
+	return changes
+}
+
+// firstNames shortens a list for a log line
+func firstNames(names []string, n int) []string {
+	if len(names) > n {
+		return names[:n]
+	}
+	return names
+}
+
+// Services lists the services from the catalog
+func (c *keywordCatalog) Services(ctx context.Context) ([]string, error) {
+	s, err := c.snapshot(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return s.services, nil
+}
+
+// Keywords lists a service's keywords from the catalog
+func (c *keywordCatalog) Keywords(ctx context.Context, service string) ([]string, error) {
+	s, err := c.snapshot(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	keywords := make([]string, 0, len(s.metadata[service]))
+	for _, meta := range s.metadata[service] {
+		keywords = append(keywords, meta.Keyword)
+	}
+	return keywords, nil
+}
+
+// Metadata describes a service's keywords from the catalog
+func (c *keywordCatalog) Metadata(ctx context.Context, service string) ([]KeywordMetadata, error) {
+	s, err := c.snapshot(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return s.metadata[service], nil
+}
+
+// validate checks that each keyword is in the catalog, reading it again once if one is not in case the
+// keyword was added since
+func (c *keywordCatalog) validate(ctx context.Context, keys []string) error {
+	s, err := c.snapshot(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		service, keyword, err := splitKeyword(key)
+		if err != nil {
+			return err
+		}
+		if s.has(service, keyword) {
+			continue
+		}
+
+		if time.Since(s.loaded) >= CATALOG_MISS_REFRESH {
+			err = c.refresh(ctx)
+			if err != nil {
+				return err
+			}
+			s, err = c.snapshot(ctx)
+			if err != nil {
+				return err
+			}
+			if s.has(service, keyword) {
+				continue
+			}
+		}
+
+		return fmt.Errorf("unknown keyword: %s", key)
+	}
+
+	return nil
+}
+
+// status describes the catalog without reading it
+func (c *keywordCatalog) status() CatalogStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	status := CatalogStatus{RefreshSeconds: c.every.Seconds(), LastChanges: c.changes}
+	if c.current != nil {
+		status.Loaded = &c.current.loaded
+		status.Services = len(c.current.services)
+		status.Keywords = c.current.keywords
+	}
+	if status.LastChanges.Added == nil {
+		status.LastChanges = catalogChanges{Added: []string{}, Removed: []string{}}
+	}
+	return status
+}
+
+// handleResourceCatalog reports the state of the keyword catalog, a POST reads the archive's metadata again
+// straight away rather than waiting for the next refresh
+func (ds *KeywordDatasource) handleResourceCatalog(rw http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	_, err := ds.archive()
+	if err != nil {
+		logger(ctx).Error(fl()+"archive unavailable", "error", err)
+		writeResult(rw, "?", nil, withStatus(http.StatusServiceUnavailable, err))
+		return
+	}
+
+	if req.Method == http.MethodPost {
+		err = ds.catalog.refresh(ctx)
+		if err != nil {
+			logger(ctx).Error(fl()+"keyword catalog refresh failure", "error", err)
+			writeResult(rw, "?", nil, withStatus(http.StatusInternalServerError, err))
+			return
+		}
+	}
+
+	writeResult(rw, "catalog", ds.catalog.status(), nil)
+}
@@ -0,0 +1,138 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+func TestCatalog(t *testing.T) {
+	ds := newTestDatasource(t)
+	store := ds.store.(*MemoryStore)
+
+	_, body := callResource(t, ds, "/keywords?service=test")
+	if keywords, _ := body["keywords"].(map[string]interface{}); len(keywords) != 1 {
+		t.Fatalf("unexpected keywords: %v", body)
+	}
+
+	// A keyword added to the archive is not seen until the catalog is read again
+	store.AddKeyword(KeywordMetadata{Service: "test", Keyword: "NEW"})
+	store.RemoveKeyword("dcs.AZ")
+	_, body = callResource(t, ds, "/keywords?service=test")
+	if keywords, _ := body["keywords"].(map[string]interface{}); len(keywords) != 1 {
+		t.Fatalf("expected the catalog to be kept, got %v", body)
+	}
+
+	// Asking for a refresh finds the changes
+	var status CatalogStatus
+	err := ds.CallResource(context.Background(),
+		&backend.CallResourceRequest{Method: http.MethodPost, Path: "/catalog", URL: "/catalog"},
+		backend.CallResourceResponseSenderFunc(func(res *backend.CallResourceResponse) error {
+			var body map[string]CatalogStatus
+			err := json.Unmarshal(res.Body, &body)
+			status = body["catalog"]
+			return err
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Services != 1 || status.Keywords != 2 ||
+		strings.Join(status.LastChanges.Added, ",") != "test.NEW" || strings.Join(status.LastChanges.Removed, ",") != "dcs.AZ" {
+		t.Fatalf("unexpected catalog status: %+v", status)
+	}
+
+	_, body = callResource(t, ds, "/services")
+	if services, _ := body["services"].(map[string]interface{}); len(services) != 1 {
+		t.Fatalf("expected the removed service to be gone, got %v", body)
+	}
+
+	// An expired catalog is read again on the next use
+	ds.catalog.every = time.Nanosecond
+	store.AddKeyword(KeywordMetadata{Service: "test", Keyword: "LATER"})
+	keywords, err := ds.catalog.Keywords(context.Background(), "test")
+	if err != nil || strings.Join(keywords, ",") != "LATER,NEW,RAMP" {
+		t.Fatalf("unexpected keywords %v: %v", keywords, err)
+	}
+}
+
+func TestCatalogValidation(t *testing.T) {
+	ds := newTestDatasource(t)
+
+	res := runQuery(t, ds, QUERY_TYPE_TIMESERIES, `{"queryText": "dcs.NOPE"}`)
+	if res.Error == nil || !strings.Contains(res.Error.Error(), "unknown keyword: dcs.NOPE") {
+		t.Fatalf("expected an unknown keyword error, got %v", res.Error)
+	}
+
+	// Patterns are expanded from the catalog for every query type
+	res = runQuery(t, ds, QUERY_TYPE_TIMESERIES, `{"queryText": "*.RAMP, dcs.*"}`)
+	if res.Error != nil || len(res.Frames) != 2 || res.Frames[0].Name != "test.RAMP" || res.Frames[1].Name != "dcs.AZ" {
+		t.Fatalf("unexpected frames %v: %v", res.Frames, res.Error)
+	}
+
+	// A keyword added since the catalog was read is found once the catalog is old enough to read again
+	ds.store.(*MemoryStore).AddKeyword(KeywordMetadata{Service: "dcs", Keyword: "EL"})
+	res = runQuery(t, ds, QUERY_TYPE_TIMESERIES, `{"queryText": "dcs.EL"}`)
+	if res.Error == nil {
+		t.Fatal("expected the catalog not to be read again so soon")
+	}
+	ds.catalog.current.loaded = time.Now().Add(-CATALOG_MISS_REFRESH)
+	res = runQuery(t, ds, QUERY_TYPE_TIMESERIES, `{"queryText": "dcs.EL"}`)
+	if res.Error != nil {
+		t.Fatalf("expected the new keyword to be found: %v", res.Error)
+	}
+
+	// A bad refresh interval is a settings problem
+	instance, err := NewDatasource(context.Background(), backend.DataSourceInstanceSettings{
+		JSONData: json.RawMessage(`{"backend": "files", "path": "` + t.TempDir() + `", "catalogRefresh": "often"}`),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if instance.(*KeywordDatasource).settingsErr == nil {
+		t.Fatal("expected an invalid refresh interval to be reported")
+	}
+}
+
+// collatedStore lists keywords ignoring case, as a database with a linguistic collation orders them
+type collatedStore struct {
+	*MemoryStore
+}
+
+func (s *collatedStore) Metadata(ctx context.Context, service string) ([]KeywordMetadata, error) {
+	list, err := s.MemoryStore.Metadata(ctx, service)
+	sort.Slice(list, func(i, j int) bool { return strings.ToLower(list[i].Keyword) < strings.ToLower(list[j].Keyword) })
+	return list, err
+}
+
+func TestCatalogCollation(t *testing.T) {
+	ctx := context.Background()
+
+	store := &collatedStore{MemoryStore: NewMemoryStore()}
+	for _, keyword := range []string{"AZ", "EL", "b_el", "dome_az"} {
+		store.AddKeyword(KeywordMetadata{Service: "dcs", Keyword: keyword})
+	}
+
+	// Every keyword is found whatever order the archive listed them in
+	catalog := newKeywordCatalog(store, &DatasourceSettings{}, 0)
+	if err := catalog.validate(ctx, []string{"dcs.AZ", "dcs.EL", "dcs.b_el", "dcs.dome_az"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := catalog.validate(ctx, []string{"dcs.el"}); err == nil {
+		t.Fatal("expected keywords to match case")
+	}
+
+	// Nothing is reported as changed when the same keywords come back in the archive's order
+	if err := catalog.refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if changes := catalog.status().LastChanges; len(changes.Added) != 0 || len(changes.Removed) != 0 {
+		t.Fatalf("unexpected changes: %+v", changes)
+	}
+}
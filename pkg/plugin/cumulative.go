@@ -0,0 +1,156 @@
+package plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// transformDuration is a duration written as a string such as "5m" in the step parameters
+type transformDuration time.Duration
+
+func (d *transformDuration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("durations must be strings such as \"30s\"")
+	}
+
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	if parsed <= 0 {
+		return fmt.Errorf("duration must be positive: %s", s)
+	}
+	*d = transformDuration(parsed)
+
+	return nil
+}
+
+// seconds returns the duration in seconds, or fallback if it was not given
+func (d transformDuration) seconds(fallback float64) float64 {
+	if d == 0 {
+		return fallback
+	}
+	return time.Duration(d).Seconds()
+}
+
+// isGap reports whether the spacing between two samples exceeds the gap limit, zero meaning no limit
+func (d transformDuration) isGap(dt float64) bool {
+	return d > 0 && dt > time.Duration(d).Seconds()
+}
+
+func init() {
+	RegisterTransform(TransformDefinition{
+		Name:        "integral",
+		Label:       "time integral",
+		Description: `{"per": "1m" for a rate per minute (default "1s"), "maxGap": "5m" to skip gaps longer than that}`,
+		Build:       buildIntegralTransform,
+	})
+
+	RegisterTransform(TransformDefinition{
+		Name:        "cumsum",
+		Label:       "cumulative sum",
+		Description: "running total of the values, no parameters",
+		Build: func(_ json.RawMessage) (transformFunc, error) {
+			return cumulativeSum, nil
+		},
+	})
+
+	RegisterTransform(TransformDefinition{
+		Name:        "counter_rate",
+		Label:       "counter rate",
+		Description: `{"per": "1h" (default "1s"), "wrap": 65536 if the counter wraps rather than resets, "maxGap": "5m"}`,
+		Build:       buildCounterRateTransform,
+	})
+}
+
+// buildIntegralTransform integrates the values over time with the trapezoidal rule, producing a running
+// total at each sample.  Intervals longer than maxGap are treated as missing data and add nothing.
+func buildIntegralTransform(params json.RawMessage) (transformFunc, error) {
+	var p struct {
+		Per    transformDuration `json:"per"`
+		MaxGap transformDuration `json:"maxGap"`
+	}
+	err := decodeParams(params, &p)
+	if err != nil {
+		return nil, err
+	}
+	per := p.Per.seconds(1)
+
+	return func(times []time.Time, values []float64) ([]time.Time, []float64, error) {
+		result := make([]float64, len(values))
+
+		for i := 1; i < len(values); i++ {
+			result[i] = result[i-1]
+
+			dt := times[i].Sub(times[i-1]).Seconds()
+			if p.MaxGap.isGap(dt) {
+				continue
+			}
+
+			result[i] += (values[i] + values[i-1]) / 2 * dt / per
+		}
+
+		return times, result, nil
+	}, nil
+}
+
+// cumulativeSum replaces each value with the total of all values up to and including it
+func cumulativeSum(times []time.Time, values []float64) ([]time.Time, []float64, error) {
+	result := make([]float64, len(values))
+
+	total := 0.0
+	for i, v := range values {
+		total += v
+		result[i] = total
+	}
+
+	return times, result, nil
+}
+
+// buildCounterRateTransform turns a monotonically increasing counter into a rate.  A decrease is taken as
+// a reset to zero, so the increment is the new value, unless wrap is given in which case the counter
+// rolled over at that value.  Samples sharing a timestamp with their predecessor, and samples after a gap
+// longer than maxGap, produce no rate.
+func buildCounterRateTransform(params json.RawMessage) (transformFunc, error) {
+	var p struct {
+		Per    transformDuration `json:"per"`
+		Wrap   float64           `json:"wrap"`
+		MaxGap transformDuration `json:"maxGap"`
+	}
+	err := decodeParams(params, &p)
+	if err != nil {
+		return nil, err
+	}
+	if p.Wrap < 0 {
+		return nil, fmt.Errorf("wrap must not be negative")
+	}
+	per := p.Per.seconds(1)
+
+	return func(times []time.Time, values []float64) ([]time.Time, []float64, error) {
+		rtimes := make([]time.Time, 0, len(values))
+		rvalues := make([]float64, 0, len(values))
+
+		for i := 1; i < len(values); i++ {
+			dt := times[i].Sub(times[i-1]).Seconds()
+			if dt <= 0 || p.MaxGap.isGap(dt) {
+				continue
+			}
+
+			increment := values[i] - values[i-1]
+			if increment < 0 {
+				if p.Wrap > 0 {
+					increment += p.Wrap
+				} else {
+					increment = values[i]
+				}
+			}
+
+			rtimes = append(rtimes, times[i])
+			rvalues = append(rvalues, increment/dt*per)
+		}
+
+		return rtimes, rvalues, nil
+	}, nil
+}
@@ -0,0 +1,77 @@
+package plugin
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestCumulative(t *testing.T) {
+	times := secondsSeries(0, 1, 3)
+	values := []float64{2, 4, 0}
+
+	cases := []struct {
+		name     string
+		params   string
+		expected []float64
+	}{
+		// Trapezoids: (2+4)/2 × 1s, then (4+0)/2 × 2s
+		{"integral", ``, []float64{0, 3, 7}},
+		{"integral", `{"per": "1s"}`, []float64{0, 3, 7}},
+		{"integral", `{"per": "1m"}`, []float64{0, 3.0 / 60, 7.0 / 60}},
+		// The two second interval is a gap, the total carries across it unchanged
+		{"integral", `{"maxGap": "1s"}`, []float64{0, 3, 3}},
+		{"integral", `{"maxGap": "2s"}`, []float64{0, 3, 7}},
+		{"cumsum", ``, []float64{2, 6, 6}},
+	}
+
+	for _, c := range cases {
+		gotTimes, got := runTransform(t, c.name, c.params, times, values)
+		if len(gotTimes) != len(times) || !sameValues(got, c.expected, 1e-12) {
+			t.Fatalf("%s %s: expected %v, got %v", c.name, c.params, c.expected, got)
+		}
+	}
+}
+
+func TestCounterRate(t *testing.T) {
+	// Increments of 50, then a drop, then a repeated timestamp, then 20, then 10 after a long gap
+	times := secondsSeries(0, 10, 20, 20, 30, 300)
+	values := []float64{100, 150, 30, 40, 60, 70}
+
+	cases := []struct {
+		params   string
+		seconds  []float64
+		expected []float64
+	}{
+		// A drop is a reset to zero, so the increment is the new value.  The sample sharing its timestamp
+		// with the one before has no rate.
+		{``, []float64{10, 20, 30, 300}, []float64{5, 3, 2, 10.0 / 270}},
+		// A counter that wraps at 256 went 150 → 256 → 30, an increment of 136
+		{`{"wrap": 256}`, []float64{10, 20, 30, 300}, []float64{5, 13.6, 2, 10.0 / 270}},
+		{`{"per": "1m"}`, []float64{10, 20, 30, 300}, []float64{300, 180, 120, 600.0 / 270}},
+		// The sample after the gap has no rate
+		{`{"maxGap": "1m"}`, []float64{10, 20, 30}, []float64{5, 3, 2}},
+	}
+
+	for _, c := range cases {
+		gotTimes, got := runTransform(t, "counter_rate", c.params, times, values)
+		expectedTimes := secondsSeries(c.seconds...)
+		if len(gotTimes) != len(expectedTimes) {
+			t.Fatalf("%s: expected times %v, got %v", c.params, expectedTimes, gotTimes)
+		}
+		for i := range gotTimes {
+			if !gotTimes[i].Equal(expectedTimes[i]) {
+				t.Fatalf("%s: expected times %v, got %v", c.params, expectedTimes, gotTimes)
+			}
+		}
+		if !sameValues(got, c.expected, 1e-12) {
+			t.Fatalf("%s: expected %v, got %v", c.params, c.expected, got)
+		}
+	}
+
+	for _, params := range []string{`{"wrap": -1}`, `{"per": "0s"}`, `{"per": 60}`, `{"maxGap": "soon"}`} {
+		_, err := newTransformPipeline([]TransformStep{{Name: "counter_rate", Params: json.RawMessage(params)}})
+		if err == nil {
+			t.Fatalf("%s: expected an error", params)
+		}
+	}
+}
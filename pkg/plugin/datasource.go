@@ -4,18 +4,15 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"github.com/lib/pq"
-	"math"
 	"net/http"
 	"net/url"
 	"runtime"
 	"strings"
 	"time"
-
-	"database/sql"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/grafana/grafana-plugin-sdk-go/backend"
-	"github.com/grafana/grafana-plugin-sdk-go/backend/datasource"
 	"github.com/grafana/grafana-plugin-sdk-go/backend/instancemgmt"
 	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
 	"github.com/grafana/grafana-plugin-sdk-go/backend/resource/httpadapter"
@@ -39,79 +36,230 @@ func fl() string {
 	return s
 }
 
-// DatasourceSettings contains Postgres connection information
+// DatasourceSettings contains Postgres connection information, or where to find an offline archive
 type DatasourceSettings struct {
+	// Which kind of archive to read, one of the BACKEND_* values
+	Backend string `json:"backend"`
+
+	// Directory holding an archive extract for the files backend, or the sqlite backend's database file
+	Path string `json:"path"`
+
 	Server    string `json:"server"`
 	Port      string `json:"port"`
 	Role      string `json:"role"`
 	Database  string `json:"database"`
 	MetaTable string `json:"metatable"`
-}
 
-// Define the unit conversions, this maps onto the unitConversionOptions list in QueryEditor.tsx
-const (
-	UNIT_CONVERT_NONE          = iota
-	UNIT_CONVERT_DEG_TO_RAD    = iota
-	UNIT_CONVERT_RAD_TO_DEG    = iota
-	UNIT_CONVERT_RAD_TO_ARCSEC = iota
-	UNIT_CONVERT_K_TO_C        = iota
-	UNIT_CONVERT_C_TO_K        = iota
-)
+	// Calibrations applied to raw sensor keywords, keyed by service.keyword
+	Calibrations map[string]Calibration `json:"calibrations"`
 
-// Define the data transforms, this maps onto the transformOptions list in QueryEditor.tsx
-const (
-	TRANSFORM_NONE                  = iota
-	TRANSFORM_FIRST_DERIVATVE       = iota
-	TRANSFORM_FIRST_DERIVATVE_1HZ   = iota
-	TRANSFORM_FIRST_DERIVATVE_10HZ  = iota
-	TRANSFORM_FIRST_DERIVATVE_100HZ = iota
-	TRANSFORM_DELTA                 = iota
-)
+	// Layout of the archive tables, empty fields take the KTL archive defaults
+	Schema ArchiveSchema `json:"schema"`
+
+	// Archives of the federated backend, each service is read from the one holding it
+	Archives []ArchiveConnection `json:"archives"`
+
+	// How often the keyword catalog is read again, such as "10m", "0" only when asked
+	CatalogRefresh string `json:"catalogRefresh"`
+}
 
 // LoadSettings gets the relevant settings from the plugin context
 func LoadSettings(ctx backend.PluginContext) (*DatasourceSettings, error) {
+	return parseSettings(ctx.DataSourceInstanceSettings.JSONData)
+}
+
+// parseSettings decodes the JSON settings stored by the configuration editor
+func parseSettings(jsonData []byte) (*DatasourceSettings, error) {
 	model := &DatasourceSettings{}
 
-	settings := ctx.DataSourceInstanceSettings
-	err := json.Unmarshal(settings.JSONData, &model)
+	err := json.Unmarshal(jsonData, &model)
 	if err != nil {
 		return nil, fmt.Errorf("error reading settings: %s", err.Error())
 	}
 
+	model.applyDefaults()
+
 	return model, nil
 }
 
+// applyDefaults fills in the parts of the settings that fall back to the KTL archive layout
+func (s *DatasourceSettings) applyDefaults() {
+	if s.MetaTable == "" {
+		s.MetaTable = DEFAULT_META_TABLE
+	}
+	s.Schema.applyDefaults()
+
+	// A list of archives is only of use to the federated backend
+	if s.Backend == "" && len(s.Archives) > 0 {
+		s.Backend = BACKEND_FEDERATED
+	}
+}
+
+// catalogRefresh is how often to read the keyword catalog again, CATALOG_DEFAULT_REFRESH if not set
+func (s *DatasourceSettings) catalogRefresh() (time.Duration, error) {
+	if s.CatalogRefresh == "" {
+		return CATALOG_DEFAULT_REFRESH, nil
+	}
+
+	every, err := time.ParseDuration(s.CatalogRefresh)
+	if err != nil || every < 0 {
+		return 0, fmt.Errorf("invalid catalog refresh interval: %q, expected a duration such as 10m", s.CatalogRefresh)
+	}
+	return every, nil
+}
+
+// source describes where the archive is, for the record kept with exports
+func (s *DatasourceSettings) source() string {
+	switch s.Backend {
+	case BACKEND_FILES:
+		return "files:" + s.Path
+	case BACKEND_SQLITE:
+		return "sqlite:" + s.Path
+	case BACKEND_FEDERATED:
+		var sources []string
+		for i := range s.Archives {
+			sources = append(sources, s.Archives[i].settings(s).source())
+		}
+		return "federated:" + strings.Join(sources, ",")
+	default:
+		return fmt.Sprintf("postgres://%s@%s:%s/%s", s.Role, s.Server, s.Port, s.Database)
+	}
+}
+
 // NewDatasource creates a new datasource instance.
-func NewDatasource(_ context.Context, _ backend.DataSourceInstanceSettings) (instancemgmt.Instance, error) {
+func NewDatasource(_ context.Context, settings backend.DataSourceInstanceSettings) (instancemgmt.Instance, error) {
+
+	// Grafana calls this when the instance is created for the first time or when a datasource
+	// configuration changed, the previous instance is disposed of first.
+	log.DefaultLogger.Info(fl()+"creating new keyword datasource", "dsUid", settings.UID, "dsName", settings.Name)
 
-	// Create an instance manager for the plugin. The function passed
-	// into `NewInstanceManger` is called when the instance is created
-	// for the first time or when a datasource configuration changed.
-	log.DefaultLogger.Info(fl() + "Creating new keyword datasource")
+	// Validate the settings now rather than on each query, a failure here does not prevent the instance
+	// from being created since CheckHealth needs an instance to report the problem from
+	var calibrations *calibrationCatalog
+	var store ArchiveStore
 
-	im := datasource.NewInstanceManager(newDataSourceInstance)
+	config, err := parseSettings(settings.JSONData)
+	if err == nil {
+		err = config.Schema.validate()
+	}
+	if err == nil {
+		_, err = config.catalogRefresh()
+	}
+	if err == nil {
+		calibrations, err = newCalibrationCatalog(config.Calibrations)
+	}
+	if err == nil {
+		store, err = newArchiveStore(config)
+	}
+	if err != nil {
+		log.DefaultLogger.Error(fl()+"invalid datasource settings", "dsUid", settings.UID, "error", err)
+	}
+
+	// Fall back to the default layout so the instance remains usable for the health check
+	if config == nil {
+		config = &DatasourceSettings{}
+		config.applyDefaults()
+	}
+
+	ds := newKeywordDatasource(config, store)
+	ds.calibrations = calibrations
+	ds.settingsErr = err
+	ds.uid = settings.UID
+
+	// Report the connection pool for as long as the instance lives
+	if pool, ok := store.(poolReporter); ok {
+		pools.add(ds.uid, pool)
+	}
+
+	return ds, nil
+}
+
+// newKeywordDatasource creates an instance reading from the store, the store is closed when the instance
+// is disposed of
+func newKeywordDatasource(config *DatasourceSettings, store ArchiveStore) *KeywordDatasource {
 	ds := &KeywordDatasource{
-		im: im,
+		settings: config,
+		store:    store,
+	}
+
+	// Dropdowns, validation and wildcards read the catalog rather than the metadata table, a bad interval
+	// has already been reported as a settings problem
+	if store != nil {
+		every, err := config.catalogRefresh()
+		if err != nil {
+			every = CATALOG_DEFAULT_REFRESH
+		}
+		ds.catalog = newKeywordCatalog(store, config, every)
 	}
 
 	mux := http.NewServeMux()
 	httpResourceHandler := httpadapter.New(mux)
 
-	// Bind the HTTP paths to functions that respond to them
-	mux.HandleFunc("/services", ds.handleResourceKeywords)
-	mux.HandleFunc("/keywords", ds.handleResourceKeywords)
-
-	ds.CallResourceHandler = httpResourceHandler;
-
-	return ds, nil;
+	// Bind the HTTP paths to functions that respond to them, counting the calls to each
+	handle := func(path string, handler http.HandlerFunc) {
+		mux.HandleFunc(path, instrumentResource(path, handler))
+	}
+	handle("/services", allowMethods(ds.handleResourceServices, http.MethodGet))
+	handle("/keywords", allowMethods(ds.handleResourceKeywords, http.MethodGet))
+	handle("/conversions", allowMethods(ds.handleResourceConversions, http.MethodGet))
+	handle("/transforms", allowMethods(ds.handleResourceTransforms, http.MethodGet))
+	handle("/export", allowMethods(ds.handleResourceExport, http.MethodGet))
+	handle("/search", allowMethods(ds.handleResourceSearch, http.MethodGet))
+	handle("/catalog", allowMethods(ds.handleResourceCatalog, http.MethodGet, http.MethodPost))
+	ds.routeAPI(handle)
+
+	ds.CallResourceHandler = httpResourceHandler
+
+	return ds
 }
 
 type KeywordDatasource struct {
-	// The instance manager can help with lifecycle management
-	// of datasource instances in plugins. It's not a requirements
-	// but a best practice that we recommend that you follow.
-	im instancemgmt.InstanceManager
 	backend.CallResourceHandler
+
+	// Settings, compiled calibration catalog and any problem found validating them at creation
+	settings     *DatasourceSettings
+	calibrations *calibrationCatalog
+	settingsErr  error
+
+	// Where the keywords are read from, nil if the settings are invalid
+	store ArchiveStore
+
+	// Services and keywords of the store held in memory, nil without a store
+	catalog *keywordCatalog
+
+	// Grafana's identifier for the datasource, labelling its metrics
+	uid string
+
+	// Keyword search index, built from the catalog on the first search and again when it changes
+	search keywordIndex
+}
+
+// Dispose is called before creating a new instance when the configuration changes
+func (ds *KeywordDatasource) Dispose() {
+	if ds.store == nil {
+		return
+	}
+
+	if pool, ok := ds.store.(poolReporter); ok {
+		pools.remove(ds.uid, pool)
+	}
+
+	err := ds.store.Close()
+	if err != nil {
+		log.DefaultLogger.Error(fl()+"archive close error", "dsUid", ds.uid, "error", err)
+	}
+}
+
+// archive returns the store behind the keyword catalog, or why there isn't one
+func (ds *KeywordDatasource) archive() (ArchiveStore, error) {
+	if ds.settingsErr != nil {
+		return nil, ds.settingsErr
+	}
+	if ds.store == nil {
+		return nil, fmt.Errorf("no archive configured")
+	}
+
+	return ds.catalog, nil
 }
 
 // QueryData handles multiple queries and returns multiple responses.
@@ -119,32 +267,44 @@ type KeywordDatasource struct {
 // The QueryDataResponse contains a map of RefID to the response for each query, and each response
 // contains Frames ([]*Frame).
 func (ds *KeywordDatasource) QueryData(ctx context.Context, req *backend.QueryDataRequest) (*backend.QueryDataResponse, error) {
-	log.DefaultLogger.Info(fl()+"keyword-backend.go:QueryData", "request", req)
+	ctx = withRequestLog(ctx, req.PluginContext)
+	logger(ctx).Debug(fl()+"query request", "queries", len(req.Queries), "request", req)
+
+	ctx, span := startSpan(ctx, "QueryData", ATTR_QUERIES.Int(len(req.Queries)))
+	defer span.End()
 
 	// create response struct
 	response := backend.NewQueryDataResponse()
 
-	// Get the configuration
-	config, err := LoadSettings(req.PluginContext)
+	// The archive was opened when the instance was created
+	store, err := ds.archive()
 	if err != nil {
-		log.DefaultLogger.Error(fl() + "settings load error")
+		logger(ctx).Error(fl()+"archive unavailable", "error", err)
 		return nil, err
 	}
 
-	// Build the connection string
-	psqlInfo := fmt.Sprintf("host=%s port=%s user=%s dbname=%s sslmode=disable", config.Server, config.Port, config.Role, config.Database)
-
-	// Open the Postgres interface
-	db, err := sql.Open("postgres", psqlInfo)
-	if err != nil {
-		log.DefaultLogger.Error(fl() + "DB connection failure")
-		return nil, err
-	}
-	defer db.Close()
-
 	// loop over queries and execute them individually.
 	for _, q := range req.Queries {
-		res := ds.query(ctx, q, db)
+		start := time.Now()
+		res := ds.query(ctx, q, store)
+
+		queryType := queryTypeLabel(q.QueryType)
+		status := "ok"
+		if res.Error != nil {
+			status = "error"
+		}
+		queriesTotal.WithLabelValues(queryType, status).Inc()
+		queryDuration.WithLabelValues(queryType).Observe(time.Since(start).Seconds())
+
+		if res.Error != nil {
+			logger(ctx).Warn(fl()+"query failed", "refId", q.RefID, "queryType", queryType, "error", res.Error)
+		} else {
+			logger(ctx).Debug(fl()+"query done", "refId", q.RefID, "queryType", queryType, "frames", len(res.Frames),
+				"duration", time.Since(start))
+		}
+		for _, frame := range res.Frames {
+			bytesReturned.WithLabelValues("query").Add(float64(frameBytes(frame)))
+		}
 
 		// save the response in a hashmap
 		// based on with RefID as identifier
@@ -157,23 +317,81 @@ func (ds *KeywordDatasource) QueryData(ctx context.Context, req *backend.QueryDa
 type queryModel struct {
 	//Datasource string `json:"datasource"`
 	//DatasourceId string `json:"datasourceId"`
-	Format         string `json:"format"`
-	QueryText      string `json:"queryText"`
-	UnitConversion int    `json:"unitConversion"`
-	Transform      int    `json:"transform"`
-	IntervalMs     int    `json:"intervalMs"`
-	MaxDataPoints  int    `json:"maxDataPoints"`
-	OrgId          int    `json:"orgId"`
-	RefId          string `json:"refId"`
-	Hide           bool   `json:"hide"`
+	Format    string `json:"format"`
+	QueryText string `json:"queryText"`
+
+	// Additional service.keyword names queried alongside the one (or comma separated list) in QueryText
+	Keywords []string `json:"keywords"`
+
+	// Percentiles reported by the statistics query type
+	Percentiles []float64 `json:"percentiles"`
+
+	// Bucketing for the histogram query type
+	Histogram histogramOptions `json:"histogram"`
+
+	// Thresholds for the staleness query type
+	Staleness stalenessOptions `json:"staleness"`
+
+	UnitConversion int `json:"unitConversion"`
+	Transform      int `json:"transform"`
+
+	// Named unit conversion from the registry, this takes precedence over the legacy UnitConversion code
+	Conversion       string  `json:"conversion"`
+	ConversionScale  float64 `json:"conversionScale"`
+	ConversionOffset float64 `json:"conversionOffset"`
+
+	// Ordered transform pipeline, applied after the legacy conversion and transform above
+	Transforms []TransformStep `json:"transforms"`
+
+	// Calibration mode: "" applies automatic calibrations, "always" applies any calibration, "never" skips it
+	Calibrate string `json:"calibrate"`
+
+	// Compare against another period, such as "-1d" or "last week", the samples are moved into the current range
+	TimeShift string `json:"timeShift"`
+
+	IntervalMs    int    `json:"intervalMs"`
+	MaxDataPoints int    `json:"maxDataPoints"`
+	OrgId         int    `json:"orgId"`
+	RefId         string `json:"refId"`
+	Hide          bool   `json:"hide"`
+}
+
+// The query types, an empty query type is a time series
+const (
+	QUERY_TYPE_TIMESERIES = ""
+	QUERY_TYPE_STATS      = "stats"
+	QUERY_TYPE_HISTOGRAM  = "histogram"
+	QUERY_TYPE_STALENESS  = "staleness"
+)
+
+// keywordList returns the service.keyword names the query covers, in order and without repeats
+func (qm *queryModel) keywordList() []string {
+	var keys []string
+	seen := map[string]bool{}
+
+	list := append(strings.Split(qm.QueryText, ","), qm.Keywords...)
+	for _, key := range list {
+		key = strings.TrimSpace(key)
+		if key != "" && !seen[key] {
+			keys = append(keys, key)
+			seen[key] = true
+		}
+	}
+
+	return keys
 }
 
-func (ds *KeywordDatasource) query(ctx context.Context, query backend.DataQuery, db *sql.DB) backend.DataResponse {
+func (ds *KeywordDatasource) query(ctx context.Context, query backend.DataQuery, store ArchiveStore) backend.DataResponse {
 	// Unmarshal the json into our queryModel
 	var qm queryModel
 
 	response := backend.DataResponse{}
 
+	ctx = withLogValues(ctx, "refId", query.RefID)
+	ctx, span := startSpan(ctx, "query", append(timeRangeAttributes(query.TimeRange),
+		ATTR_REF_ID.String(query.RefID), ATTR_QUERY_TYPE.String(queryTypeLabel(query.QueryType)))...)
+	defer func() { endSpan(span, response.Error) }()
+
 	// Return an error if the unmarshal fails
 	response.Error = json.Unmarshal(query.JSON, &qm)
 	if response.Error != nil {
@@ -190,228 +408,226 @@ func (ds *KeywordDatasource) query(ctx context.Context, query backend.DataQuery,
 	empty_frame.Fields = append(empty_frame.Fields, data.NewField("time", nil, []time.Time{query.TimeRange.From, query.TimeRange.To}))
 
 	// Return empty frame if query is empty
-	if qm.QueryText == "" {
+	keys := qm.keywordList()
+	if len(keys) == 0 {
 
 		// add the frames to the response
 		response.Frames = append(response.Frames, empty_frame)
 		return response
 	}
 
-	// Log a warning if `Format` is empty.
-	if qm.Format == "" {
-		log.DefaultLogger.Warn(fl() + "format is empty, defaulting to time series")
+	// Patterns such as dcs.* stand for the catalog's keywords they match, and every keyword must be in the
+	// catalog.  The staleness query type reports a keyword that was never archived rather than rejecting it.
+	keys, err := expandKeywords(ctx, store, keys)
+	if err == nil && query.QueryType != QUERY_TYPE_STALENESS {
+		err = ds.catalog.validate(ctx, keys)
 	}
-
-	// Pick apart the keyword name from the service
-	sk := strings.Split(qm.QueryText, ".")
-	service := sk[0]
-	keyword := sk[1]
-
-	// Retrieve the values from the keyword archiver with Unix time as a floating point
-	from_u := float64(query.TimeRange.From.UnixNano()) * 1e-9
-	to_u := float64(query.TimeRange.To.UnixNano()) * 1e-9
-
-	// Strip bad characters from the service in case of SQL injection attack
-	// TODO - Is this sufficient?
-	service = pq.QuoteIdentifier(service)
-
-	// Build a SQL query for just counting
-	sql_count := fmt.Sprintf("select count(time) from %s where keyword = $1 and time >= $2 and time <= $3;", service)
-
-	// Run the query once to see how many we are going to get back
-	row := db.QueryRow(sql_count, keyword, from_u, to_u)
-
-	// Get the count value out of the query result
-	var count int32
-	switch err := row.Scan(&count); err {
-	case sql.ErrNoRows:
-		log.DefaultLogger.Error(fl() + "query no rows returned")
-
-		// Send back an empty frame since there's no data to be had
+	if err != nil {
 		response.Frames = append(response.Frames, empty_frame)
+		response.Error = err
 		return response
+	}
+	span.SetAttributes(ATTR_KEYWORDS.StringSlice(keys))
 
-	case nil:
-		log.DefaultLogger.Debug(fl() + fmt.Sprintf("query yielded %d rows", count))
+	// The query editor never sets a format, so this is only of interest when debugging
+	if qm.Format == "" {
+		logger(ctx).Debug(fl()+"format is empty, defaulting to time series", "keywords", keys)
+	}
 
-	default:
-		log.DefaultLogger.Error(fl() + "Error from row.Scan: " + err.Error())
-		// Send back an empty frame, the query failed in some way
+	// Build the transform pipeline, queries saved before the pipeline existed are migrated into it here
+	steps, err := qm.transformSteps()
+	if err != nil {
+		// Send back an empty frame with an error, we did not understand the conversion or transform
 		response.Frames = append(response.Frames, empty_frame)
 		response.Error = err
 		return response
 	}
 
-	// Setup and perform the query for the real data set now
-	// 2021-08-30: trim the binvalue so whitespace doesn't affect the float64 conversion below
-	sql := fmt.Sprintf("select time, trim(binvalue) from %s where keyword = $1 and time >= $2 and time <= $3 order by time asc;", service)
-	rows, err := db.Query(sql, keyword, from_u, to_u)
-
+	pipeline, err := newTransformPipeline(steps)
 	if err != nil {
-		log.DefaultLogger.Error(fl() + "query retrieval error: " + err.Error())
+		response.Frames = append(response.Frames, empty_frame)
 		response.Error = err
 		return response
 	}
-	defer rows.Close()
-
-	// Store times and values here first
-	times := make([]time.Time, count)
-	values := make([]float64, count)
-
-	// Temporary variables for conversions/transforms
-	var timetemp float64
-	var valtemp, val float64
-	var i int32
-
-	// Iterate only as many rows as predicted, it's possible more rows arrived after the initial query executed!
-	for i = 0; i < count; i++ {
 
-		// Get the next row
-		if rows.Next() {
-
-			// Pull the elements out of the row
-
-			err = rows.Scan(&timetemp, &valtemp)
+	// Check the time shift up front rather than once per keyword
+	_, _, err = parseTimeShift(qm.TimeShift)
+	if err != nil {
+		response.Frames = append(response.Frames, empty_frame)
+		response.Error = err
+		return response
+	}
 
+	switch query.QueryType {
+	case QUERY_TYPE_TIMESERIES:
+		// One frame per keyword
+		for _, key := range keys {
+			frame, err := ds.querySeries(ctx, store, qm, key, pipeline, query.TimeRange)
 			if err != nil {
-				log.DefaultLogger.Error(fl() + "query scan error: " + err.Error())
-
-				// Send back an empty frame, the query failed in some way
 				response.Frames = append(response.Frames, empty_frame)
 				response.Error = err
 				return response
 			}
-		}
-
-		// Separate the fractional seconds so we can convert it into a time.Time
-		sec, dec := math.Modf(timetemp)
-		times[i] = time.Unix(int64(sec), int64(dec*(1e9)))
-
-		// If we are doing a unit conversion, perform it now while we have the single value in hand
-		switch qm.UnitConversion {
-
-		case UNIT_CONVERT_NONE:
-			// No conversion, just assign it straight over
-			val = valtemp
-
-		case UNIT_CONVERT_DEG_TO_RAD:
-			// RAD = DEG * π/180  (1° = 0.01745rad)
-			val = valtemp * (math.Pi / 180)
 
-		case UNIT_CONVERT_RAD_TO_DEG:
-			// DEG = RAD * 180/π  (1rad = 57.296°)
-			val = valtemp * (180 / math.Pi)
-
-		case UNIT_CONVERT_RAD_TO_ARCSEC:
-			// ARCSEC = RAD * (3600 * 180)/π  (1rad = 206264.806")
-			val = valtemp * (3600 * 180 / math.Pi)
+			// add the frames to the response
+			response.Frames = append(response.Frames, frame)
+		}
 
-		case UNIT_CONVERT_K_TO_C:
-			// °C = K + 273.15
-			val = valtemp + 273.15
+	case QUERY_TYPE_STATS:
+		frame, err := ds.queryStats(ctx, store, qm, keys, pipeline, query.TimeRange)
+		if err != nil {
+			response.Frames = append(response.Frames, empty_frame)
+			response.Error = err
+			return response
+		}
+		response.Frames = append(response.Frames, frame)
 
-		case UNIT_CONVERT_C_TO_K:
-			// K = °C − 273.15
-			val = valtemp - 273.15
+	case QUERY_TYPE_HISTOGRAM:
+		frame, err := ds.queryHistogram(ctx, store, qm, keys, pipeline, query.TimeRange)
+		if err != nil {
+			response.Frames = append(response.Frames, empty_frame)
+			response.Error = err
+			return response
+		}
+		response.Frames = append(response.Frames, frame)
 
-		default:
-			// Send back an empty frame with an error, we did not understand the conversion
+	case QUERY_TYPE_STALENESS:
+		frame, err := ds.queryStaleness(ctx, store, qm, keys, query.TimeRange)
+		if err != nil {
 			response.Frames = append(response.Frames, empty_frame)
-			response.Error = fmt.Errorf("Unknown unit conversion: %d", qm.UnitConversion)
+			response.Error = err
 			return response
 		}
+		response.Frames = append(response.Frames, frame)
 
-		// Assign the value to the result array
-		values[i] = val
+	default:
+		response.Frames = append(response.Frames, empty_frame)
+		response.Error = fmt.Errorf("unknown query type: %s", query.QueryType)
+	}
+
+	return response
+}
+
+// querySeries retrieves and transforms a single keyword into a time series frame, or a spectrum frame if
+// the pipeline ends in one
+func (ds *KeywordDatasource) querySeries(ctx context.Context, store ArchiveStore, qm queryModel, key string, pipeline *transformPipeline, timeRange backend.TimeRange) (*data.Frame, error) {
+	times, values, err := ds.fetchSeries(ctx, store, qm, key, timeRange)
+	if err != nil {
+		return nil, err
 	}
 
 	// Perform any requested data transforms
-	switch qm.Transform {
+	times, values, err = pipeline.run(ctx, times, values)
+	if err != nil {
+		return nil, err
+	}
 
-	case TRANSFORM_NONE:
-		break
+	// A spectrum replaces the time series with frequency versus power
+	if pipeline.spectrum != nil {
+		frequencies, power, err := pipeline.spectrum(times, values)
+		if err != nil {
+			return nil, err
+		}
 
-	case TRANSFORM_FIRST_DERIVATVE, TRANSFORM_FIRST_DERIVATVE_1HZ, TRANSFORM_FIRST_DERIVATVE_10HZ, TRANSFORM_FIRST_DERIVATVE_100HZ:
+		return spectrumFrame(qm, key, frequencies, power), nil
+	}
 
-		// Compute the first derivative of the data.
-		dtimes := make([]time.Time, count-1)
-		dvalues := make([]float64, count-1)
+	// Start a new frame and add the times + values
+	_, span := startSpan(ctx, "build frame", ATTR_KEYWORD.String(key), ATTR_ROWS.Int(len(values)))
+	defer span.End()
 
-		for i = 1; i < count; i++ {
-			// Calculate the dt
-			dtimes[i-1] = times[i]
+	frame := data.NewFrame("response")
+	frame.RefID = qm.RefId
+	frame.Name = qm.seriesName(key)
 
-			// Calculate the dy/dt
-			var dt, dvdt float64
-			dt = (times[i].Sub(times[i-1])).Seconds()
-			dvdt = (values[i] - values[i-1]) / dt
+	// It looks like you can submit the values with any string for a name, which will be appended to the
+	// .Name field above (thus creating a series named "service.KEYWORD values" which may not be the desired
+	// name for the series.  Thus, submit it with an empty string for now which appears to work.
+	//frame.Fields = append(frame.Fields, data.NewField("values", nil, values))
+	frame.Fields = append(frame.Fields, data.NewField("", nil, values))
+	frame.Fields = append(frame.Fields, data.NewField("time", nil, times))
 
-			if qm.Transform == TRANSFORM_FIRST_DERIVATVE_1HZ {
-				dvdt = math.Round(dvdt)
-			} else if qm.Transform == TRANSFORM_FIRST_DERIVATVE_10HZ {
-				dvdt = math.Round(dvdt*10) / 10
-			} else if qm.Transform == TRANSFORM_FIRST_DERIVATVE_100HZ {
-				dvdt = math.Round(dvdt*100) / 100
-			}
+	return frame, nil
+}
 
-			dvalues[i-1] = dvdt
-		}
+// fetchSeries retrieves a keyword from the archive over the time range, parsed and calibrated so that it
+// is ready for the transform pipeline
+func (ds *KeywordDatasource) fetchSeries(ctx context.Context, store ArchiveStore, qm queryModel, key string, timeRange backend.TimeRange) ([]time.Time, []float64, error) {
+	// Pick apart the keyword name from the service
+	service, keyword, err := splitKeyword(key)
+	if err != nil {
+		return nil, nil, err
+	}
 
-		// Reassign the original arrays to be the 1st derivative results
-		times = dtimes
-		values = dvalues
+	ctx = withLogValues(ctx, "service", service, "keyword", keyword)
+	ctx, span := startSpan(ctx, "fetch keyword", append(timeRangeAttributes(timeRange),
+		ATTR_SERVICE.String(service), ATTR_KEYWORD.String(keyword))...)
+	defer func() { endSpan(span, err) }()
 
-	case TRANSFORM_DELTA:
-		// Compute the deltas of the data.  This algorithm replicates what numpy diff() does in Python,
-		// to the extent that it disregards the time series data.  The resultant arrays have one fewer element,
-		// we drop the 0th element of time and value.  It's like a first derivative where dt is always 1.
-		// See https://numpy.org/doc/stable/reference/generated/numpy.diff.html
-		dtimes := make([]time.Time, count-1)
-		dvalues := make([]float64, count-1)
+	// Find any calibration for the raw keyword, it is applied before the transforms
+	calibration, err := ds.calibrations.lookup(key, qm.Calibrate)
+	if err != nil {
+		return nil, nil, err
+	}
 
-		for i = 1; i < count; i++ {
-			// Bring the time val straight across, shifted by one
-			dtimes[i-1] = times[i]
+	// A shifted query reads the earlier (or later) range and moves the samples back into this one
+	shift, _, err := parseTimeShift(qm.TimeShift)
+	if err != nil {
+		return nil, nil, err
+	}
+	timeRange = shiftTimeRange(timeRange, shift)
 
-			// Calculate the dx/dt and assume dt is always 1
-			dvalues[i-1] = values[i] - values[i-1]
+	// Retrieve the archived text of each sample
+	start := time.Now()
+	times, raw, err := store.Samples(ctx, service, keyword, timeRange.From, timeRange.To)
+	observeArchive(ds.settings, "samples", start)
+	if err != nil {
+		return nil, nil, err
+	}
+	rowsFetched.WithLabelValues(backendLabel(ds.settings)).Add(float64(len(raw)))
+	span.SetAttributes(ATTR_ROWS.Int(len(raw)))
+
+	values := make([]float64, len(raw))
+	for i := range raw {
+		// Parse the archived text, which may be a plain number or a sexagesimal value
+		var val float64
+		val, err = parseArchivedValue(raw[i])
+		if err != nil {
+			logger(ctx).Error(fl()+"value parse error", "value", raw[i], "time", times[i], "error", err)
+			return nil, nil, err
 		}
 
-		// Reassign the original arrays to be the new results
-		times = dtimes
-		values = dvalues
-
-	default:
-		// Send back an empty frame with an error, we did not understand the transform
-		response.Frames = append(response.Frames, empty_frame)
-		response.Error = fmt.Errorf("Unknown transform: %d", qm.Transform)
-		return response
+		// Calibrate the raw reading into physical units
+		if calibration != nil {
+			val = calibration(val)
+		}
 
+		values[i] = val
 	}
 
-	// Get any error encountered during iteration of the SQL result
-	err = rows.Err()
-	if err != nil {
-		log.DefaultLogger.Error(fl() + "query row error: " + err.Error())
-		response.Error = fmt.Errorf("row query error: " + err.Error())
-	}
+	restampTimes(times, shift)
 
-	// Start a new frame and add the times + values
-	frame := data.NewFrame("response")
-	frame.RefID = qm.RefId
-	frame.Name = qm.QueryText
+	return times, values, nil
+}
 
-	// It looks like you can submit the values with any string for a name, which will be appended to the
-	// .Name field above (thus creating a series named "service.KEYWORD values" which may not be the desired
-	// name for the series.  Thus, submit it with an empty string for now which appears to work.
-	//frame.Fields = append(frame.Fields, data.NewField("values", nil, values))
-	frame.Fields = append(frame.Fields, data.NewField("", nil, values))
-	frame.Fields = append(frame.Fields, data.NewField("time", nil, times))
+// splitKeyword picks apart a service.keyword name
+func splitKeyword(key string) (string, string, error) {
+	sk := strings.SplitN(key, ".", 2)
+	if len(sk) != 2 || sk[0] == "" || sk[1] == "" {
+		return "", "", fmt.Errorf("keyword must be of the form service.keyword: %s", key)
+	}
 
-	// add the frames to the response
-	response.Frames = append(response.Frames, frame)
+	return sk[0], sk[1], nil
+}
 
-	return response
+// capitalize upper-cases the first letter of a message, whatever its length in bytes
+func capitalize(text string) string {
+	r, size := utf8.DecodeRuneInString(text)
+	if r == utf8.RuneError {
+		return text
+	}
+
+	return string(unicode.ToUpper(r)) + text[size:]
 }
 
 // CheckHealth handles health checks sent from Grafana to the plugin.
@@ -420,205 +636,154 @@ func (ds *KeywordDatasource) query(ctx context.Context, query backend.DataQuery,
 // a datasource is working as expected.
 func (ds *KeywordDatasource) CheckHealth(ctx context.Context, req *backend.CheckHealthRequest) (*backend.CheckHealthResult, error) {
 	var status = backend.HealthStatusOk
-	var message = "Data source is working"
+	var message string
+
+	// Check each layer of the archive, the details say which one is broken
+	ctx = withRequestLog(ctx, req.PluginContext)
+	details, err := ds.diagnose(ctx)
 
-	config, err := LoadSettings(req.PluginContext)
 	if err != nil {
-		return &backend.CheckHealthResult{
-			Status:  backend.HealthStatusError,
-			Message: "Invalid config",
-		}, nil
-	}
+		status = backend.HealthStatusError
+		message = capitalize(err.Error())
+		if message == "" {
+			message = "Health check failed"
+		}
+		logger(ctx).Warn(fl()+"health check failed", "error", err)
 
-	// Build the connection string
-	psqlInfo := fmt.Sprintf("host=%s port=%s user=%s dbname=%s sslmode=disable",
-		config.Server, config.Port, config.Role, config.Database)
+	} else {
+		// Confirmation success back to the user
+		config := ds.settings
+		if config.Backend == BACKEND_FILES || config.Backend == BACKEND_SQLITE {
+			message = fmt.Sprintf("confirmed: %s", config.Path)
+		} else if federated, ok := ds.store.(*federatedStore); ok {
+			message = fmt.Sprintf("confirmed: %d archives (%s)", len(federated.archives), strings.Join(federated.archiveNames(), ", "))
+		} else {
+			message = fmt.Sprintf("confirmed: %s:%s:%s:%s", config.Server, config.Role, config.Database, config.MetaTable)
+		}
 
-	// See if we can open the Postgres interface
-	db, err := sql.Open("postgres", psqlInfo)
-	if err != nil {
-		return &backend.CheckHealthResult{
-			Status:  backend.HealthStatusError,
-			Message: "Failure to open SQL driver: " + err.Error(),
-		}, nil
+		message += fmt.Sprintf(", %d services", details.Metadata.Services)
+		if details.Metadata.Keywords > 0 {
+			message += fmt.Sprintf(", %d keywords", details.Metadata.Keywords)
+		}
+		if details.NewestAgeSeconds != nil {
+			age := time.Duration(*details.NewestAgeSeconds) * time.Second
+			message += fmt.Sprintf(", newest sample %s ago", age.Truncate(time.Second))
+		}
 	}
-	defer db.Close()
-
-	// Now see if we can ping the specified database
-	err = db.Ping()
 
+	jsonDetails, err := json.Marshal(details)
 	if err != nil {
-		return &backend.CheckHealthResult{
-			Status:  backend.HealthStatusError,
-			Message: "Failure to ping db: " + err.Error(),
-		}, nil
-
-	} else {
-		// Confirmation success back to the user
-		message = fmt.Sprintf("confirmed: %s:%s:%s:%s", config.Server, config.Role, config.Database, config.MetaTable)
+		logger(ctx).Error(fl()+"cannot encode the health details", "error", err)
 	}
 
 	return &backend.CheckHealthResult{
-		Status:  status,
-		Message: message,
+		Status:      status,
+		Message:     message,
+		JSONDetails: jsonDetails,
 	}, nil
 }
 
+// writeResult answers an unversioned path with the value under the path's name, or the uniform error body.
+// An error is a bad request unless it says otherwise.
 func writeResult(rw http.ResponseWriter, path string, val interface{}, err error) {
-	response := make(map[string]interface{})
-	code := http.StatusOK
 	if err != nil {
-		response["error"] = err.Error()
-		code = http.StatusBadRequest
-	} else {
-		response[path] = val
+		writeError(rw, errorStatus(err, http.StatusBadRequest), err)
+		return
 	}
 
-	body, err := json.Marshal(response)
+	writeJSON(rw, http.StatusOK, map[string]interface{}{path: val})
+}
+
+// writeJSON answers with a JSON body
+func writeJSON(rw http.ResponseWriter, code int, val interface{}) {
+	body, err := json.Marshal(val)
 	if err != nil {
-		body = []byte(err.Error())
+		body, _ = json.Marshal(apiErrorBody{Error: err.Error(), Status: http.StatusInternalServerError})
 		code = http.StatusInternalServerError
 	}
+
+	// The status has to go out before the body, writing first would fix it at 200
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(code)
 	_, err = rw.Write(body)
 	if err != nil {
-		code = http.StatusInternalServerError
+		log.DefaultLogger.Error(fl()+"resource response write error", "status", code, "error", err)
 	}
-	rw.WriteHeader(code)
 }
 
-func (ds *KeywordDatasource) handleResourceKeywords(rw http.ResponseWriter, req *http.Request) {
-	log.DefaultLogger.Debug(fl() + "resource call url=" + req.URL.String() + "  method=" + req.Method)
+// handleResourceServices lists the services for the query editor's dropdown, keyed by name.  The versioned
+// API's /services gives a list instead.
+func (ds *KeywordDatasource) handleResourceServices(rw http.ResponseWriter, req *http.Request) {
+	// The archive was opened when the instance was created
+	ctx := req.Context()
+	store, err := ds.archive()
+	if err != nil {
+		logger(ctx).Error(fl()+"archive unavailable", "error", err)
+		writeResult(rw, "?", nil, withStatus(http.StatusServiceUnavailable, err))
+		return
+	}
 
-	if req.Method != http.MethodGet {
+	list, err := store.Services(ctx)
+	if err != nil {
+		logger(ctx).Error(fl()+"services retrieval failure", "error", err)
+		writeResult(rw, "?", nil, withStatus(http.StatusInternalServerError, err))
 		return
 	}
 
-	// Get the configuration
+	// Older query editors take the entries of a map, so the name is both key and value
+	services := map[string]string{}
+	for _, service := range list {
+		services[service] = service
+	}
+
+	writeResult(rw, "services", services, nil)
+}
+
+// handleResourceKeywords lists a service's keywords for the query editor's dropdown, keyed by bare name with
+// the service.keyword for display
+func (ds *KeywordDatasource) handleResourceKeywords(rw http.ResponseWriter, req *http.Request) {
 	ctx := req.Context()
-	cfg, err := LoadSettings(httpadapter.PluginConfigFromContext(ctx))
+	store, err := ds.archive()
 	if err != nil {
-		log.DefaultLogger.Error(fl() + "settings load error")
-		writeResult(rw, "?", nil, err)
+		logger(ctx).Error(fl()+"archive unavailable", "error", err)
+		writeResult(rw, "?", nil, withStatus(http.StatusServiceUnavailable, err))
 		return
 	}
 
-	// Build the connection string
-	psqlInfo := fmt.Sprintf("host=%s port=%s user=%s dbname=%s sslmode=disable", cfg.Server, cfg.Port, cfg.Role, cfg.Database)
-
-	// See if we can open the Postgres interface
-	db, err := sql.Open("postgres", psqlInfo)
+	// The only parameter expected to come in is the one indicating for which service to retrieve the keywords
+	params, err := url.ParseQuery(req.URL.RawQuery)
 	if err != nil {
-		log.DefaultLogger.Error(fl() + "DB connection error")
+		logger(ctx).Warn(fl()+"keywords URL error", "url", req.URL.String(), "error", err)
 		writeResult(rw, "?", nil, err)
 		return
 	}
-	defer db.Close()
-
-	// Retrieve the keywords for a given service
-	if strings.HasPrefix(req.URL.String(), "/keywords") {
-
-		// The only parameter expected to come in is the one indicating for which service to retrieve the keywords
-		params, err := url.ParseQuery(req.URL.RawQuery)
-		if err != nil {
-			log.DefaultLogger.Error(fl() + "keywords URL error: " + err.Error())
-			writeResult(rw, "?", nil, err)
-			return
-		}
-		service := params.Get("service")
-
-		sqlStatement := "select keyword from ktlmeta where service = $1 order by keyword asc;"
-		rows, err := db.Query(sqlStatement, service)
-
-		if err != nil {
-			log.DefaultLogger.Error(fl() + "keywords retrieval failure")
-			writeResult(rw, "?", nil, err)
-		}
-		defer rows.Close()
-
-		// Prepare a container to send back to the caller
-		keywords := map[string]string{}
-
-		// Iterate the service list and add to the return array
-		var keyword string
-		for rows.Next() {
-			err = rows.Scan(&keyword)
-			if err != nil {
-				log.DefaultLogger.Error(fl() + "keywords scan error")
-				writeResult(rw, "?", nil, err)
-			}
-
-			// Make a key-value pair for Grafana to use, the key is the bare keyword name and the service.keyword is the display value
-			keywords[keyword] = service + "." + keyword
-		}
-
-		// get any error encountered during iteration
-		err = rows.Err()
-		if err != nil {
-			log.DefaultLogger.Error(fl() + "services row error")
-			writeResult(rw, "?", nil, err)
-		}
-
-		writeResult(rw, "keywords", keywords, err)
-
-		// Retrieve the services list
-	} else if strings.HasPrefix(req.URL.String(), "/services") {
-
-		// Retrieve the services, all of them, 106 on 2020-06-09
-		sqlStatement := "select distinct service from ktlmeta order by service ASC;"
-		rows, err := db.Query(sqlStatement)
-
-		if err != nil {
-			log.DefaultLogger.Error(fl() + "services count error")
-			writeResult(rw, "?", nil, err)
-		}
-		defer rows.Close()
-
-		// Prepare a container to send back to the caller
-		services := map[string]string{}
-
-		// Iterate the service list and add to the return array
-		var service string
-		for rows.Next() {
-			err = rows.Scan(&service)
-			if err != nil {
-				log.DefaultLogger.Error(fl() + "services scan error")
-				writeResult(rw, "?", nil, err)
-			}
-
-			// Make a key-value pair for Grafana to use but the key and the value end up being the same (is this lazy?)
-			services[service] = service
-		}
-
-		// get any error encountered during iteration
-		err = rows.Err()
-		if err != nil {
-			log.DefaultLogger.Error(fl() + "services row error")
-			writeResult(rw, "?", nil, err)
-		}
-
-		writeResult(rw, "services", services, err)
-
-	} else {
+	service := params.Get("service")
+	if service == "" {
+		writeResult(rw, "?", nil, fmt.Errorf("the keywords need a service parameter"))
+		return
+	}
 
-		// If we got this far, it was a bogus request
-		log.DefaultLogger.Error(fl() + "invalid request string")
-		writeResult(rw, "?", nil, err)
+	list, err := store.Keywords(ctx, service)
+	if err != nil {
+		logger(ctx).Error(fl()+"keywords retrieval failure", "service", service, "error", err)
+		writeResult(rw, "?", nil, withStatus(http.StatusInternalServerError, err))
+		return
 	}
 
-}
+	keywords := map[string]string{}
+	for _, keyword := range list {
+		keywords[keyword] = service + "." + keyword
+	}
 
-type instanceSettings struct {
-	httpClient *http.Client
+	writeResult(rw, "keywords", keywords, nil)
 }
 
-//func newDataSourceInstance(setting backend.DataSourceInstanceSettings) (instancemgmt.Instance, error) {
-func newDataSourceInstance(ctx context.Context, settings backend.DataSourceInstanceSettings) (instancemgmt.Instance, error) {
-	return &instanceSettings{
-		httpClient: &http.Client{},
-	}, nil
+// handleResourceConversions returns the unit conversion registry so the query editor can offer it
+func (ds *KeywordDatasource) handleResourceConversions(rw http.ResponseWriter, req *http.Request) {
+	writeResult(rw, "conversions", UnitConversions(), nil)
 }
 
-func (s *instanceSettings) Dispose() {
-	// Called before creating a a new instance to allow plugin authors
-	// to cleanup.
+// handleResourceTransforms returns the transform registry so the query editor can offer it
+func (ds *KeywordDatasource) handleResourceTransforms(rw http.ResponseWriter, req *http.Request) {
+	writeResult(rw, "transforms", Transforms(), nil)
 }
@@ -1,20 +1,106 @@
 package plugin
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/apache/arrow-go/v18/arrow/ipc"
 	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
 )
 
+// newTestDatasource returns a datasource over an in-memory archive holding a ramp and an angle
+func newTestDatasource(t *testing.T) *KeywordDatasource {
+	t.Helper()
+
+	store := NewMemoryStore()
+	store.AddKeyword(KeywordMetadata{Service: "dcs", Keyword: "AZ", Units: "deg", Description: "Telescope azimuth"})
+
+	var times []time.Time
+	var ramp, angle []string
+	for i := 0; i < 10; i++ {
+		times = append(times, testEpoch.Add(time.Duration(i)*time.Second))
+		ramp = append(ramp, strconv.Itoa(i))
+		angle = append(angle, "0:30:00")
+	}
+
+	if err := store.AddSamples("test.RAMP", times, ramp); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.AddSamples("dcs.AZ", times, angle); err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := parseSettings([]byte(`{}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ds := newKeywordDatasource(config, store)
+	ds.calibrations, err = newCalibrationCatalog(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return ds
+}
+
+// runQuery runs a single query over the first few seconds of the fixtures
+func runQuery(t *testing.T, ds *KeywordDatasource, queryType string, model string) backend.DataResponse {
+	t.Helper()
+
+	resp, err := ds.QueryData(
+		context.Background(),
+		&backend.QueryDataRequest{
+			Queries: []backend.DataQuery{
+				{
+					RefID:     "A",
+					QueryType: queryType,
+					JSON:      json.RawMessage(model),
+					TimeRange: backend.TimeRange{From: testEpoch, To: testEpoch.Add(4 * time.Second)},
+				},
+			},
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return resp.Responses["A"]
+}
+
+// floatValues returns the float64 values of a field
+func floatValues(t *testing.T, field *data.Field) []float64 {
+	t.Helper()
+
+	values := make([]float64, field.Len())
+	for i := range values {
+		v, ok := field.ConcreteAt(i)
+		if !ok {
+			t.Fatalf("field %s has no value at %d", field.Name, i)
+		}
+		values[i] = v.(float64)
+	}
+
+	return values
+}
+
 func TestQueryData(t *testing.T) {
-	ds := Datasource{}
+	ds := newTestDatasource(t)
 
 	resp, err := ds.QueryData(
 		context.Background(),
 		&backend.QueryDataRequest{
 			Queries: []backend.DataQuery{
-				{RefID: "A"},
+				{RefID: "A", JSON: json.RawMessage(`{}`)},
 			},
 		},
 	)
@@ -26,3 +112,400 @@ func TestQueryData(t *testing.T) {
 		t.Fatal("QueryData must return a response")
 	}
 }
+
+func TestQueryTimeSeries(t *testing.T) {
+	ds := newTestDatasource(t)
+
+	res := runQuery(t, ds, QUERY_TYPE_TIMESERIES, `{"queryText": "test.RAMP"}`)
+	if res.Error != nil {
+		t.Fatal(res.Error)
+	}
+	if len(res.Frames) != 1 || res.Frames[0].Name != "test.RAMP" {
+		t.Fatalf("expected a single test.RAMP frame, got %v", res.Frames)
+	}
+
+	values := floatValues(t, res.Frames[0].Fields[0])
+	expected := []float64{0, 1, 2, 3, 4}
+	if len(values) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, values)
+	}
+	for i := range expected {
+		if values[i] != expected[i] {
+			t.Fatalf("expected %v, got %v", expected, values)
+		}
+	}
+}
+
+func TestQueryConversionAndTransforms(t *testing.T) {
+	ds := newTestDatasource(t)
+
+	// The sexagesimal angle is half a degree, converted to arcminutes
+	res := runQuery(t, ds, QUERY_TYPE_TIMESERIES, `{"queryText": "dcs.AZ", "conversion": "deg_to_arcmin"}`)
+	if res.Error != nil {
+		t.Fatal(res.Error)
+	}
+	for _, v := range floatValues(t, res.Frames[0].Fields[0]) {
+		if math.Abs(v-30) > 1e-9 {
+			t.Fatalf("expected 30 arcmin, got %g", v)
+		}
+	}
+
+	// The ramp rises by one per second, scaled by two
+	res = runQuery(t, ds, QUERY_TYPE_TIMESERIES,
+		`{"queryText": "test.RAMP", "transforms": [{"name": "convert", "params": {"conversion": "scale_offset", "scale": 2}}, {"name": "derivative"}]}`)
+	if res.Error != nil {
+		t.Fatal(res.Error)
+	}
+	for _, v := range floatValues(t, res.Frames[0].Fields[0]) {
+		if math.Abs(v-2) > 1e-9 {
+			t.Fatalf("expected a derivative of 2, got %g", v)
+		}
+	}
+
+	// An unknown transform is reported on the query rather than failing the request
+	res = runQuery(t, ds, QUERY_TYPE_TIMESERIES, `{"queryText": "test.RAMP", "transforms": [{"name": "nonsense"}]}`)
+	if res.Error == nil {
+		t.Fatal("expected an error for an unknown transform")
+	}
+}
+
+func TestQueryStats(t *testing.T) {
+	ds := newTestDatasource(t)
+
+	res := runQuery(t, ds, QUERY_TYPE_STATS, `{"queryText": "test.RAMP", "percentiles": [50]}`)
+	if res.Error != nil {
+		t.Fatal(res.Error)
+	}
+
+	frame := res.Frames[0]
+	field, _ := frame.FieldByName("mean")
+	if mean, _ := field.ConcreteAt(0); mean.(float64) != 2 {
+		t.Fatalf("expected a mean of 2, got %v", mean)
+	}
+	field, _ = frame.FieldByName("count")
+	if count, _ := field.ConcreteAt(0); count.(int64) != 5 {
+		t.Fatalf("expected 5 samples, got %v", count)
+	}
+}
+
+func TestQueryHistogram(t *testing.T) {
+	ds := newTestDatasource(t)
+
+	res := runQuery(t, ds, QUERY_TYPE_HISTOGRAM, `{"queryText": "test.RAMP", "histogram": {"binWidth": 5}}`)
+	if res.Error != nil {
+		t.Fatal(res.Error)
+	}
+
+	counts := floatValues(t, res.Frames[0].Fields[2])
+	if len(counts) != 1 || counts[0] != 5 {
+		t.Fatalf("expected all 5 samples in one bucket, got %v", counts)
+	}
+}
+
+func TestQueryTimeShift(t *testing.T) {
+	ds := newTestDatasource(t)
+
+	// Five seconds on, the ramp is read from 5 to 9 and moved back into the panel's range
+	res := runQuery(t, ds, QUERY_TYPE_TIMESERIES, `{"queryText": "test.RAMP", "timeShift": "+5s"}`)
+	if res.Error != nil {
+		t.Fatal(res.Error)
+	}
+
+	frame := res.Frames[0]
+	if frame.Name != "test.RAMP (+5s)" {
+		t.Fatalf("expected the series to be marked with the shift, got %q", frame.Name)
+	}
+	if values := floatValues(t, frame.Fields[0]); !sameValues(values, []float64{5, 6, 7, 8, 9}, 0) {
+		t.Fatalf("expected the later samples, got %v", values)
+	}
+	field, _ := frame.FieldByName("time")
+	for i := 0; i < field.Len(); i++ {
+		if stamp := field.At(i).(time.Time); !stamp.Equal(testEpoch.Add(time.Duration(i) * time.Second)) {
+			t.Fatalf("sample %d stamped %v, outside the panel range", i, stamp)
+		}
+	}
+
+	// The named shifts are the same as their amounts, whichever way they are phrased
+	for shift, expected := range map[string]string{
+		"":                     "test.RAMP",
+		"1d":                   "test.RAMP (-1d)",
+		"Last Night":           "test.RAMP (-1d)",
+		"same time last night": "test.RAMP (-1d)",
+		"this time  yesterday": "test.RAMP (-1d)",
+		"same time last week":  "test.RAMP (-7d)",
+	} {
+		qm := queryModel{TimeShift: shift}
+		if got := qm.seriesName("test.RAMP"); got != expected {
+			t.Fatalf("%q: expected %q, got %q", shift, expected, got)
+		}
+	}
+
+	// A shift that cannot be read fails the query rather than showing the unshifted range
+	for _, shift := range []string{"sometime", "-1y", "same time tomorrow"} {
+		res = runQuery(t, ds, QUERY_TYPE_TIMESERIES, `{"queryText": "test.RAMP", "timeShift": "`+shift+`"}`)
+		if res.Error == nil || !strings.Contains(res.Error.Error(), "invalid time shift") {
+			t.Fatalf("%q: expected an invalid time shift, got %v", shift, res.Error)
+		}
+	}
+}
+
+func TestQueryStaleness(t *testing.T) {
+	ds := newTestDatasource(t)
+
+	// A minute after the epoch both keywords were last archived 51 seconds before, dcs.EL never was
+	end := testEpoch.Add(time.Minute)
+	resp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+		Queries: []backend.DataQuery{{
+			RefID:     "A",
+			QueryType: QUERY_TYPE_STALENESS,
+			JSON:      json.RawMessage(`{"queryText": "*.RAMP, dcs.*, dcs.EL", "staleness": {"thresholds": {"test.*": "30s"}}}`),
+			TimeRange: backend.TimeRange{From: testEpoch, To: end},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := resp.Responses["A"]
+	if res.Error != nil {
+		t.Fatal(res.Error)
+	}
+
+	frame := res.Frames[0]
+	keywords := []string{}
+	for i := 0; i < frame.Fields[0].Len(); i++ {
+		keywords = append(keywords, frame.Fields[0].At(i).(string))
+	}
+	if strings.Join(keywords, ",") != "test.RAMP,dcs.AZ,dcs.EL" {
+		t.Fatalf("unexpected keywords: %v", keywords)
+	}
+
+	age, _ := frame.Fields[3].ConcreteAt(0)
+	value, _ := frame.Fields[2].ConcreteAt(0)
+	if age != 51.0 || value != "9" {
+		t.Fatalf("unexpected age %v or value %v", age, value)
+	}
+
+	stale := []bool{frame.Fields[5].At(0).(bool), frame.Fields[5].At(1).(bool), frame.Fields[5].At(2).(bool)}
+	if !stale[0] || stale[1] || !stale[2] {
+		t.Fatalf("unexpected staleness: %v", stale)
+	}
+	if _, ok := frame.Fields[1].ConcreteAt(2); ok {
+		t.Fatal("expected no last time for a keyword never archived")
+	}
+
+	// A bad threshold is an error
+	res = runQuery(t, ds, QUERY_TYPE_STALENESS, `{"queryText": "test.RAMP", "staleness": {"threshold": "soon"}}`)
+	if res.Error == nil {
+		t.Fatal("expected an invalid threshold to fail")
+	}
+}
+
+// callResource calls a resource path on the datasource and decodes the JSON response
+func callResource(t *testing.T, ds *KeywordDatasource, path string) (int, map[string]interface{}) {
+	t.Helper()
+
+	var status int
+	var body map[string]interface{}
+
+	err := ds.CallResource(context.Background(),
+		&backend.CallResourceRequest{Method: http.MethodGet, Path: strings.SplitN(path, "?", 2)[0], URL: path},
+		backend.CallResourceResponseSenderFunc(func(res *backend.CallResourceResponse) error {
+			status = res.Status
+			return json.Unmarshal(res.Body, &body)
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return status, body
+}
+
+func TestResources(t *testing.T) {
+	ds := newTestDatasource(t)
+
+	_, body := callResource(t, ds, "/services")
+	services, _ := body["services"].(map[string]interface{})
+	if len(services) != 2 || services["dcs"] != "dcs" {
+		t.Fatalf("unexpected services: %v", body)
+	}
+
+	_, body = callResource(t, ds, "/keywords?service=dcs")
+	keywords, _ := body["keywords"].(map[string]interface{})
+	if len(keywords) != 1 || keywords["AZ"] != "dcs.AZ" {
+		t.Fatalf("unexpected keywords: %v", body)
+	}
+
+	_, body = callResource(t, ds, "/conversions")
+	if conversions, _ := body["conversions"].([]interface{}); len(conversions) == 0 {
+		t.Fatalf("expected the conversion registry, got %v", body)
+	}
+}
+
+func TestCheckHealth(t *testing.T) {
+	ds := newTestDatasource(t)
+
+	res, err := ds.CheckHealth(context.Background(), &backend.CheckHealthRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Status != backend.HealthStatusOk {
+		t.Fatalf("expected a healthy datasource, got %s", res.Message)
+	}
+
+	// The details report each layer, the newest sample is the last of the ramp
+	var details healthDetails
+	err = json.Unmarshal(res.JSONDetails, &details)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if details.Connection.Status != HEALTH_OK || details.Metadata.Services != 2 || details.Metadata.Keywords != 2 || len(details.Tables) != 2 {
+		t.Fatalf("unexpected health details: %s", res.JSONDetails)
+	}
+	if details.NewestSample == nil || !details.NewestSample.Equal(testEpoch.Add(9*time.Second)) {
+		t.Fatalf("unexpected newest sample: %s", res.JSONDetails)
+	}
+
+	// A bad calibration is reported by the health check
+	instance, err := NewDatasource(context.Background(), backend.DataSourceInstanceSettings{
+		JSONData: json.RawMessage(`{"calibrations": {"dcs.AZ": {}}}`),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err = instance.(*KeywordDatasource).CheckHealth(context.Background(), &backend.CheckHealthRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Status != backend.HealthStatusError {
+		t.Fatal("expected invalid settings to fail the health check")
+	}
+	details = healthDetails{}
+	err = json.Unmarshal(res.JSONDetails, &details)
+	if err != nil || details.Settings.Status != HEALTH_ERROR || details.Connection.Status != HEALTH_SKIPPED {
+		t.Fatalf("unexpected health details: %s", res.JSONDetails)
+	}
+	if !strings.HasPrefix(res.Message, "Invalid settings: calibration dcs.AZ") {
+		t.Fatalf("expected the capitalised error, got %q", res.Message)
+	}
+}
+
+func TestCapitalize(t *testing.T) {
+	for text, expected := range map[string]string{
+		"":                  "",
+		"connection failed": "Connection failed",
+		"échec":             "Échec",
+		"ölçüm":             "Ölçüm",
+		"42 tables":         "42 tables",
+		"\xffbad":           "\xffbad",
+	} {
+		if got := capitalize(text); got != expected {
+			t.Fatalf("%q: expected %q, got %q", text, expected, got)
+		}
+	}
+}
+
+// callResourceRaw calls a resource path and gathers the streamed response body
+func callResourceRaw(t *testing.T, ds *KeywordDatasource, path string) (int, http.Header, []byte, int) {
+	t.Helper()
+
+	var status, chunks int
+	var headers http.Header
+	var body []byte
+
+	err := ds.CallResource(context.Background(),
+		&backend.CallResourceRequest{Method: http.MethodGet, Path: strings.SplitN(path, "?", 2)[0], URL: path},
+		backend.CallResourceResponseSenderFunc(func(res *backend.CallResourceResponse) error {
+			if chunks == 0 {
+				status = res.Status
+				headers = res.Headers
+			}
+			chunks++
+			body = append(body, res.Body...)
+			return nil
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return status, headers, body, chunks
+}
+
+func TestExport(t *testing.T) {
+	ds := newTestDatasource(t)
+	from := strconv.FormatInt(testEpoch.UnixMilli(), 10)
+	to := strconv.FormatInt(testEpoch.Add(3*time.Second).UnixMilli(), 10)
+
+	// A one second window reads the archive in pieces, the boundary samples must not repeat
+	status, headers, body, _ := callResourceRaw(t, ds,
+		"/export?keyword=test.RAMP&from="+from+"&to="+to+"&window=1s&conversion=scale_offset&scale=10")
+	if status != http.StatusOK || headers["Content-Type"][0] != "text/csv" {
+		t.Fatalf("unexpected response %d %v: %s", status, headers, body)
+	}
+	expected := "time,keyword,value\n" +
+		"2024-03-01T00:00:00Z,test.RAMP,0\n" +
+		"2024-03-01T00:00:01Z,test.RAMP,10\n" +
+		"2024-03-01T00:00:02Z,test.RAMP,20\n" +
+		"2024-03-01T00:00:03Z,test.RAMP,30\n"
+	if string(body) != expected {
+		t.Fatalf("unexpected CSV:\n%s", body)
+	}
+
+	// The derivative needs the whole series, so the window is ignored
+	_, _, body, _ = callResourceRaw(t, ds,
+		"/export?keyword=test.RAMP&from="+from+"&to="+to+"&window=1s&format=ndjson&transforms="+url.QueryEscape(`[{"name": "derivative"}]`))
+	lines := strings.Split(strings.TrimSpace(string(body)), "\n")
+	if len(lines) != 3 || !strings.Contains(lines[0], `"value":1`) {
+		t.Fatalf("unexpected NDJSON:\n%s", body)
+	}
+
+	// The first sample has no spread, a NaN which JSON cannot hold so it is exported as null
+	status, _, body, _ = callResourceRaw(t, ds,
+		"/export?keyword=test.RAMP&from="+from+"&to="+to+"&format=ndjson&transforms="+url.QueryEscape(`[{"name": "rolling_std", "params": {"window": 2}}]`))
+	lines = strings.Split(strings.TrimSpace(string(body)), "\n")
+	if status != http.StatusOK || len(lines) != 4 || !strings.Contains(lines[0], `"value":null`) ||
+		strings.Contains(lines[1], `"value":null`) {
+		t.Fatalf("expected a null then the rolling deviation, got %d:\n%s", status, body)
+	}
+	for _, line := range lines {
+		var sample map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &sample); err != nil {
+			t.Fatalf("%s: %v", line, err)
+		}
+	}
+
+	_, _, body, _ = callResourceRaw(t, ds, "/export?keyword=test.RAMP,dcs.AZ&from="+from+"&to="+to+"&format=arrow")
+	reader, err := ipc.NewReader(bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Release()
+	rows := 0
+	for reader.Next() {
+		rows += int(reader.Record().NumRows())
+	}
+	if rows != 8 {
+		t.Fatalf("expected 8 Arrow rows, got %d", rows)
+	}
+
+	// Problems are reported before anything is streamed
+	status, _, _, _ = callResourceRaw(t, ds, "/export?keyword=test.RAMP&from="+from)
+	if status != http.StatusBadRequest {
+		t.Fatalf("expected a bad request without a to time, got %d", status)
+	}
+
+	// Keywords are expanded and checked against the catalog before the headers go out
+	for _, keyword := range []string{"test.RAMPP", "nope.*", "test.RAMP,dcs.NOPE"} {
+		status, _, body, _ = callResourceRaw(t, ds, "/export?keyword="+url.QueryEscape(keyword)+"&from="+from+"&to="+to)
+		if status != http.StatusBadRequest {
+			t.Fatalf("%s: expected a bad request, got %d: %s", keyword, status, body)
+		}
+	}
+
+	status, _, body, _ = callResourceRaw(t, ds, "/export?keyword="+url.QueryEscape("test.*")+"&from="+from+"&to="+to+
+		"&format=ndjson")
+	if lines = strings.Split(strings.TrimSpace(string(body)), "\n"); status != http.StatusOK || len(lines) != 4 {
+		t.Fatalf("expected test.* to export test.RAMP, got %d:\n%s", status, body)
+	}
+}
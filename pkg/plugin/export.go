@@ -0,0 +1,473 @@
+package plugin
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/apache/arrow-go/v18/arrow"
+	"github.com/apache/arrow-go/v18/arrow/array"
+	"github.com/apache/arrow-go/v18/arrow/ipc"
+	"github.com/apache/arrow-go/v18/arrow/memory"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+// The export formats
+const (
+	EXPORT_CSV    = "csv"
+	EXPORT_NDJSON = "ndjson"
+	EXPORT_ARROW  = "arrow"
+	EXPORT_FITS   = "fits"
+)
+
+// Rows written between flushes, each flush goes back to Grafana as a chunk of the response
+const EXPORT_FLUSH_ROWS = 10000
+
+// The default span of archive read at a time when the transforms allow it
+const EXPORT_DEFAULT_WINDOW = time.Hour
+
+// exportRequest is an export decoded from the resource URL
+type exportRequest struct {
+	qm        queryModel
+	keys      []string
+	pipeline  *transformPipeline
+	timeRange backend.TimeRange
+	format    string
+	window    time.Duration
+}
+
+// parseExportRequest reads the export parameters.  The query may be given whole as the panel saved it in
+// "query", or in parts as keyword, conversion, transforms and so on, the parts take precedence.
+func parseExportRequest(params url.Values) (*exportRequest, error) {
+	r := &exportRequest{
+		format: params.Get("format"),
+		window: EXPORT_DEFAULT_WINDOW,
+	}
+	if r.format == "" {
+		r.format = EXPORT_CSV
+	}
+
+	if query := params.Get("query"); query != "" {
+		err := json.Unmarshal([]byte(query), &r.qm)
+		if err != nil {
+			return nil, fmt.Errorf("invalid query: %s", err.Error())
+		}
+	}
+
+	// Keywords may be repeated or comma separated
+	for _, keyword := range params["keyword"] {
+		r.qm.Keywords = append(r.qm.Keywords, strings.Split(keyword, ",")...)
+	}
+
+	if params.Has("conversion") {
+		r.qm.Conversion = params.Get("conversion")
+	}
+	for name, v := range map[string]*float64{"scale": &r.qm.ConversionScale, "offset": &r.qm.ConversionOffset} {
+		if params.Has(name) {
+			f, err := strconv.ParseFloat(params.Get(name), 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s: %s", name, params.Get(name))
+			}
+			*v = f
+		}
+	}
+	if params.Has("calibrate") {
+		r.qm.Calibrate = params.Get("calibrate")
+	}
+	if params.Has("timeShift") {
+		r.qm.TimeShift = params.Get("timeShift")
+	}
+	if params.Has("transforms") {
+		r.qm.Transforms = nil
+		err := json.Unmarshal([]byte(params.Get("transforms")), &r.qm.Transforms)
+		if err != nil {
+			return nil, fmt.Errorf("invalid transforms: %s", err.Error())
+		}
+	}
+
+	r.keys = r.qm.keywordList()
+	if len(r.keys) == 0 {
+		return nil, fmt.Errorf("no keyword given")
+	}
+	for _, key := range r.keys {
+		if _, _, err := splitKeyword(key); err != nil {
+			return nil, err
+		}
+	}
+
+	var err error
+	r.timeRange.From, err = parseExportTime(params.Get("from"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid from: %s", err.Error())
+	}
+	r.timeRange.To, err = parseExportTime(params.Get("to"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid to: %s", err.Error())
+	}
+	if r.timeRange.To.Before(r.timeRange.From) {
+		return nil, fmt.Errorf("to must not be before from")
+	}
+
+	if window := params.Get("window"); window != "" {
+		r.window, err = time.ParseDuration(window)
+		if err != nil || r.window <= 0 {
+			return nil, fmt.Errorf("invalid window: %s", window)
+		}
+	}
+
+	steps, err := r.qm.transformSteps()
+	if err != nil {
+		return nil, err
+	}
+	r.pipeline, err = newTransformPipeline(steps)
+	if err != nil {
+		return nil, err
+	}
+	if r.pipeline.spectrum != nil {
+		return nil, fmt.Errorf("a spectrum cannot be exported as a time series")
+	}
+
+	_, _, err = parseTimeShift(r.qm.TimeShift)
+	if err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// parseExportTime reads a time as Unix milliseconds, as Grafana's ${__from} gives, or as RFC 3339
+func parseExportTime(text string) (time.Time, error) {
+	if text == "" {
+		return time.Time{}, fmt.Errorf("a time is required")
+	}
+
+	ms, err := strconv.ParseInt(text, 10, 64)
+	if err == nil {
+		return time.UnixMilli(ms), nil
+	}
+
+	return time.Parse(time.RFC3339Nano, text)
+}
+
+// expandExportKeywords expands wildcards and checks every keyword against the catalog, as a query does, so
+// that an export can be refused before anything is written rather than cut short part way
+func (ds *KeywordDatasource) expandExportKeywords(ctx context.Context, store ArchiveStore, r *exportRequest) error {
+	keys, err := expandKeywords(ctx, store, r.keys)
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("no keywords match %s", strings.Join(r.keys, ", "))
+	}
+
+	err = ds.catalog.validate(ctx, keys)
+	if err != nil {
+		return err
+	}
+
+	r.keys = keys
+	return nil
+}
+
+// exportWriter writes exported samples in one of the formats, a keyword's samples arrive in pieces
+type exportWriter interface {
+	contentType() string
+	write(key string, times []time.Time, values []float64) error
+	close() error
+}
+
+func newExportWriter(w io.Writer, format string) (exportWriter, error) {
+	switch format {
+	case EXPORT_CSV:
+		return newCSVExport(w)
+	case EXPORT_NDJSON:
+		return &ndjsonExport{encoder: json.NewEncoder(w)}, nil
+	case EXPORT_ARROW:
+		return newArrowExport(w), nil
+	default:
+		return nil, fmt.Errorf("unknown export format: %s", format)
+	}
+}
+
+// csvExport writes time,keyword,value rows
+type csvExport struct {
+	w *csv.Writer
+}
+
+func newCSVExport(w io.Writer) (*csvExport, error) {
+	e := &csvExport{w: csv.NewWriter(w)}
+	return e, e.w.Write([]string{"time", "keyword", "value"})
+}
+
+func (e *csvExport) contentType() string {
+	return "text/csv"
+}
+
+func (e *csvExport) write(key string, times []time.Time, values []float64) error {
+	for i := range values {
+		err := e.w.Write([]string{
+			times[i].UTC().Format(time.RFC3339Nano),
+			key,
+			strconv.FormatFloat(values[i], 'g', -1, 64),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	e.w.Flush()
+	return e.w.Error()
+}
+
+func (e *csvExport) close() error {
+	e.w.Flush()
+	return e.w.Error()
+}
+
+// ndjsonExport writes a JSON object per sample, one per line
+type ndjsonExport struct {
+	encoder *json.Encoder
+}
+
+// The value is null where a transform leaves no number (NaN or infinite), which JSON cannot hold
+type ndjsonSample struct {
+	Time    time.Time `json:"time"`
+	Keyword string    `json:"keyword"`
+	Value   *float64  `json:"value"`
+}
+
+func (e *ndjsonExport) contentType() string {
+	return "application/x-ndjson"
+}
+
+func (e *ndjsonExport) write(key string, times []time.Time, values []float64) error {
+	for i := range values {
+		sample := ndjsonSample{Time: times[i].UTC(), Keyword: key}
+		if !math.IsNaN(values[i]) && !math.IsInf(values[i], 0) {
+			sample.Value = &values[i]
+		}
+
+		err := e.encoder.Encode(sample)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *ndjsonExport) close() error {
+	return nil
+}
+
+// arrowExport writes an Arrow IPC stream, a record batch per piece of a keyword
+type arrowExport struct {
+	w       *ipc.Writer
+	schema  *arrow.Schema
+	builder *array.RecordBuilder
+}
+
+func newArrowExport(w io.Writer) *arrowExport {
+	schema := arrow.NewSchema([]arrow.Field{
+		{Name: "time", Type: &arrow.TimestampType{Unit: arrow.Nanosecond, TimeZone: "UTC"}},
+		{Name: "keyword", Type: arrow.BinaryTypes.String},
+		{Name: "value", Type: arrow.PrimitiveTypes.Float64},
+	}, nil)
+
+	return &arrowExport{
+		w:       ipc.NewWriter(w, ipc.WithSchema(schema)),
+		schema:  schema,
+		builder: array.NewRecordBuilder(memory.DefaultAllocator, schema),
+	}
+}
+
+func (e *arrowExport) contentType() string {
+	return "application/vnd.apache.arrow.stream"
+}
+
+func (e *arrowExport) write(key string, times []time.Time, values []float64) error {
+	if len(values) == 0 {
+		return nil
+	}
+
+	timeBuilder := e.builder.Field(0).(*array.TimestampBuilder)
+	keywordBuilder := e.builder.Field(1).(*array.StringBuilder)
+	for i := range values {
+		timeBuilder.Append(arrow.Timestamp(times[i].UnixNano()))
+		keywordBuilder.Append(key)
+	}
+	e.builder.Field(2).(*array.Float64Builder).AppendValues(values, nil)
+
+	record := e.builder.NewRecord()
+	defer record.Release()
+
+	return e.w.Write(record)
+}
+
+func (e *arrowExport) close() error {
+	e.builder.Release()
+	return e.w.Close()
+}
+
+// export writes every keyword in turn.  When the transforms allow it the archive is read a window at a
+// time so that a long range is never held in memory, otherwise each keyword is read whole.  flush is
+// called as the output grows so that it goes out in chunks.
+func (ds *KeywordDatasource) export(ctx context.Context, store ArchiveStore, r *exportRequest, out exportWriter, flush func()) error {
+	for _, key := range r.keys {
+		window := r.timeRange.To.Sub(r.timeRange.From)
+		if r.pipeline.pointwise {
+			window = r.window
+		}
+
+		rows := 0
+		for start := r.timeRange.From; ; start = start.Add(window) {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			end := start.Add(window)
+			if end.After(r.timeRange.To) {
+				end = r.timeRange.To
+			}
+
+			times, values, err := ds.fetchSeries(ctx, store, r.qm, key, backend.TimeRange{From: start, To: end})
+			if err != nil {
+				return fmt.Errorf("%s: %w", key, err)
+			}
+
+			// Windows share their boundary, a sample exactly on it belongs to the earlier one
+			if start.After(r.timeRange.From) {
+				skip := 0
+				for skip < len(times) && !times[skip].After(start) {
+					skip++
+				}
+				times, values = times[skip:], values[skip:]
+			}
+
+			times, values, err = r.pipeline.run(ctx, times, values)
+			if err != nil {
+				return fmt.Errorf("%s: %w", key, err)
+			}
+
+			// Write in pieces so that no one chunk of the response gets too large
+			for i := 0; i < len(values); i += EXPORT_FLUSH_ROWS {
+				j := min(i+EXPORT_FLUSH_ROWS, len(values))
+				err = out.write(key, times[i:j], values[i:j])
+				if err != nil {
+					return err
+				}
+				flush()
+			}
+			rows += len(values)
+
+			if !end.Before(r.timeRange.To) {
+				break
+			}
+		}
+
+		logger(ctx).Debug(fl()+"exported keyword", "key", key, "rows", rows)
+	}
+
+	return out.close()
+}
+
+// Export writes keywords as the URL parameters of the /export resource describe, for use outside Grafana
+func (ds *KeywordDatasource) Export(ctx context.Context, w io.Writer, params url.Values) error {
+	store, err := ds.archive()
+	if err != nil {
+		return err
+	}
+
+	r, err := parseExportRequest(params)
+	if err != nil {
+		return err
+	}
+	err = ds.expandExportKeywords(ctx, store, r)
+	if err != nil {
+		return err
+	}
+
+	if r.format == EXPORT_FITS {
+		return ds.exportFITS(ctx, store, r, w, func() {})
+	}
+
+	out, err := newExportWriter(w, r.format)
+	if err != nil {
+		return err
+	}
+
+	return ds.export(ctx, store, r, out, func() {})
+}
+
+// handleResourceExport streams keywords over a time range as CSV, newline-delimited JSON, Arrow or FITS, with
+// the same conversions and transforms as a panel query
+func (ds *KeywordDatasource) handleResourceExport(rw http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	store, err := ds.archive()
+	if err != nil {
+		logger(ctx).Error(fl()+"archive unavailable", "error", err)
+		writeResult(rw, "?", nil, withStatus(http.StatusServiceUnavailable, err))
+		return
+	}
+
+	// Everything is checked before the first byte goes out, after that an error can only cut the export short
+	r, err := parseExportRequest(req.URL.Query())
+	if err != nil {
+		logger(ctx).Debug(fl()+"invalid export request", "error", err)
+		writeResult(rw, "?", nil, err)
+		return
+	}
+	err = ds.expandExportKeywords(ctx, store, r)
+	if err != nil {
+		logger(ctx).Debug(fl()+"invalid export keywords", "error", err)
+		writeResult(rw, "?", nil, err)
+		return
+	}
+	ctx = withLogValues(ctx, "keywords", r.keys, "format", r.format)
+
+	flush := func() {}
+	if flusher, ok := rw.(http.Flusher); ok {
+		flush = flusher.Flush
+	}
+
+	// FITS gives each table's size up front so it is written a keyword at a time rather than in pieces
+	if r.format == EXPORT_FITS {
+		rw.Header().Set("Content-Type", "application/fits")
+		rw.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", exportFileName(r)))
+		rw.WriteHeader(http.StatusOK)
+
+		err = ds.exportFITS(ctx, store, r, rw, flush)
+		if err != nil {
+			logger(ctx).Error(fl()+"export failed part way", "error", err)
+		}
+		return
+	}
+
+	out, err := newExportWriter(rw, r.format)
+	if err != nil {
+		writeResult(rw, "?", nil, err)
+		return
+	}
+
+	rw.Header().Set("Content-Type", out.contentType())
+	rw.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", exportFileName(r)))
+	rw.WriteHeader(http.StatusOK)
+
+	err = ds.export(ctx, store, r, out, flush)
+	if err != nil {
+		logger(ctx).Error(fl()+"export failed part way", "error", err)
+	}
+}
+
+// exportFileName names the download after the first keyword and the start of the range
+func exportFileName(r *exportRequest) string {
+	extension := map[string]string{EXPORT_CSV: "csv", EXPORT_NDJSON: "ndjson", EXPORT_ARROW: "arrow", EXPORT_FITS: "fits"}[r.format]
+	return fmt.Sprintf("%s-%s.%s", r.keys[0], r.timeRange.From.UTC().Format("20060102T150405"), extension)
+}
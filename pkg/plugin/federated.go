@@ -0,0 +1,335 @@
+package plugin
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ArchiveConnection is one of the archives a federated datasource reads, such as the Keck I, Keck II and
+// summit facility archives.  It takes the fields of a single archive datasource, an archive without its own
+// meta table or schema uses the datasource's.
+type ArchiveConnection struct {
+	// Name in logs and errors, the archive's location if empty
+	Name string `json:"name"`
+
+	Backend   string        `json:"backend"`
+	Path      string        `json:"path"`
+	Server    string        `json:"server"`
+	Port      string        `json:"port"`
+	Role      string        `json:"role"`
+	Database  string        `json:"database"`
+	MetaTable string        `json:"metatable"`
+	Schema    ArchiveSchema `json:"schema"`
+}
+
+// settings returns the connection as the settings of a datasource reading only this archive
+func (c *ArchiveConnection) settings(parent *DatasourceSettings) *DatasourceSettings {
+	s := &DatasourceSettings{
+		Backend:   c.Backend,
+		Path:      c.Path,
+		Server:    c.Server,
+		Port:      c.Port,
+		Role:      c.Role,
+		Database:  c.Database,
+		MetaTable: c.MetaTable,
+		Schema:    c.Schema,
+	}
+
+	if s.MetaTable == "" {
+		s.MetaTable = parent.MetaTable
+	}
+	if reflect.DeepEqual(s.Schema, ArchiveSchema{}) {
+		s.Schema = parent.Schema
+	}
+	s.applyDefaults()
+
+	return s
+}
+
+// federatedArchive is one of the stores behind a federated store
+type federatedArchive struct {
+	name  string
+	store ArchiveStore
+}
+
+// federatedStore reads several archives as one.  Each service is read from the archive whose metadata
+// table lists it, found by asking every archive for its services, so that a query can mix keywords from
+// different archives.  A service listed by more than one archive is read from the first of them.
+type federatedStore struct {
+	archives []federatedArchive
+
+	mu     sync.Mutex
+	routes map[string]int
+}
+
+// newFederatedStore opens each of the archives in the settings
+func newFederatedStore(settings *DatasourceSettings) (*federatedStore, error) {
+	if len(settings.Archives) == 0 {
+		return nil, fmt.Errorf("the federated archive needs at least one archive")
+	}
+
+	var archives []federatedArchive
+	names := map[string]bool{}
+	fail := func(err error) (*federatedStore, error) {
+		for _, a := range archives {
+			_ = a.store.Close()
+		}
+		return nil, err
+	}
+
+	for i := range settings.Archives {
+		c := &settings.Archives[i]
+		s := c.settings(settings)
+
+		name := c.Name
+		if name == "" {
+			name = s.source()
+		}
+		if names[name] {
+			return fail(fmt.Errorf("two archives are named %s", name))
+		}
+		names[name] = true
+
+		if s.Backend == BACKEND_FEDERATED {
+			return fail(fmt.Errorf("archive %s: a federated archive cannot hold another", name))
+		}
+
+		err := s.Schema.validate()
+		if err != nil {
+			return fail(fmt.Errorf("archive %s: %w", name, err))
+		}
+
+		store, err := newArchiveStore(s)
+		if err != nil {
+			return fail(fmt.Errorf("archive %s: %w", name, err))
+		}
+		archives = append(archives, federatedArchive{name: name, store: store})
+	}
+
+	return federate(archives), nil
+}
+
+// federate reads the stores as one, in order of preference
+func federate(archives []federatedArchive) *federatedStore {
+	return &federatedStore{archives: archives, routes: map[string]int{}}
+}
+
+// discover asks each archive for its services and routes each service to the first archive listing it.
+// An archive that cannot be reached keeps the services it had, so one archive being down does not take
+// the others' services out of the dropdowns, only all of them failing is an error.
+func (f *federatedStore) discover(ctx context.Context) ([]string, error) {
+	f.mu.Lock()
+	previous := f.routes
+	f.mu.Unlock()
+
+	routes := map[string]int{}
+	var failures []error
+	for i, a := range f.archives {
+		services, err := a.store.Services(ctx)
+		if err != nil {
+			logger(ctx).Warn(fl()+"archive unavailable, keeping its services", "archive", a.name, "error", err)
+			failures = append(failures, fmt.Errorf("archive %s: %w", a.name, err))
+			for service, j := range previous {
+				if j == i {
+					if _, ok := routes[service]; !ok {
+						routes[service] = i
+					}
+				}
+			}
+			continue
+		}
+
+		for _, service := range services {
+			if j, ok := routes[service]; ok {
+				if j != i {
+					logger(ctx).Warn(fl()+"service in more than one archive, reading the first", "service", service,
+						"archive", f.archives[j].name, "ignored", a.name)
+				}
+				continue
+			}
+			routes[service] = i
+		}
+	}
+
+	if len(failures) == len(f.archives) {
+		return nil, errors.Join(failures...)
+	}
+
+	f.mu.Lock()
+	f.routes = routes
+	f.mu.Unlock()
+
+	services := make([]string, 0, len(routes))
+	for service := range routes {
+		services = append(services, service)
+	}
+	sort.Strings(services)
+
+	return services, nil
+}
+
+// route finds the archive holding a service, asking the archives again if it is not known yet
+func (f *federatedStore) route(ctx context.Context, service string) (ArchiveStore, error) {
+	f.mu.Lock()
+	i, ok := f.routes[service]
+	f.mu.Unlock()
+
+	if !ok {
+		_, err := f.discover(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		f.mu.Lock()
+		i, ok = f.routes[service]
+		f.mu.Unlock()
+		if !ok {
+			return nil, fmt.Errorf("no archive holds the service %s", service)
+		}
+	}
+
+	return f.archives[i].store, nil
+}
+
+func (f *federatedStore) Services(ctx context.Context) ([]string, error) {
+	return f.discover(ctx)
+}
+
+func (f *federatedStore) Keywords(ctx context.Context, service string) ([]string, error) {
+	store, err := f.route(ctx, service)
+	if err != nil {
+		return nil, err
+	}
+	return store.Keywords(ctx, service)
+}
+
+func (f *federatedStore) Samples(ctx context.Context, service string, keyword string, from time.Time, to time.Time) ([]time.Time, []string, error) {
+	store, err := f.route(ctx, service)
+	if err != nil {
+		return nil, nil, err
+	}
+	return store.Samples(ctx, service, keyword, from, to)
+}
+
+func (f *federatedStore) Latest(ctx context.Context, service string, keyword string, before time.Time) (time.Time, string, bool, error) {
+	store, err := f.route(ctx, service)
+	if err != nil {
+		return time.Time{}, "", false, err
+	}
+	return store.Latest(ctx, service, keyword, before)
+}
+
+func (f *federatedStore) Metadata(ctx context.Context, service string) ([]KeywordMetadata, error) {
+	store, err := f.route(ctx, service)
+	if err != nil {
+		return nil, err
+	}
+	return store.Metadata(ctx, service)
+}
+
+// Ping checks every archive, naming those that cannot be reached
+func (f *federatedStore) Ping(ctx context.Context) error {
+	var failures []error
+	for _, a := range f.archives {
+		err := a.store.Ping(ctx)
+		if err != nil {
+			failures = append(failures, fmt.Errorf("archive %s: %w", a.name, err))
+		}
+	}
+	return errors.Join(failures...)
+}
+
+func (f *federatedStore) Close() error {
+	var failures []error
+	for _, a := range f.archives {
+		err := a.store.Close()
+		if err != nil {
+			failures = append(failures, fmt.Errorf("archive %s: %w", a.name, err))
+		}
+	}
+	return errors.Join(failures...)
+}
+
+// poolStats adds up the connection pools of the archives that have one
+func (f *federatedStore) poolStats() sql.DBStats {
+	var total sql.DBStats
+	for _, a := range f.archives {
+		if pool, ok := a.store.(poolReporter); ok {
+			stats := pool.poolStats()
+			total.MaxOpenConnections += stats.MaxOpenConnections
+			total.OpenConnections += stats.OpenConnections
+			total.InUse += stats.InUse
+			total.Idle += stats.Idle
+			total.WaitCount += stats.WaitCount
+			total.WaitDuration += stats.WaitDuration
+			total.MaxIdleClosed += stats.MaxIdleClosed
+			total.MaxIdleTimeClosed += stats.MaxIdleTimeClosed
+			total.MaxLifetimeClosed += stats.MaxLifetimeClosed
+		}
+	}
+	return total
+}
+
+// version lists each archive's version for the health check
+func (f *federatedStore) version(ctx context.Context) (string, error) {
+	var versions []string
+	for _, a := range f.archives {
+		inspector, ok := a.store.(archiveInspector)
+		if !ok {
+			continue
+		}
+		v, err := inspector.version(ctx)
+		if err != nil {
+			return "", fmt.Errorf("archive %s: %w", a.name, err)
+		}
+		versions = append(versions, a.name+": "+v)
+	}
+	return strings.Join(versions, "; "), nil
+}
+
+// keywordCount adds up the keywords of every archive
+func (f *federatedStore) keywordCount(ctx context.Context) (int, error) {
+	total := 0
+	for _, a := range f.archives {
+		inspector, ok := a.store.(archiveInspector)
+		if !ok {
+			continue
+		}
+		n, err := inspector.keywordCount(ctx)
+		if err != nil {
+			return 0, fmt.Errorf("archive %s: %w", a.name, err)
+		}
+		total += n
+	}
+	return total, nil
+}
+
+// inspectTable reads a service's table in the archive holding it
+func (f *federatedStore) inspectTable(ctx context.Context, service string) (tableInspection, error) {
+	store, err := f.route(ctx, service)
+	if err != nil {
+		return tableInspection{}, err
+	}
+
+	inspector, ok := store.(archiveInspector)
+	if !ok {
+		return tableInspection{}, nil
+	}
+	return inspector.inspectTable(ctx, service)
+}
+
+// archiveNames lists the archives in order, for the health check
+func (f *federatedStore) archiveNames() []string {
+	names := make([]string, len(f.archives))
+	for i, a := range f.archives {
+		names[i] = a.name
+	}
+	return names
+}
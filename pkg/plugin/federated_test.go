@@ -0,0 +1,207 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+func TestFederatedQuery(t *testing.T) {
+	keck1 := newTestSQLite(t,
+		`create table ktlmeta (service text, keyword text, units text, description text)`,
+		`insert into ktlmeta values ('dcs', 'AZ', 'deg', 'Telescope azimuth')`,
+		`create table dcs (time real, keyword text, binvalue text)`,
+		`insert into dcs values (1700000000, 'AZ', '10'), (1700000001, 'AZ', '12')`,
+	)
+
+	// The summit archive also lists dcs, the first archive holding a service is the one read
+	summit := newTestSQLite(t,
+		`create table ktlmeta (service text, keyword text, units text, description text)`,
+		`insert into ktlmeta values ('met', 'TEMP', 'degC', 'Outside temperature'), ('dcs', 'AZ', 'deg', null)`,
+		`create table met (time real, keyword text, binvalue text)`,
+		`insert into met values (1700000000, 'TEMP', '2.5'), (1700000001, 'TEMP', '2.0')`,
+		`create table dcs (time real, keyword text, binvalue text)`,
+		`insert into dcs values (1700000000, 'AZ', '-1')`,
+	)
+
+	settings, _ := json.Marshal(map[string]interface{}{
+		"archives": []map[string]string{
+			{"name": "keck1", "backend": BACKEND_SQLITE, "path": keck1},
+			{"name": "summit", "backend": BACKEND_SQLITE, "path": summit},
+		},
+	})
+	instance, err := NewDatasource(context.Background(), backend.DataSourceInstanceSettings{JSONData: settings})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds := instance.(*KeywordDatasource)
+	defer ds.Dispose()
+	if ds.settingsErr != nil {
+		t.Fatal(ds.settingsErr)
+	}
+
+	health, err := ds.CheckHealth(context.Background(), &backend.CheckHealthRequest{})
+	if err != nil || health.Status != backend.HealthStatusOk || !strings.Contains(health.Message, "2 archives (keck1, summit)") {
+		t.Fatalf("expected a healthy datasource: %v %v", health, err)
+	}
+
+	_, _, body := callAPI(t, ds, http.MethodGet, "/api/v1/services")
+	if services, _ := apiList(t, body); len(services) != 2 {
+		t.Fatalf("unexpected services: %v", body)
+	}
+
+	// One query mixes keywords from both archives
+	start := time.Unix(1700000000, 0)
+	res, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+		Queries: []backend.DataQuery{{
+			RefID:     "A",
+			JSON:      json.RawMessage(`{"queryText": "dcs.AZ, met.TEMP"}`),
+			TimeRange: backend.TimeRange{From: start, To: start.Add(time.Minute)},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	frames := res.Responses["A"].Frames
+	if res.Responses["A"].Error != nil || len(frames) != 2 {
+		t.Fatalf("unexpected response: %v", res.Responses["A"])
+	}
+	if az := floatValues(t, frames[0].Fields[0]); len(az) != 2 || az[0] != 10 {
+		t.Fatalf("expected dcs from the first archive, got %v", az)
+	}
+	if temp := floatValues(t, frames[1].Fields[0]); len(temp) != 2 || temp[1] != 2.0 {
+		t.Fatalf("unexpected met.TEMP: %v", temp)
+	}
+
+	res, _ = ds.QueryData(context.Background(), &backend.QueryDataRequest{
+		Queries: []backend.DataQuery{{
+			RefID:     "A",
+			JSON:      json.RawMessage(`{"queryText": "acs.NOPE"}`),
+			TimeRange: backend.TimeRange{From: start, To: start.Add(time.Minute)},
+		}},
+	})
+	if res.Responses["A"].Error == nil {
+		t.Fatal("expected a service no archive holds to fail")
+	}
+}
+
+// flakyStore is an archive that can be made unreachable
+type flakyStore struct {
+	*MemoryStore
+	down bool
+}
+
+func (s *flakyStore) Services(ctx context.Context) ([]string, error) {
+	if s.down {
+		return nil, fmt.Errorf("connection refused")
+	}
+	return s.MemoryStore.Services(ctx)
+}
+
+func (s *flakyStore) Metadata(ctx context.Context, service string) ([]KeywordMetadata, error) {
+	if s.down {
+		return nil, fmt.Errorf("connection refused")
+	}
+	return s.MemoryStore.Metadata(ctx, service)
+}
+
+func TestFederatedDiscovery(t *testing.T) {
+	ctx := context.Background()
+
+	keck1 := &flakyStore{MemoryStore: NewMemoryStore()}
+	keck1.AddKeyword(KeywordMetadata{Service: "dcs", Keyword: "AZ"})
+	keck2 := &flakyStore{MemoryStore: NewMemoryStore()}
+	keck2.AddKeyword(KeywordMetadata{Service: "dcs2", Keyword: "AZ"})
+
+	store := federate([]federatedArchive{{"keck1", keck1}, {"keck2", keck2}})
+
+	services, err := store.Services(ctx)
+	if err != nil || strings.Join(services, ",") != "dcs,dcs2" {
+		t.Fatalf("unexpected services %v: %v", services, err)
+	}
+
+	// A service added to an archive is found the first time it is asked for
+	keck2.AddKeyword(KeywordMetadata{Service: "ao", Keyword: "DTTAZ"})
+	keywords, err := store.Keywords(ctx, "ao")
+	if err != nil || strings.Join(keywords, ",") != "DTTAZ" {
+		t.Fatalf("unexpected keywords %v: %v", keywords, err)
+	}
+
+	// An archive that is down keeps its services, all of them down is an error
+	keck2.down = true
+	services, err = store.Services(ctx)
+	if err != nil || strings.Join(services, ",") != "ao,dcs,dcs2" {
+		t.Fatalf("unexpected services with an archive down %v: %v", services, err)
+	}
+	keck1.down = true
+	_, err = store.Services(ctx)
+	if err == nil || !strings.Contains(err.Error(), "archive keck1") || !strings.Contains(err.Error(), "archive keck2") {
+		t.Fatalf("expected both archives to be named in the error, got %v", err)
+	}
+
+	// Archives need distinct names, and cannot hold another federation
+	for _, archives := range []string{
+		`[{"name": "a", "backend": "files", "path": "/tmp"}, {"name": "a", "backend": "files", "path": "/tmp"}]`,
+		`[{"name": "a", "backend": "federated"}]`,
+	} {
+		settings, err := parseSettings([]byte(`{"archives": ` + archives + `}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = newFederatedStore(settings)
+		if err == nil {
+			t.Fatalf("expected %s to be refused", archives)
+		}
+	}
+}
+
+func TestFederatedCatalog(t *testing.T) {
+	ctx := context.Background()
+
+	keck1 := &flakyStore{MemoryStore: NewMemoryStore()}
+	keck1.AddKeyword(KeywordMetadata{Service: "dcs", Keyword: "AZ"})
+	keck2 := &flakyStore{MemoryStore: NewMemoryStore()}
+	keck2.AddKeyword(KeywordMetadata{Service: "dcs2", Keyword: "AZ", Description: "Keck II azimuth"})
+
+	catalog := newKeywordCatalog(federate([]federatedArchive{{"keck1", keck1}, {"keck2", keck2}}),
+		&DatasourceSettings{Backend: BACKEND_FEDERATED}, 0)
+	if status := catalog.status(); status.Keywords != 0 {
+		t.Fatalf("expected an unread catalog, got %+v", status)
+	}
+	if err := catalog.validate(ctx, []string{"dcs.AZ", "dcs2.AZ"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// With keck2 down its services keep their keywords while keck1's are read again
+	keck1.AddKeyword(KeywordMetadata{Service: "dcs", Keyword: "EL"})
+	keck2.down = true
+	if err := catalog.refresh(ctx); err != nil {
+		t.Fatalf("expected one archive down not to fail the refresh, got %v", err)
+	}
+	keywords, err := catalog.Keywords(ctx, "dcs")
+	if err != nil || strings.Join(keywords, ",") != "AZ,EL" {
+		t.Fatalf("expected keck1 to be read again, got %v: %v", keywords, err)
+	}
+	metadata, err := catalog.Metadata(ctx, "dcs2")
+	if err != nil || len(metadata) != 1 || metadata[0].Description != "Keck II azimuth" {
+		t.Fatalf("expected keck2's keywords to be kept, got %v: %v", metadata, err)
+	}
+	if changes := catalog.status().LastChanges; len(changes.Removed) != 0 || strings.Join(changes.Added, ",") != "dcs.EL" {
+		t.Fatalf("unexpected changes: %+v", changes)
+	}
+
+	// Every service failing fails the refresh, the previous catalog stays
+	keck1.down = true
+	if err = catalog.refresh(ctx); err == nil {
+		t.Fatal("expected every archive down to fail the refresh")
+	}
+	if status := catalog.status(); status.Keywords != 3 {
+		t.Fatalf("expected the previous catalog to stay, got %+v", status)
+	}
+}
@@ -0,0 +1,513 @@
+package plugin
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apache/arrow-go/v18/arrow/memory"
+	"github.com/apache/arrow-go/v18/parquet/file"
+	"github.com/apache/arrow-go/v18/parquet/pqarrow"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+)
+
+// fileStore serves an archive extract, a directory holding a file per service as written by the KTL
+// archive export tools.  Files may be CSV, TSV or Parquet and use the same column names as the archive
+// tables, the schema's table template (without any schema qualifier) names the file.  A file named after
+// the metadata table describes the keywords, without one the keywords are found in the service files.
+//
+// Service files are read the first time they are needed and then held in memory.
+type fileStore struct {
+	dir    string
+	schema ArchiveSchema
+
+	// Service to file, and the metadata read from the metadata file (nil if there isn't one)
+	files    map[string]string
+	metadata map[string][]KeywordMetadata
+
+	// The services read so far, each with its own lock so a large file doesn't hold up the others
+	mu     sync.Mutex
+	loaded map[string]*serviceFile
+	memory *MemoryStore
+}
+
+// serviceFile is the outcome of reading a service's file, held so the file is only read once
+type serviceFile struct {
+	mu   sync.Mutex
+	read bool
+	err  error
+}
+
+// The file extensions an extract may use
+var archiveFileExtensions = map[string]bool{
+	".csv":     true,
+	".tsv":     true,
+	".parquet": true,
+}
+
+// Text layouts accepted for times in files, in addition to numbers in the schema's time format
+var archiveTimeLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02 15:04:05.999999999Z07:00",
+	"2006-01-02 15:04:05.999999999Z0700",
+	"2006-01-02 15:04:05.999999999-07",
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04:05.999999999",
+}
+
+func newFileStore(settings *DatasourceSettings) (*fileStore, error) {
+	if settings.Path == "" {
+		return nil, fmt.Errorf("the files archive needs a directory path")
+	}
+
+	entries, err := os.ReadDir(settings.Path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read the archive directory: %w", err)
+	}
+
+	s := &fileStore{
+		dir:    settings.Path,
+		schema: settings.Schema,
+		files:  map[string]string{},
+		loaded: map[string]*serviceFile{},
+		memory: NewMemoryStore(),
+	}
+
+	// The file name around the service, from the table template without a schema qualifier
+	template := settings.Schema.TableTemplate
+	template = template[strings.LastIndex(template, ".")+1:]
+	prefix, suffix, _ := strings.Cut(template, "{service}")
+
+	metaTable := settings.MetaTable[strings.LastIndex(settings.MetaTable, ".")+1:]
+	metaFile := ""
+
+	for _, entry := range entries {
+		ext := strings.ToLower(filepath.Ext(entry.Name()))
+		if entry.IsDir() || !archiveFileExtensions[ext] {
+			continue
+		}
+
+		path := filepath.Join(s.dir, entry.Name())
+		base := strings.TrimSuffix(entry.Name(), filepath.Ext(entry.Name()))
+
+		if base == metaTable {
+			metaFile = path
+			continue
+		}
+
+		if !strings.HasPrefix(base, prefix) || !strings.HasSuffix(base, suffix) || len(base) <= len(prefix)+len(suffix) {
+			log.DefaultLogger.Debug(fl()+"ignoring archive file", "file", entry.Name())
+			continue
+		}
+
+		service := base[len(prefix) : len(base)-len(suffix)]
+		if other, ok := s.files[service]; ok {
+			return nil, fmt.Errorf("service %s is in both %s and %s", service, filepath.Base(other), entry.Name())
+		}
+		s.files[service] = path
+	}
+
+	if metaFile != "" {
+		s.metadata, err = s.readMetadata(metaFile)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", filepath.Base(metaFile), err)
+		}
+	}
+
+	return s, nil
+}
+
+// readMetadata reads the metadata file, the units and description columns are optional
+func (s *fileStore) readMetadata(path string) (map[string][]KeywordMetadata, error) {
+	table, err := readArchiveFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	services, err := table.column(s.schema.MetaServiceColumn)
+	if err != nil {
+		return nil, err
+	}
+	keywords, err := table.column(s.schema.MetaKeywordColumn)
+	if err != nil {
+		return nil, err
+	}
+	units, _ := table.column(s.schema.MetaUnitsColumn)
+	descriptions, _ := table.column(s.schema.MetaDescriptionColumn)
+
+	metadata := map[string][]KeywordMetadata{}
+	for i := 0; i < table.rows; i++ {
+		meta := KeywordMetadata{Service: services[i], Keyword: keywords[i]}
+		if units != nil {
+			meta.Units = units[i]
+		}
+		if descriptions != nil {
+			meta.Description = descriptions[i]
+		}
+		metadata[meta.Service] = append(metadata[meta.Service], meta)
+	}
+
+	for _, list := range metadata {
+		sort.Slice(list, func(i, j int) bool { return list[i].Keyword < list[j].Keyword })
+	}
+
+	return metadata, nil
+}
+
+// load reads a service's file into memory the first time it is needed
+func (s *fileStore) load(service string) error {
+	// The store lock only covers finding the service's entry, the file is read under the entry's own
+	// lock so other services can be served meanwhile
+	s.mu.Lock()
+	loaded, ok := s.loaded[service]
+	if !ok {
+		loaded = &serviceFile{}
+		s.loaded[service] = loaded
+	}
+	s.mu.Unlock()
+
+	loaded.mu.Lock()
+	defer loaded.mu.Unlock()
+
+	// Each file is read once, the loaded services act as a cache of the files
+	cacheResult("files", loaded.read)
+	if loaded.read {
+		return loaded.err
+	}
+	loaded.read = true
+
+	path, ok := s.files[service]
+	if !ok {
+		// Nothing archived for the service, which is not an error since the metadata may still list it
+		return nil
+	}
+
+	err := s.readService(service, path)
+	if err != nil {
+		err = fmt.Errorf("%s: %w", filepath.Base(path), err)
+		log.DefaultLogger.Error(fl()+"archive file error", "service", service, "error", err)
+	}
+	loaded.err = err
+
+	return err
+}
+
+// readService reads the samples in a service's file into the memory store
+func (s *fileStore) readService(service string, path string) error {
+	table, err := readArchiveFile(path)
+	if err != nil {
+		return err
+	}
+
+	timeColumn, err := table.column(s.schema.TimeColumn)
+	if err != nil {
+		return err
+	}
+	keywordColumn, err := table.column(s.schema.KeywordColumn)
+	if err != nil {
+		return err
+	}
+
+	valueColumns := make([][]string, len(s.schema.ValueColumns))
+	for i, name := range s.schema.ValueColumns {
+		valueColumns[i], err = table.column(name)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Gather each keyword's samples before adding them, the memory store sorts them once per keyword
+	type series struct {
+		times  []time.Time
+		values []string
+	}
+	keywords := map[string]*series{}
+
+	for row := 0; row < table.rows; row++ {
+		// The first non-empty value column, as the archive query coalesces them
+		value := ""
+		for _, column := range valueColumns {
+			if column[row] != "" {
+				value = strings.TrimSpace(column[row])
+				break
+			}
+		}
+		if value == "" {
+			continue
+		}
+
+		t, err := s.parseTime(timeColumn[row])
+		if err != nil {
+			return fmt.Errorf("row %d: %w", row+1, err)
+		}
+
+		k, ok := keywords[keywordColumn[row]]
+		if !ok {
+			k = &series{}
+			keywords[keywordColumn[row]] = k
+		}
+		k.times = append(k.times, t)
+		k.values = append(k.values, value)
+	}
+
+	for keyword, k := range keywords {
+		err = s.memory.AddSamples(service+"."+keyword, k.times, k.values)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// parseTime reads a time as a number in the schema's time format, or as text
+func (s *fileStore) parseTime(text string) (time.Time, error) {
+	text = strings.TrimSpace(text)
+
+	if s.schema.TimeFormat != TIME_FORMAT_TIMESTAMPTZ {
+		v, err := strconv.ParseFloat(text, 64)
+		if err == nil {
+			return s.schema.timeFromNumber(v), nil
+		}
+	}
+
+	for _, layout := range archiveTimeLayouts {
+		t, err := time.Parse(layout, text)
+		if err == nil {
+			return t, nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("cannot read time %q", text)
+}
+
+func (s *fileStore) Services(ctx context.Context) ([]string, error) {
+	services := []string{}
+
+	if s.metadata != nil {
+		for service := range s.metadata {
+			services = append(services, service)
+		}
+	} else {
+		for service := range s.files {
+			services = append(services, service)
+		}
+	}
+	sort.Strings(services)
+
+	return services, nil
+}
+
+func (s *fileStore) Keywords(ctx context.Context, service string) ([]string, error) {
+	if s.metadata != nil {
+		keywords := []string{}
+		for _, meta := range s.metadata[service] {
+			keywords = append(keywords, meta.Keyword)
+		}
+		return keywords, nil
+	}
+
+	err := s.load(service)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.memory.Keywords(ctx, service)
+}
+
+func (s *fileStore) Samples(ctx context.Context, service string, keyword string, from time.Time, to time.Time) ([]time.Time, []string, error) {
+	err := s.load(service)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return s.memory.Samples(ctx, service, keyword, from, to)
+}
+
+func (s *fileStore) Latest(ctx context.Context, service string, keyword string, before time.Time) (time.Time, string, bool, error) {
+	err := s.load(service)
+	if err != nil {
+		return time.Time{}, "", false, err
+	}
+
+	return s.memory.Latest(ctx, service, keyword, before)
+}
+
+func (s *fileStore) Metadata(ctx context.Context, service string) ([]KeywordMetadata, error) {
+	if s.metadata != nil {
+		return append([]KeywordMetadata{}, s.metadata[service]...), nil
+	}
+
+	err := s.load(service)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.memory.Metadata(ctx, service)
+}
+
+func (s *fileStore) version(ctx context.Context) (string, error) {
+	return fmt.Sprintf("archive files, %d service files", len(s.files)), nil
+}
+
+func (s *fileStore) keywordCount(ctx context.Context) (int, error) {
+	if s.metadata != nil {
+		count := 0
+		for _, list := range s.metadata {
+			count += len(list)
+		}
+		return count, nil
+	}
+
+	// Without a metadata file every service file has to be read to know its keywords
+	for service := range s.files {
+		err := s.load(service)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return s.memory.keywordCount(ctx)
+}
+
+// inspectTable reads a service's file, reporting a file that cannot be read
+func (s *fileStore) inspectTable(ctx context.Context, service string) (tableInspection, error) {
+	err := s.load(service)
+	if err != nil {
+		return tableInspection{}, err
+	}
+
+	return s.memory.inspectTable(ctx, service)
+}
+
+func (s *fileStore) Ping(ctx context.Context) error {
+	_, err := os.Stat(s.dir)
+	return err
+}
+
+func (s *fileStore) Close() error {
+	return nil
+}
+
+// archiveFile is a file read column by column as text, empty text stands for null
+type archiveFile struct {
+	names   []string
+	columns [][]string
+	rows    int
+}
+
+// column returns the named column, matching the name without regard to case as Postgres does
+func (f *archiveFile) column(name string) ([]string, error) {
+	for i, n := range f.names {
+		if strings.EqualFold(n, name) {
+			return f.columns[i], nil
+		}
+	}
+
+	return nil, fmt.Errorf("no %s column", name)
+}
+
+// readArchiveFile reads a CSV, TSV or Parquet file
+func readArchiveFile(path string) (*archiveFile, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".parquet":
+		return readParquetFile(path)
+	case ".tsv":
+		return readDelimitedFile(path, '\t')
+	default:
+		return readDelimitedFile(path, ',')
+	}
+}
+
+// readDelimitedFile reads a CSV or TSV file, the first line names the columns
+func readDelimitedFile(path string, delimiter rune) (*archiveFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	r.Comma = delimiter
+	r.ReuseRecord = true
+
+	header, err := r.Read()
+	if err != nil {
+		return nil, fmt.Errorf("cannot read the header: %w", err)
+	}
+
+	table := &archiveFile{
+		names:   append([]string(nil), header...),
+		columns: make([][]string, len(header)),
+	}
+
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		for i := range table.columns {
+			table.columns[i] = append(table.columns[i], record[i])
+		}
+		table.rows++
+	}
+
+	return table, nil
+}
+
+// readParquetFile reads a Parquet file through Arrow, each value is converted to its text form
+func readParquetFile(path string) (*archiveFile, error) {
+	reader, err := file.OpenParquetFile(path, false)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	arrowReader, err := pqarrow.NewFileReader(reader, pqarrow.ArrowReadProperties{}, memory.DefaultAllocator)
+	if err != nil {
+		return nil, err
+	}
+
+	tbl, err := arrowReader.ReadTable(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	defer tbl.Release()
+
+	table := &archiveFile{
+		names:   make([]string, tbl.NumCols()),
+		columns: make([][]string, tbl.NumCols()),
+		rows:    int(tbl.NumRows()),
+	}
+
+	for i := range table.columns {
+		column := tbl.Column(i)
+		table.names[i] = column.Name()
+
+		text := make([]string, 0, table.rows)
+		for _, chunk := range column.Data().Chunks() {
+			for j := 0; j < chunk.Len(); j++ {
+				if chunk.IsNull(j) {
+					text = append(text, "")
+				} else {
+					text = append(text, chunk.ValueStr(j))
+				}
+			}
+		}
+		table.columns[i] = text
+	}
+
+	return table, nil
+}
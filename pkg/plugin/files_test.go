@@ -0,0 +1,193 @@
+package plugin
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/apache/arrow-go/v18/arrow"
+	"github.com/apache/arrow-go/v18/arrow/array"
+	"github.com/apache/arrow-go/v18/arrow/memory"
+	"github.com/apache/arrow-go/v18/parquet/pqarrow"
+)
+
+// writeTestFile writes a file into the extract directory
+func writeTestFile(t *testing.T, dir string, name string, content string) {
+	t.Helper()
+
+	err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// writeTestParquet writes a service file with float seconds times and text values
+func writeTestParquet(t *testing.T, path string, times []float64, keywords []string, values []string) {
+	t.Helper()
+
+	schema := arrow.NewSchema([]arrow.Field{
+		{Name: "time", Type: arrow.PrimitiveTypes.Float64},
+		{Name: "keyword", Type: arrow.BinaryTypes.String},
+		{Name: "binvalue", Type: arrow.BinaryTypes.String, Nullable: true},
+	}, nil)
+
+	builder := array.NewRecordBuilder(memory.DefaultAllocator, schema)
+	defer builder.Release()
+	builder.Field(0).(*array.Float64Builder).AppendValues(times, nil)
+	builder.Field(1).(*array.StringBuilder).AppendValues(keywords, nil)
+	builder.Field(2).(*array.StringBuilder).AppendValues(values, nil)
+
+	record := builder.NewRecord()
+	defer record.Release()
+
+	table := array.NewTableFromRecords(schema, []arrow.Record{record})
+	defer table.Release()
+
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	err = pqarrow.WriteTable(table, f, 1024, nil, pqarrow.DefaultWriterProps())
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileStore(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+	epoch := time.Unix(1700000000, 0).UTC()
+
+	writeTestFile(t, dir, "dcs.csv", "time,keyword,binvalue\n1700000001,AZ,10\n1700000000,AZ,5\n1700000002,EL,45\n")
+	writeTestFile(t, dir, "acs.tsv", "time\tkeyword\tbinvalue\n2023-11-14T22:13:20Z\tTEMP\t20.5\n")
+	writeTestFile(t, dir, "notes.txt", "not part of the archive")
+	writeTestParquet(t, filepath.Join(dir, "met.parquet"), []float64{1700000000, 1700000001}, []string{"WIND", "WIND"}, []string{"3", "4"})
+
+	config, err := parseSettings([]byte(`{"backend": "files", "path": "` + dir + `"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := newArchiveStore(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Without a metadata file the services come from the file names and the keywords from their contents
+	services, err := store.Services(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(services) != 3 || services[0] != "acs" || services[1] != "dcs" || services[2] != "met" {
+		t.Fatalf("unexpected services: %v", services)
+	}
+
+	keywords, err := store.Keywords(ctx, "dcs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keywords) != 2 || keywords[0] != "AZ" || keywords[1] != "EL" {
+		t.Fatalf("unexpected keywords: %v", keywords)
+	}
+
+	// Samples come back in time order
+	times, values, err := store.Samples(ctx, "dcs", "AZ", epoch, epoch.Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 2 || values[0] != "5" || values[1] != "10" || !times[0].Equal(epoch) {
+		t.Fatalf("unexpected samples: %v %v", times, values)
+	}
+
+	times, values, err = store.Samples(ctx, "acs", "TEMP", epoch, epoch.Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 1 || values[0] != "20.5" || !times[0].Equal(epoch) {
+		t.Fatalf("unexpected TSV samples: %v %v", times, values)
+	}
+
+	times, values, err = store.Samples(ctx, "met", "WIND", epoch, epoch.Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 2 || values[1] != "4" || !times[1].Equal(epoch.Add(time.Second)) {
+		t.Fatalf("unexpected Parquet samples: %v %v", times, values)
+	}
+
+	// A metadata file takes over the service and keyword lists
+	writeTestFile(t, dir, "ktlmeta.csv", "service,keyword,units,description\ndcs,AZ,deg,Azimuth\nnew,KEY,,\n")
+	store, err = newArchiveStore(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	services, _ = store.Services(ctx)
+	if len(services) != 2 || services[0] != "dcs" || services[1] != "new" {
+		t.Fatalf("unexpected services from the metadata: %v", services)
+	}
+
+	meta, err := keywordMetadata(ctx, store, "dcs", "AZ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Units != "deg" || meta.Description != "Azimuth" {
+		t.Fatalf("unexpected metadata: %+v", meta)
+	}
+}
+
+func TestFileStoreLoadLocking(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+	epoch := time.Unix(1700000000, 0).UTC()
+
+	writeTestFile(t, dir, "dcs.csv", "time,keyword,binvalue\n1700000000,AZ,5\n")
+	writeTestFile(t, dir, "acs.csv", "time,keyword,binvalue\n1700000000,TEMP,20\n")
+	writeTestFile(t, dir, "bad.csv", "time,keyword,binvalue\nsoon,TEMP,20\n")
+
+	config, err := parseSettings([]byte(`{"backend": "files", "path": "` + dir + `"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := newFileStore(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// While one service's file is being read, as if it were a large one, the others can still be read
+	slow := &serviceFile{}
+	store.loaded["acs"] = slow
+	slow.mu.Lock()
+
+	done := make(chan error)
+	go func() {
+		_, _, err := store.Samples(ctx, "dcs", "AZ", epoch, epoch.Add(time.Minute))
+		done <- err
+	}()
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("reading dcs waited for acs")
+	}
+	slow.mu.Unlock()
+
+	// Callers of the same service all see its one read, including a failure
+	errs := make(chan error, 4)
+	for i := 0; i < cap(errs); i++ {
+		go func() {
+			_, _, err := store.Samples(ctx, "bad", "TEMP", epoch, epoch.Add(time.Minute))
+			errs <- err
+		}()
+	}
+	for i := 0; i < cap(errs); i++ {
+		if err := <-errs; err == nil {
+			t.Fatal("expected the unreadable time to be reported to every caller")
+		}
+	}
+}
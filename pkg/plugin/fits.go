@@ -0,0 +1,327 @@
+package plugin
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FITS files are written in blocks of this many bytes, headers are 36 cards of 80 characters
+const (
+	FITS_BLOCK = 2880
+	FITS_CARD  = 80
+)
+
+// The Unix epoch as a Modified Julian Date, the TIME column counts seconds from it
+const FITS_MJD_UNIX_EPOCH = 40587.0
+
+// FITS unit strings for the units of the conversion registry, anything not listed is written as is
+var fitsUnits = map[string]string{
+	"hours": "h",
+	"k":     "K",
+	"c":     "Celsius",
+	"f":     "Fahrenheit",
+	"pa":    "Pa",
+	"hpa":   "hPa",
+	"kpa":   "kPa",
+	"torr":  "Torr",
+	"inhg":  "inHg",
+	"hr":    "h",
+	"day":   "d",
+}
+
+// Transforms that leave the units of a series alone
+var unitPreservingTransforms = map[string]bool{
+	"delta":          true,
+	"moving_average": true,
+	"rolling_std":    true,
+	"rolling_median": true,
+	"rolling_min":    true,
+	"rolling_max":    true,
+	"ema":            true,
+	"savgol":         true,
+	"cumsum":         true,
+}
+
+// seriesUnits follows a keyword's archived units through the transform steps, giving "" where the
+// result's units cannot be known
+func seriesUnits(units string, steps []TransformStep) string {
+	for _, step := range steps {
+		switch {
+		case step.Name == "convert":
+			var p convertParams
+			if decodeParams(step.Params, &p) != nil {
+				return ""
+			}
+			_, to, ok := strings.Cut(p.Conversion, "_to_")
+			if !ok {
+				return ""
+			}
+			units = to
+			if fits, ok := fitsUnits[to]; ok {
+				units = fits
+			}
+
+		case step.Name == "derivative" && units != "":
+			units += "/s"
+
+		case unitPreservingTransforms[step.Name]:
+
+		default:
+			return ""
+		}
+	}
+
+	return units
+}
+
+// fitsHeader builds the cards of a header unit
+type fitsHeader struct {
+	cards []string
+}
+
+// fitsText reduces text to the printable ASCII a header allows
+func fitsText(text string) string {
+	var b strings.Builder
+	for _, r := range text {
+		switch {
+		case r == 'µ':
+			b.WriteRune('u')
+		case r >= 0x20 && r < 0x7f:
+			b.WriteRune(r)
+		default:
+			b.WriteRune('?')
+		}
+	}
+	return b.String()
+}
+
+// add writes a keyword card, strings are quoted and numbers and logicals right-justified as the
+// standard's fixed format asks
+func (h *fitsHeader) add(keyword string, value interface{}, comment string) {
+	var v string
+	switch value := value.(type) {
+	case string:
+		// Quotes are doubled and the string padded to at least eight characters.  A string too long for the
+		// card is cut as it is escaped, so the cut never falls between the two halves of a doubled quote.
+		var text strings.Builder
+		for _, r := range fitsText(value) {
+			escaped := string(r)
+			if r == '\'' {
+				escaped = "''"
+			}
+			if text.Len()+len(escaped) > 68 {
+				break
+			}
+			text.WriteString(escaped)
+		}
+		v = fmt.Sprintf("'%-8s'", text.String())
+	case bool:
+		v = fmt.Sprintf("%20s", map[bool]string{true: "T", false: "F"}[value])
+	case int:
+		v = fmt.Sprintf("%20d", value)
+	case float64:
+		// A real needs a decimal point or exponent, otherwise readers take it for an integer
+		text := strconv.FormatFloat(value, 'G', -1, 64)
+		if !strings.ContainsAny(text, ".E") {
+			text += ".0"
+		}
+		v = fmt.Sprintf("%20s", text)
+	}
+
+	card := fmt.Sprintf("%-8s= %s", keyword, v)
+	if comment != "" {
+		card += " / " + fitsText(comment)
+	}
+	h.cards = append(h.cards, card)
+}
+
+// commentary writes HISTORY or COMMENT cards, wrapping long text over several
+func (h *fitsHeader) commentary(keyword string, text string) {
+	text = fitsText(text)
+	for {
+		line := text
+		if len(line) > FITS_CARD-10 {
+			line = line[:FITS_CARD-10]
+		}
+		h.cards = append(h.cards, fmt.Sprintf("%-8s  %s", keyword, line))
+
+		text = text[len(line):]
+		if text == "" {
+			return
+		}
+	}
+}
+
+// write writes the cards and END, padded with spaces to a whole block
+func (h *fitsHeader) write(w io.Writer) error {
+	var b strings.Builder
+	for _, card := range h.cards {
+		if len(card) > FITS_CARD {
+			card = card[:FITS_CARD]
+		}
+		fmt.Fprintf(&b, "%-80s", card)
+	}
+	fmt.Fprintf(&b, "%-80s", "END")
+
+	if pad := b.Len() % FITS_BLOCK; pad != 0 {
+		b.WriteString(strings.Repeat(" ", FITS_BLOCK-pad))
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// fitsDate formats a time as FITS wants dates, ISO 8601 in UTC without a zone
+func fitsDate(t time.Time) string {
+	return t.UTC().Format("2006-01-02T15:04:05.000")
+}
+
+// exportFITS writes the keywords as a FITS file, an empty primary HDU describing the export followed by
+// a binary table per keyword with TIME (Unix seconds) and VALUE columns.  Each keyword is read whole since
+// the table header gives its row count up front.
+func (ds *KeywordDatasource) exportFITS(ctx context.Context, store ArchiveStore, r *exportRequest, w io.Writer, flush func()) error {
+	steps, err := r.qm.transformSteps()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	primary := &fitsHeader{}
+	primary.add("SIMPLE", true, "conforms to FITS standard")
+	primary.add("BITPIX", 8, "")
+	primary.add("NAXIS", 0, "no primary data")
+	primary.add("EXTEND", true, "binary table extensions follow")
+	primary.add("ORIGIN", "W. M. Keck Observatory", "")
+	primary.add("DATE", fitsDate(now), "file creation date (UTC)")
+	primary.add("CREATOR", "keyword-grafana-datasource", "")
+	primary.add("ARCHIVE", ds.settings.source(), "keyword archive the data was read from")
+	primary.add("TIMESYS", "UTC", "")
+	primary.add("DATE-BEG", fitsDate(r.timeRange.From), "start of the exported range")
+	primary.add("DATE-END", fitsDate(r.timeRange.To), "end of the exported range")
+	if r.qm.TimeShift != "" {
+		primary.add("TIMESHFT", r.qm.TimeShift, "samples moved from this offset into the range")
+	}
+	primary.add("NKEYWORD", len(r.keys), "number of keyword tables")
+	for _, step := range steps {
+		params := ""
+		if len(step.Params) > 0 {
+			params = " " + string(step.Params)
+		}
+		primary.commentary("HISTORY", "transform "+step.Name+params)
+	}
+
+	err = primary.write(w)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range r.keys {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		times, values, err := ds.fetchSeries(ctx, store, r.qm, key, r.timeRange)
+		if err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+		times, values, err = r.pipeline.run(ctx, times, values)
+		if err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+
+		service, keyword, _ := splitKeyword(key)
+
+		// Units come from the metadata table, or the calibration if one was applied, through the transforms
+		meta, err := keywordMetadata(ctx, store, service, keyword)
+		if err != nil {
+			logger(ctx).Debug(fl()+"no metadata for the FITS export", "key", key, "error", err)
+		}
+		units := meta.Units
+		calibrated := false
+		if calibratedUnits, ok := ds.calibrations.units(key, r.qm.Calibrate); ok {
+			units, calibrated = calibratedUnits, true
+		}
+		units = seriesUnits(units, steps)
+
+		err = writeFITSTable(w, key, service, keyword, meta.Description, units, calibrated, times, values, steps)
+		if err != nil {
+			return err
+		}
+		flush()
+	}
+
+	return nil
+}
+
+// writeFITSTable writes one keyword's binary table extension
+func writeFITSTable(w io.Writer, key, service, keyword, description, units string, calibrated bool, times []time.Time, values []float64, steps []TransformStep) error {
+	h := &fitsHeader{}
+	h.add("XTENSION", "BINTABLE", "binary table extension")
+	h.add("BITPIX", 8, "")
+	h.add("NAXIS", 2, "")
+	h.add("NAXIS1", 16, "bytes per row")
+	h.add("NAXIS2", len(values), "number of samples")
+	h.add("PCOUNT", 0, "")
+	h.add("GCOUNT", 1, "")
+	h.add("TFIELDS", 2, "")
+	h.add("TTYPE1", "TIME", "sample time")
+	h.add("TFORM1", "1D", "")
+	h.add("TUNIT1", "s", "seconds since MJDREF")
+	h.add("TTYPE2", "VALUE", "")
+	h.add("TFORM2", "1D", "")
+	if units != "" {
+		h.add("TUNIT2", units, "")
+	}
+	h.add("EXTNAME", key, "")
+	h.add("SERVICE", service, "KTL service")
+	h.add("KEYWORD", keyword, "KTL keyword")
+	h.add("TIMESYS", "UTC", "")
+	h.add("MJDREF", FITS_MJD_UNIX_EPOCH, "Unix epoch")
+	h.add("TIMEUNIT", "s", "")
+	if len(times) > 0 {
+		h.add("DATE-BEG", fitsDate(times[0]), "first sample")
+		h.add("DATE-END", fitsDate(times[len(times)-1]), "last sample")
+	}
+	h.add("CALIBRAT", calibrated, "calibration applied")
+	if len(steps) > 0 {
+		names := make([]string, len(steps))
+		for i, step := range steps {
+			names[i] = step.Name
+		}
+		h.add("TRANSFRM", strings.Join(names, ","), "transforms applied in order")
+	}
+	if description != "" {
+		h.commentary("COMMENT", description)
+	}
+
+	err := h.write(w)
+	if err != nil {
+		return err
+	}
+
+	// Rows of big-endian doubles, padded with zeros to a whole block
+	row := make([]byte, 16)
+	size := 0
+	for i := range values {
+		seconds := float64(times[i].UnixNano()) * 1e-9
+		binary.BigEndian.PutUint64(row[:8], math.Float64bits(seconds))
+		binary.BigEndian.PutUint64(row[8:], math.Float64bits(values[i]))
+		n, err := w.Write(row)
+		if err != nil {
+			return err
+		}
+		size += n
+	}
+
+	if pad := size % FITS_BLOCK; pad != 0 {
+		_, err = w.Write(make([]byte, FITS_BLOCK-pad))
+	}
+
+	return err
+}
@@ -0,0 +1,119 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"math"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readFITSHeader reads header cards from the start of data up to END, returning them and the bytes used
+func readFITSHeader(t *testing.T, data []byte) (map[string]string, []string, int) {
+	t.Helper()
+
+	cards := map[string]string{}
+	var commentary []string
+	for offset := 0; offset+FITS_CARD <= len(data); offset += FITS_CARD {
+		card := string(data[offset : offset+FITS_CARD])
+		keyword := strings.TrimSpace(card[:8])
+
+		switch {
+		case keyword == "END":
+			used := offset + FITS_CARD
+			return cards, commentary, used + (FITS_BLOCK-used%FITS_BLOCK)%FITS_BLOCK
+		case card[8:10] == "= ":
+			value, _, _ := strings.Cut(card[10:], " / ")
+			cards[keyword] = strings.Trim(strings.TrimSpace(value), "'")
+			cards[keyword] = strings.TrimSpace(cards[keyword])
+		default:
+			commentary = append(commentary, keyword+" "+strings.TrimSpace(card[10:]))
+		}
+	}
+
+	t.Fatal("no END card")
+	return nil, nil, 0
+}
+
+func TestExportFITS(t *testing.T) {
+	ds := newTestDatasource(t)
+
+	params := url.Values{
+		"keyword":    {"dcs.AZ"},
+		"from":       {testEpoch.Format(time.RFC3339)},
+		"to":         {testEpoch.Add(2 * time.Second).Format(time.RFC3339)},
+		"conversion": {"deg_to_arcsec"},
+		"format":     {EXPORT_FITS},
+	}
+
+	var out bytes.Buffer
+	err := ds.Export(context.Background(), &out, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := out.Bytes()
+
+	if len(data)%FITS_BLOCK != 0 {
+		t.Fatalf("the file is %d bytes, not a whole number of blocks", len(data))
+	}
+
+	primary, history, used := readFITSHeader(t, data)
+	if primary["SIMPLE"] != "T" || primary["DATE-BEG"] != "2024-03-01T00:00:00.000" || primary["ARCHIVE"] == "" {
+		t.Fatalf("unexpected primary header: %v", primary)
+	}
+	if len(history) != 1 || !strings.Contains(history[0], "deg_to_arcsec") {
+		t.Fatalf("expected the conversion in the history: %v", history)
+	}
+
+	data = data[used:]
+	table, comments, used := readFITSHeader(t, data)
+	if table["XTENSION"] != "BINTABLE" || table["EXTNAME"] != "dcs.AZ" || table["NAXIS2"] != "3" {
+		t.Fatalf("unexpected table header: %v", table)
+	}
+	if table["TUNIT2"] != "arcsec" || table["MJDREF"] != "40587.0" {
+		t.Fatalf("unexpected units: %v", table)
+	}
+	if len(comments) != 1 || !strings.Contains(comments[0], "Telescope azimuth") {
+		t.Fatalf("expected the description as a comment: %v", comments)
+	}
+
+	// The rows are big-endian doubles, half a degree is 1800 arcseconds
+	rows := data[used:]
+	for i := 0; i < 3; i++ {
+		seconds := math.Float64frombits(binary.BigEndian.Uint64(rows[i*16:]))
+		value := math.Float64frombits(binary.BigEndian.Uint64(rows[i*16+8:]))
+		if seconds != float64(testEpoch.Unix()+int64(i)) || math.Abs(value-1800) > 1e-9 {
+			t.Fatalf("unexpected row %d: %g %g", i, seconds, value)
+		}
+	}
+}
+
+func TestFITSHeaderString(t *testing.T) {
+	cases := []struct {
+		value    string
+		expected string
+	}{
+		{"deg", "'deg     '"},
+		{"it's", "'it''s   '"},
+		{"µm", "'um      '"},
+		// The doubled quote would run one past the card, so the cut falls before it rather than inside it
+		{strings.Repeat("a", 67) + "'b", "'" + strings.Repeat("a", 67) + "'"},
+		{strings.Repeat("a", 66) + "'b", "'" + strings.Repeat("a", 66) + "'''"},
+		{strings.Repeat("'", 40), "'" + strings.Repeat("''", 34) + "'"},
+	}
+
+	for _, c := range cases {
+		h := &fitsHeader{}
+		h.add("TUNIT1", c.value, "")
+		card := h.cards[0]
+		if value := card[10:]; value != c.expected {
+			t.Fatalf("%q: expected %s, got %s", c.value, c.expected, value)
+		}
+		if len(card) > FITS_CARD {
+			t.Fatalf("%q: card is %d characters", c.value, len(card))
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// The health check reads a few service tables rather than all of them, spread through the service list
+const HEALTH_SAMPLE_TABLES = 3
+
+// The whole health check gives up after this long, a slow archive is reported rather than waited on
+const HEALTH_TIMEOUT = 20 * time.Second
+
+// Status of each component of the health check
+const (
+	HEALTH_OK      = "ok"
+	HEALTH_ERROR   = "error"
+	HEALTH_SKIPPED = "skipped"
+)
+
+// archiveInspector is implemented by stores that can look inside themselves for the health check
+type archiveInspector interface {
+	// version describes the database server, or the kind of store
+	version(ctx context.Context) (string, error)
+
+	// keywordCount counts the keywords across every service
+	keywordCount(ctx context.Context) (int, error)
+
+	// inspectTable reads a service's table
+	inspectTable(ctx context.Context, service string) (tableInspection, error)
+}
+
+// tableInspection is what inspecting a service's table found
+type tableInspection struct {
+	// Time of the newest sample, nil when the table is empty
+	newest *time.Time
+
+	// Whether the time column is indexed, nil when the store has no indexes
+	indexed *bool
+}
+
+// healthDetails is the per-component report returned with the health check, so that a failure can be
+// traced to the layer that is broken
+type healthDetails struct {
+	Backend    string           `json:"backend"`
+	Source     string           `json:"source"`
+	Settings   healthComponent  `json:"settings"`
+	Connection connectionHealth `json:"connection"`
+	Metadata   metadataHealth   `json:"metadata"`
+	Tables     []tableHealth    `json:"tables"`
+
+	// Newest sample in the tables read, and its age when checked
+	NewestSample     *time.Time `json:"newestSample,omitempty"`
+	NewestAgeSeconds *float64   `json:"newestSampleAgeSeconds,omitempty"`
+}
+
+type healthComponent struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type connectionHealth struct {
+	healthComponent
+	LatencyMs float64 `json:"latencyMs,omitempty"`
+	Version   string  `json:"version,omitempty"`
+}
+
+type metadataHealth struct {
+	healthComponent
+	Services int `json:"services"`
+	Keywords int `json:"keywords"`
+}
+
+type tableHealth struct {
+	healthComponent
+	Service          string     `json:"service"`
+	Indexed          *bool      `json:"indexed,omitempty"`
+	NewestSample     *time.Time `json:"newestSample,omitempty"`
+	NewestAgeSeconds *float64   `json:"newestSampleAgeSeconds,omitempty"`
+}
+
+func healthFailed(err error) healthComponent {
+	return healthComponent{Status: HEALTH_ERROR, Error: err.Error()}
+}
+
+// sampleServices picks up to n services spread evenly through the list
+func sampleServices(services []string, n int) []string {
+	if len(services) <= n {
+		return services
+	}
+
+	sample := make([]string, n)
+	for i := range sample {
+		sample[i] = services[i*len(services)/n]
+	}
+	return sample
+}
+
+// diagnose checks each layer in turn, settings, connection, metadata table and service tables, skipping
+// those after the first that fails.  The error returned names the failing component.
+func (ds *KeywordDatasource) diagnose(ctx context.Context) (*healthDetails, error) {
+	ctx, cancel := context.WithTimeout(ctx, HEALTH_TIMEOUT)
+	defer cancel()
+
+	skipped := healthComponent{Status: HEALTH_SKIPPED}
+	details := &healthDetails{
+		Backend:    ds.settings.Backend,
+		Source:     ds.settings.source(),
+		Settings:   healthComponent{Status: HEALTH_OK},
+		Connection: connectionHealth{healthComponent: skipped},
+		Metadata:   metadataHealth{healthComponent: skipped},
+		Tables:     []tableHealth{},
+	}
+	if details.Backend == "" {
+		details.Backend = BACKEND_POSTGRES
+	}
+
+	// Problems found validating the settings when the instance was created, such as a bad calibration
+	if ds.settingsErr != nil {
+		details.Settings = healthFailed(ds.settingsErr)
+		return details, fmt.Errorf("invalid settings: %w", ds.settingsErr)
+	}
+
+	_, err := ds.archive()
+	if err != nil {
+		details.Settings = healthFailed(err)
+		return details, fmt.Errorf("invalid config: %w", err)
+	}
+
+	// Go past the keyword catalog to the archive itself, the point is to see that it answers
+	store := ds.store
+
+	// Now see if we can reach the archive, and how long it takes
+	start := time.Now()
+	err = store.Ping(ctx)
+	if err != nil {
+		details.Connection.healthComponent = healthFailed(err)
+		return details, fmt.Errorf("failure to ping the archive: %w", err)
+	}
+	details.Connection.Status = HEALTH_OK
+	details.Connection.LatencyMs = float64(time.Since(start).Microseconds()) / 1000
+
+	inspector, _ := store.(archiveInspector)
+	if inspector != nil {
+		// Only informative, an old server that cannot say is still usable
+		details.Connection.Version, err = inspector.version(ctx)
+		if err != nil {
+			logger(ctx).Warn(fl()+"cannot read the archive version", "error", err)
+		}
+	}
+
+	// The metadata table lists the services, everything else depends on it
+	services, err := store.Services(ctx)
+	if err != nil {
+		details.Metadata.healthComponent = healthFailed(err)
+		return details, fmt.Errorf("failure to read the metadata table %s: %w", ds.settings.MetaTable, err)
+	}
+	details.Metadata.Services = len(services)
+
+	if inspector != nil {
+		details.Metadata.Keywords, err = inspector.keywordCount(ctx)
+		if err != nil {
+			details.Metadata.healthComponent = healthFailed(err)
+			return details, fmt.Errorf("failure to count the keywords: %w", err)
+		}
+	}
+	details.Metadata.Status = HEALTH_OK
+
+	if inspector == nil {
+		return details, nil
+	}
+
+	// Read a few of the service tables, a service listed in the metadata without a table shows up here
+	now := time.Now()
+	var tableErr error
+	for _, service := range sampleServices(services, HEALTH_SAMPLE_TABLES) {
+		table := tableHealth{Service: service, healthComponent: healthComponent{Status: HEALTH_OK}}
+
+		inspection, err := inspector.inspectTable(ctx, service)
+		if err != nil {
+			table.healthComponent = healthFailed(err)
+			if tableErr == nil {
+				tableErr = fmt.Errorf("failure to read the %s table: %w", service, err)
+			}
+		}
+		table.Indexed = inspection.indexed
+
+		if inspection.newest != nil {
+			age := now.Sub(*inspection.newest).Seconds()
+			table.NewestSample, table.NewestAgeSeconds = inspection.newest, &age
+
+			if details.NewestSample == nil || inspection.newest.After(*details.NewestSample) {
+				details.NewestSample, details.NewestAgeSeconds = inspection.newest, &age
+			}
+		}
+
+		details.Tables = append(details.Tables, table)
+	}
+
+	return details, tableErr
+}
@@ -0,0 +1,194 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// The most buckets a histogram may have, this guards against a tiny bin width over a wide range
+const HISTOGRAM_MAX_BINS = 10000
+
+// histogramOptions are the query model settings for the histogram query type
+type histogramOptions struct {
+	// Fixed bucket width, buckets are aligned to multiples of it unless Min is given
+	BinWidth float64 `json:"binWidth"`
+
+	// Fixed number of equal buckets between the minimum and maximum, used when BinWidth is not given
+	Bins int `json:"bins"`
+
+	// Optional limits, values outside them are not counted
+	Min *float64 `json:"min"`
+	Max *float64 `json:"max"`
+
+	// Weight each sample by the time it was held (seconds) rather than counting samples
+	TimeWeighted bool `json:"timeWeighted"`
+}
+
+// histogramBins works out the bucket edges for the values of every keyword.  Without a fixed width or
+// count the Freedman–Diaconis rule is used, falling back to Sturges' rule if the values have no spread.
+func histogramBins(opts histogramOptions, all []float64) ([]float64, error) {
+	if opts.BinWidth < 0 || opts.Bins < 0 {
+		return nil, fmt.Errorf("binWidth and bins must not be negative")
+	}
+
+	// NaN and infinite values have no bucket and would make the range infinite
+	sorted := make([]float64, 0, len(all))
+	for _, v := range all {
+		if !math.IsNaN(v) && !math.IsInf(v, 0) {
+			sorted = append(sorted, v)
+		}
+	}
+	sort.Float64s(sorted)
+
+	lo, hi := 0.0, 1.0
+	if len(sorted) > 0 {
+		lo, hi = sorted[0], sorted[len(sorted)-1]
+	}
+	if opts.Min != nil {
+		lo = *opts.Min
+	}
+	if opts.Max != nil {
+		hi = *opts.Max
+	}
+	if hi < lo {
+		return nil, fmt.Errorf("histogram max must not be below min")
+	}
+
+	// Give a single-valued range some width so it still gets one bucket
+	if hi == lo {
+		lo, hi = lo-0.5, hi+0.5
+	}
+
+	var width float64
+	switch {
+	case opts.BinWidth > 0:
+		width = opts.BinWidth
+		if opts.Min == nil {
+			lo = math.Floor(lo/width) * width
+		}
+
+	case opts.Bins > 0:
+		width = (hi - lo) / float64(opts.Bins)
+
+	default:
+		n := float64(len(sorted))
+		if n > 1 {
+			iqr := percentile(sorted, 75) - percentile(sorted, 25)
+			width = 2 * iqr / math.Cbrt(n)
+		}
+		if width <= 0 {
+			width = (hi - lo) / math.Ceil(math.Log2(math.Max(n, 1))+1)
+		}
+	}
+
+	// Checked as a float since a tiny width can overflow the count, and int(+Inf) is not an error
+	buckets := math.Ceil((hi - lo) / width)
+	if math.IsNaN(buckets) || buckets > HISTOGRAM_MAX_BINS {
+		return nil, fmt.Errorf("histogram would need %g buckets, the limit is %d", buckets, HISTOGRAM_MAX_BINS)
+	}
+	count := max(int(buckets), 1)
+
+	edges := make([]float64, count+1)
+	for i := range edges {
+		edges[i] = lo + float64(i)*width
+	}
+
+	return edges, nil
+}
+
+// histogramCounts bins a series against the edges, the final bucket includes its upper edge
+func histogramCounts(times []time.Time, values []float64, edges []float64, timeWeighted bool, end time.Time) []float64 {
+	counts := make([]float64, len(edges)-1)
+	last := len(edges) - 1
+
+	for i, v := range values {
+		if v < edges[0] || v > edges[last] || math.IsNaN(v) {
+			continue
+		}
+
+		bucket := sort.SearchFloat64s(edges, v)
+		if bucket == len(edges) || edges[bucket] != v {
+			bucket--
+		}
+		bucket = min(bucket, last-1)
+
+		weight := 1.0
+		if timeWeighted {
+			// Each value holds until the next sample, the last one until the end of the range
+			next := end
+			if i+1 < len(values) {
+				next = times[i+1]
+			}
+			weight = math.Max(next.Sub(times[i]).Seconds(), 0)
+		}
+
+		counts[bucket] += weight
+	}
+
+	return counts
+}
+
+// queryHistogram returns a histogram frame with shared buckets and a count column per keyword
+func (ds *KeywordDatasource) queryHistogram(ctx context.Context, store ArchiveStore, qm queryModel, keys []string, pipeline *transformPipeline, timeRange backend.TimeRange) (*data.Frame, error) {
+	if pipeline.spectrum != nil {
+		return nil, fmt.Errorf("a spectrum cannot be binned, remove it or use a time series query")
+	}
+
+	// Gather every series first since the buckets are shared
+	type series struct {
+		times  []time.Time
+		values []float64
+	}
+	all := []float64{}
+	gathered := make([]series, len(keys))
+
+	for i, key := range keys {
+		times, values, err := ds.fetchSeries(ctx, store, qm, key, timeRange)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", key, err)
+		}
+
+		times, values, err = pipeline.run(ctx, times, values)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", key, err)
+		}
+
+		gathered[i] = series{times, values}
+		all = append(all, values...)
+	}
+
+	_, span := startSpan(ctx, "build histogram frame", ATTR_KEYWORDS.StringSlice(keys), ATTR_ROWS.Int(len(all)))
+	defer span.End()
+
+	edges, err := histogramBins(qm.Histogram, all)
+	if err != nil {
+		return nil, err
+	}
+
+	frame := data.NewFrame("histogram")
+	frame.RefID = qm.RefId
+
+	// Grafana recognises a frame with xMin and xMax fields as an already bucketed histogram
+	frame.Fields = append(frame.Fields,
+		data.NewField("xMin", nil, edges[:len(edges)-1]),
+		data.NewField("xMax", nil, edges[1:]),
+	)
+
+	for i, key := range keys {
+		counts := histogramCounts(gathered[i].times, gathered[i].values, edges, qm.Histogram.TimeWeighted, timeRange.To)
+
+		field := data.NewField(qm.seriesName(key), nil, counts)
+		if qm.Histogram.TimeWeighted {
+			field.Config = &data.FieldConfig{Unit: "s"}
+		}
+		frame.Fields = append(frame.Fields, field)
+	}
+
+	return frame, nil
+}
@@ -0,0 +1,88 @@
+package plugin
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestHistogramBins(t *testing.T) {
+	limit := func(v float64) *float64 { return &v }
+
+	cases := []struct {
+		name     string
+		opts     histogramOptions
+		values   []float64
+		expected []float64
+	}{
+		// A fixed width is aligned to its multiples
+		{"width", histogramOptions{BinWidth: 2}, []float64{1, 2, 3, 5}, []float64{0, 2, 4, 6}},
+		{"bins", histogramOptions{Bins: 4}, []float64{0, 3, 8}, []float64{0, 2, 4, 6, 8}},
+		// Given limits replace the range of the values and the alignment
+		{"limits", histogramOptions{BinWidth: 5, Min: limit(10), Max: limit(20)}, []float64{1, 30}, []float64{10, 15, 20}},
+		{"min", histogramOptions{BinWidth: 2, Min: limit(1)}, []float64{1, 4}, []float64{1, 3, 5}},
+		// Freedman–Diaconis, an interquartile range of 3.5 over eight values
+		{"auto", histogramOptions{}, []float64{0, 1, 2, 3, 4, 5, 6, 7}, []float64{0, 3.5, 7}},
+		// No spread falls back to Sturges over a widened range
+		{"single", histogramOptions{}, []float64{3, 3}, []float64{2.5, 3, 3.5}},
+		{"empty", histogramOptions{}, nil, []float64{0, 1}},
+		// Values with no bucket leave the range alone
+		{"non-finite", histogramOptions{BinWidth: 2}, []float64{1, math.NaN(), math.Inf(1), math.Inf(-1), 5},
+			[]float64{0, 2, 4, 6}},
+		{"all NaN", histogramOptions{Bins: 2}, []float64{math.NaN()}, []float64{0, 0.5, 1}},
+	}
+
+	for _, c := range cases {
+		got, err := histogramBins(c.opts, c.values)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if !sameValues(got, c.expected, 1e-9) {
+			t.Fatalf("%s: expected %v, got %v", c.name, c.expected, got)
+		}
+	}
+
+	for name, opts := range map[string]histogramOptions{
+		"negative width": {BinWidth: -1},
+		"negative bins":  {Bins: -2},
+		"max below min":  {Min: limit(5), Max: limit(1)},
+		"too many":       {BinWidth: 1e-4},
+		"overflow":       {BinWidth: 1e-320},
+		"one over":       {BinWidth: 1, Max: limit(10001)},
+	} {
+		if _, err := histogramBins(opts, []float64{0, 10}); err == nil {
+			t.Fatalf("%s: expected an error", name)
+		}
+	}
+
+	// The limit itself is allowed
+	if edges, err := histogramBins(histogramOptions{BinWidth: 1, Max: limit(HISTOGRAM_MAX_BINS)}, []float64{0}); err != nil ||
+		len(edges) != HISTOGRAM_MAX_BINS+1 {
+		t.Fatalf("expected %d buckets, got %d, %v", HISTOGRAM_MAX_BINS, len(edges)-1, err)
+	}
+}
+
+func TestHistogramCounts(t *testing.T) {
+	edges := []float64{0, 2, 4}
+
+	cases := []struct {
+		name         string
+		seconds      []float64
+		values       []float64
+		timeWeighted bool
+		expected     []float64
+	}{
+		// An edge belongs to the bucket above it except the last, values outside or NaN are not counted
+		{"count", []float64{0, 1, 2, 3, 4, 5}, []float64{0, 2, 4, 5, math.NaN(), -1}, false, []float64{1, 2}},
+		// Each value is weighted by the seconds until the next sample or the end of the range
+		{"time", []float64{0, 1, 3}, []float64{1, 3, 1}, true, []float64{5, 2}},
+		{"empty", nil, nil, false, []float64{0, 0}},
+	}
+
+	for _, c := range cases {
+		got := histogramCounts(secondsSeries(c.seconds...), c.values, edges, c.timeWeighted, testEpoch.Add(7*time.Second))
+		if !sameValues(got, c.expected, 1e-9) {
+			t.Fatalf("%s: expected %v, got %v", c.name, c.expected, got)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package plugin
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+)
+
+// logger returns the logger for a request, carrying the key/values added to its context
+func logger(ctx context.Context) log.Logger {
+	return log.DefaultLogger.FromContext(ctx)
+}
+
+// withLogValues adds key/values to every later log line of the request
+func withLogValues(ctx context.Context, keyValues ...any) context.Context {
+	return log.WithContextualAttributes(ctx, keyValues)
+}
+
+// newRequestID makes a short random ID tying together the log lines of one request
+func newRequestID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// withRequestLog starts the log context of a request from Grafana.  Under Grafana the SDK has already added
+// the plugin, datasource and trace, this adds a correlation ID, the org and the user, and the datasource
+// when the SDK did not (as for the command-line tool).
+func withRequestLog(ctx context.Context, pCtx backend.PluginContext) context.Context {
+	keyValues := []any{"requestId", newRequestID(), "orgId", pCtx.OrgID}
+
+	if pCtx.User != nil {
+		keyValues = append(keyValues, "user", pCtx.User.Login)
+	}
+
+	if pCtx.DataSourceInstanceSettings != nil && !hasLogValue(ctx, "dsUid") {
+		keyValues = append(keyValues, "dsUid", pCtx.DataSourceInstanceSettings.UID)
+	}
+
+	return withLogValues(ctx, keyValues...)
+}
+
+// hasLogValue reports whether the request's log context already has a key
+func hasLogValue(ctx context.Context, key string) bool {
+	keyValues := log.ContextualAttributesFromContext(ctx)
+	for i := 0; i+1 < len(keyValues); i += 2 {
+		if keyValues[i] == key {
+			return true
+		}
+	}
+	return false
+}
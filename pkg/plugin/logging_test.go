@@ -0,0 +1,100 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+)
+
+// recordingLogger keeps each line logged with its level and key/values
+type recordingLogger struct {
+	mu     *sync.Mutex
+	lines  *[]loggedLine
+	values []interface{}
+}
+
+type loggedLine struct {
+	level  string
+	msg    string
+	values map[string]interface{}
+}
+
+func newRecordingLogger() *recordingLogger {
+	return &recordingLogger{mu: &sync.Mutex{}, lines: &[]loggedLine{}}
+}
+
+func (l *recordingLogger) record(level string, msg string, args []interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	values := map[string]interface{}{}
+	all := append(append([]interface{}{}, l.values...), args...)
+	for i := 0; i+1 < len(all); i += 2 {
+		values[fmt.Sprint(all[i])] = all[i+1]
+	}
+	*l.lines = append(*l.lines, loggedLine{level, msg, values})
+}
+
+func (l *recordingLogger) Debug(msg string, args ...interface{}) { l.record("debug", msg, args) }
+func (l *recordingLogger) Info(msg string, args ...interface{})  { l.record("info", msg, args) }
+func (l *recordingLogger) Warn(msg string, args ...interface{})  { l.record("warn", msg, args) }
+func (l *recordingLogger) Error(msg string, args ...interface{}) { l.record("error", msg, args) }
+func (l *recordingLogger) Level() log.Level                      { return log.Debug }
+
+func (l *recordingLogger) With(args ...interface{}) log.Logger {
+	return &recordingLogger{mu: l.mu, lines: l.lines, values: append(append([]interface{}{}, l.values...), args...)}
+}
+
+func (l *recordingLogger) FromContext(ctx context.Context) log.Logger {
+	return l.With(log.ContextualAttributesFromContext(ctx)...)
+}
+
+func TestLogging(t *testing.T) {
+	recorder := newRecordingLogger()
+	previous := log.DefaultLogger
+	log.DefaultLogger = recorder
+	defer func() { log.DefaultLogger = previous }()
+
+	ds := newTestDatasource(t)
+	_, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+		PluginContext: backend.PluginContext{
+			OrgID:                      2,
+			User:                       &backend.User{Login: "observer"},
+			DataSourceInstanceSettings: &backend.DataSourceInstanceSettings{UID: "archive-uid"},
+		},
+		Queries: []backend.DataQuery{{
+			RefID:     "B",
+			JSON:      json.RawMessage(`{"queryText": "test.RAMP", "transforms": [{"name": "nonsense"}]}`),
+			TimeRange: backend.TimeRange{From: testEpoch, To: testEpoch.Add(time.Second)},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var failure *loggedLine
+	for i, line := range *recorder.lines {
+		// The request itself is only dumped at debug
+		if _, ok := line.values["request"]; ok && line.level != "debug" {
+			t.Fatalf("request logged at %s", line.level)
+		}
+		if line.level == "warn" && strings.HasSuffix(line.msg, "query failed") {
+			failure = &(*recorder.lines)[i]
+		}
+	}
+	if failure == nil {
+		t.Fatalf("no warning of the failed query: %+v", *recorder.lines)
+	}
+
+	v := failure.values
+	if v["refId"] != "B" || v["orgId"] != int64(2) || v["user"] != "observer" || v["dsUid"] != "archive-uid" || v["requestId"] == "" || v["error"] == nil {
+		t.Fatalf("missing request values: %v", v)
+	}
+}
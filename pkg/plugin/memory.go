@@ -0,0 +1,223 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryStore is an archive held in memory, filled from fixtures.  It lets the queries, transforms and
+// resources be exercised without a database.
+type MemoryStore struct {
+	mu       sync.RWMutex
+	services map[string]map[string]*memoryKeyword
+}
+
+type memoryKeyword struct {
+	meta   KeywordMetadata
+	times  []time.Time
+	values []string
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		services: map[string]map[string]*memoryKeyword{},
+	}
+}
+
+// keyword finds or adds a keyword, the lock must be held for writing
+func (m *MemoryStore) keyword(service string, keyword string) *memoryKeyword {
+	keywords, ok := m.services[service]
+	if !ok {
+		keywords = map[string]*memoryKeyword{}
+		m.services[service] = keywords
+	}
+
+	k, ok := keywords[keyword]
+	if !ok {
+		k = &memoryKeyword{meta: KeywordMetadata{Service: service, Keyword: keyword}}
+		keywords[keyword] = k
+	}
+
+	return k
+}
+
+// AddKeyword adds a keyword, or replaces its metadata if it is already present
+func (m *MemoryStore) AddKeyword(meta KeywordMetadata) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.keyword(meta.Service, meta.Keyword).meta = meta
+}
+
+// RemoveKeyword removes a service.keyword and its samples, and the service with its last keyword
+func (m *MemoryStore) RemoveKeyword(key string) {
+	service, keyword, err := splitKeyword(key)
+	if err != nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.services[service], keyword)
+	if len(m.services[service]) == 0 {
+		delete(m.services, service)
+	}
+}
+
+// AddSamples archives samples for a service.keyword, adding the keyword if need be.  The samples may
+// arrive in any order.
+func (m *MemoryStore) AddSamples(key string, times []time.Time, values []string) error {
+	if len(times) != len(values) {
+		return fmt.Errorf("%d times but %d values", len(times), len(values))
+	}
+
+	service, keyword, err := splitKeyword(key)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	k := m.keyword(service, keyword)
+	k.times = append(k.times, times...)
+	k.values = append(k.values, values...)
+	sort.Stable(byTime{k.times, k.values})
+
+	return nil
+}
+
+// byTime sorts samples by time, keeping values alongside
+type byTime struct {
+	times  []time.Time
+	values []string
+}
+
+func (b byTime) Len() int           { return len(b.times) }
+func (b byTime) Less(i, j int) bool { return b.times[i].Before(b.times[j]) }
+func (b byTime) Swap(i, j int) {
+	b.times[i], b.times[j] = b.times[j], b.times[i]
+	b.values[i], b.values[j] = b.values[j], b.values[i]
+}
+
+func (m *MemoryStore) Services(ctx context.Context) ([]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	services := make([]string, 0, len(m.services))
+	for service := range m.services {
+		services = append(services, service)
+	}
+	sort.Strings(services)
+
+	return services, nil
+}
+
+func (m *MemoryStore) Keywords(ctx context.Context, service string) ([]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	keywords := make([]string, 0, len(m.services[service]))
+	for keyword := range m.services[service] {
+		keywords = append(keywords, keyword)
+	}
+	sort.Strings(keywords)
+
+	return keywords, nil
+}
+
+func (m *MemoryStore) Samples(ctx context.Context, service string, keyword string, from time.Time, to time.Time) ([]time.Time, []string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	times := []time.Time{}
+	values := []string{}
+
+	k, ok := m.services[service][keyword]
+	if !ok {
+		return times, values, nil
+	}
+
+	for i, t := range k.times {
+		if !t.Before(from) && !t.After(to) {
+			times = append(times, t)
+			values = append(values, k.values[i])
+		}
+	}
+
+	return times, values, nil
+}
+
+func (m *MemoryStore) Latest(ctx context.Context, service string, keyword string, before time.Time) (time.Time, string, bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	k, ok := m.services[service][keyword]
+	if !ok {
+		return time.Time{}, "", false, nil
+	}
+
+	// The first sample after the time, the one before it is the latest
+	i := sort.Search(len(k.times), func(i int) bool { return k.times[i].After(before) })
+	if i == 0 {
+		return time.Time{}, "", false, nil
+	}
+
+	return k.times[i-1], k.values[i-1], true, nil
+}
+
+func (m *MemoryStore) Metadata(ctx context.Context, service string) ([]KeywordMetadata, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	list := make([]KeywordMetadata, 0, len(m.services[service]))
+	for _, k := range m.services[service] {
+		list = append(list, k.meta)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Keyword < list[j].Keyword })
+
+	return list, nil
+}
+
+func (m *MemoryStore) version(ctx context.Context) (string, error) {
+	return "in-memory archive", nil
+}
+
+func (m *MemoryStore) keywordCount(ctx context.Context) (int, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	count := 0
+	for _, keywords := range m.services {
+		count += len(keywords)
+	}
+
+	return count, nil
+}
+
+// inspectTable finds a service's newest sample, there are no indexes to report
+func (m *MemoryStore) inspectTable(ctx context.Context, service string) (tableInspection, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	inspection := tableInspection{}
+	for _, k := range m.services[service] {
+		if n := len(k.times); n > 0 && (inspection.newest == nil || k.times[n-1].After(*inspection.newest)) {
+			inspection.newest = &k.times[n-1]
+		}
+	}
+
+	return inspection, nil
+}
+
+func (m *MemoryStore) Ping(ctx context.Context) error {
+	return nil
+}
+
+func (m *MemoryStore) Close() error {
+	return nil
+}
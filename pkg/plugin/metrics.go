@@ -0,0 +1,244 @@
+package plugin
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Metrics are registered with the default Prometheus registry, which the SDK serves to Grafana from the
+// plugin's metrics endpoint
+const METRICS_NAMESPACE = "keyword_datasource"
+
+var (
+	queriesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "queries_total",
+		Help:      "Queries run, by query type and whether they succeeded.",
+	}, []string{"query_type", "status"})
+
+	queryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "query_duration_seconds",
+		Help:      "Time to answer a query, archive reads included.",
+		Buckets:   prometheus.ExponentialBuckets(0.005, 2, 14),
+	}, []string{"query_type"})
+
+	archiveDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "archive_read_duration_seconds",
+		Help:      "Time spent waiting on the archive, set against query_duration_seconds to find where a slow query goes.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 2, 16),
+	}, []string{"backend", "operation"})
+
+	rowsFetched = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "rows_fetched_total",
+		Help:      "Samples read from the archive.",
+	}, []string{"backend"})
+
+	bytesReturned = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "response_bytes_total",
+		Help:      "Bytes returned, exact for resource calls and estimated from the frame data for queries.",
+	}, []string{"handler"})
+
+	resourceRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "resource_requests_total",
+		Help:      "Resource calls, by path and HTTP status code.",
+	}, []string{"path", "code"})
+
+	resourceErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "resource_errors_total",
+		Help:      "Resource calls answered with an error status.",
+	}, []string{"path"})
+
+	cacheRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "cache_requests_total",
+		Help:      "Cache lookups by cache and result, hit or miss, giving the hit rate.",
+	}, []string{"cache", "result"})
+)
+
+// queryTypeLabel names the time series query type, which is empty in the query itself
+func queryTypeLabel(queryType string) string {
+	if queryType == QUERY_TYPE_TIMESERIES {
+		return "timeseries"
+	}
+	return queryType
+}
+
+// backendLabel names the store's backend, an empty backend is Postgres
+func backendLabel(settings *DatasourceSettings) string {
+	if settings.Backend == "" {
+		return BACKEND_POSTGRES
+	}
+	return settings.Backend
+}
+
+// cacheResult counts a cache lookup
+func cacheResult(cache string, hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	cacheRequests.WithLabelValues(cache, result).Inc()
+}
+
+// frameBytes estimates the size of a frame's data, eight bytes a value and the length of strings
+func frameBytes(frame *data.Frame) int {
+	size := 0
+	for _, field := range frame.Fields {
+		switch field.Type() {
+		case data.FieldTypeString, data.FieldTypeNullableString:
+			for i := 0; i < field.Len(); i++ {
+				if v, ok := field.ConcreteAt(i); ok {
+					size += len(v.(string))
+				}
+			}
+		default:
+			size += 8 * field.Len()
+		}
+	}
+	return size
+}
+
+// metricsWriter records the status and size of a resource response, passing flushes through for the
+// streamed export
+type metricsWriter struct {
+	http.ResponseWriter
+	code  int
+	bytes int
+}
+
+func (w *metricsWriter) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *metricsWriter) Write(b []byte) (int, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += n
+	return n, err
+}
+
+func (w *metricsWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// instrumentResource counts the calls to a resource path, their errors and the bytes returned
+func instrumentResource(path string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		// Each call gets its own correlation ID in the log
+		ctx := withRequestLog(req.Context(), backend.PluginConfigFromContext(req.Context()))
+		req = req.WithContext(ctx)
+		start := time.Now()
+
+		w := &metricsWriter{ResponseWriter: rw}
+		handler(w, req)
+
+		if w.code == 0 {
+			w.code = http.StatusOK
+		}
+		logger(ctx).Debug(fl()+"resource call", "url", req.URL.String(), "method", req.Method, "status", w.code,
+			"bytes", w.bytes, "duration", time.Since(start))
+
+		resourceRequests.WithLabelValues(path, strconv.Itoa(w.code)).Inc()
+		if w.code >= http.StatusBadRequest {
+			resourceErrors.WithLabelValues(path).Inc()
+		}
+		bytesReturned.WithLabelValues(path).Add(float64(w.bytes))
+	}
+}
+
+// observeArchive records the time taken by an archive read started at start
+func observeArchive(settings *DatasourceSettings, operation string, start time.Time) {
+	archiveDuration.WithLabelValues(backendLabel(settings), operation).Observe(time.Since(start).Seconds())
+}
+
+// poolReporter is implemented by stores with a connection pool
+type poolReporter interface {
+	poolStats() sql.DBStats
+}
+
+// poolCollector reports the connection pools of the live instances, labelled by datasource
+type poolCollector struct {
+	mu    sync.Mutex
+	pools map[string]poolReporter
+
+	open     *prometheus.Desc
+	inUse    *prometheus.Desc
+	idle     *prometheus.Desc
+	waits    *prometheus.Desc
+	waitTime *prometheus.Desc
+}
+
+var pools = newPoolCollector()
+
+func newPoolCollector() *poolCollector {
+	label := []string{"datasource"}
+	c := &poolCollector{
+		pools:    map[string]poolReporter{},
+		open:     prometheus.NewDesc(METRICS_NAMESPACE+"_db_open_connections", "Connections open to the archive.", label, nil),
+		inUse:    prometheus.NewDesc(METRICS_NAMESPACE+"_db_in_use_connections", "Connections running a statement.", label, nil),
+		idle:     prometheus.NewDesc(METRICS_NAMESPACE+"_db_idle_connections", "Connections open but idle.", label, nil),
+		waits:    prometheus.NewDesc(METRICS_NAMESPACE+"_db_wait_total", "Times a statement waited for a free connection.", label, nil),
+		waitTime: prometheus.NewDesc(METRICS_NAMESPACE+"_db_wait_seconds_total", "Time spent waiting for a free connection.", label, nil),
+	}
+	prometheus.MustRegister(c)
+	return c
+}
+
+// add starts reporting an instance's pool, replacing any earlier instance of the same datasource
+func (c *poolCollector) add(datasource string, pool poolReporter) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pools[datasource] = pool
+}
+
+// remove stops reporting the pool, unless a newer instance has already taken its place
+func (c *poolCollector) remove(datasource string, pool poolReporter) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.pools[datasource] == pool {
+		delete(c.pools, datasource)
+	}
+}
+
+func (c *poolCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.open
+	ch <- c.inUse
+	ch <- c.idle
+	ch <- c.waits
+	ch <- c.waitTime
+}
+
+func (c *poolCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for datasource, pool := range c.pools {
+		stats := pool.poolStats()
+		ch <- prometheus.MustNewConstMetric(c.open, prometheus.GaugeValue, float64(stats.OpenConnections), datasource)
+		ch <- prometheus.MustNewConstMetric(c.inUse, prometheus.GaugeValue, float64(stats.InUse), datasource)
+		ch <- prometheus.MustNewConstMetric(c.idle, prometheus.GaugeValue, float64(stats.Idle), datasource)
+		ch <- prometheus.MustNewConstMetric(c.waits, prometheus.CounterValue, float64(stats.WaitCount), datasource)
+		ch <- prometheus.MustNewConstMetric(c.waitTime, prometheus.CounterValue, stats.WaitDuration.Seconds(), datasource)
+	}
+}
@@ -0,0 +1,43 @@
+package plugin
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMetrics(t *testing.T) {
+	ds := newTestDatasource(t)
+
+	queries := testutil.ToFloat64(queriesTotal.WithLabelValues("stats", "ok"))
+	rows := testutil.ToFloat64(rowsFetched.WithLabelValues(BACKEND_POSTGRES))
+	failures := testutil.ToFloat64(queriesTotal.WithLabelValues("timeseries", "error"))
+
+	// The test datasource has default settings, so its memory store is labelled as the default backend
+	res := runQuery(t, ds, QUERY_TYPE_STATS, `{"queryText": "test.RAMP"}`)
+	if res.Error != nil {
+		t.Fatal(res.Error)
+	}
+	if n := testutil.ToFloat64(queriesTotal.WithLabelValues("stats", "ok")) - queries; n != 1 {
+		t.Fatalf("expected one query counted, got %g", n)
+	}
+	if n := testutil.ToFloat64(rowsFetched.WithLabelValues(BACKEND_POSTGRES)) - rows; n != 5 {
+		t.Fatalf("expected five rows fetched, got %g", n)
+	}
+
+	runQuery(t, ds, QUERY_TYPE_TIMESERIES, `{"queryText": "RAMP"}`)
+	if n := testutil.ToFloat64(queriesTotal.WithLabelValues("timeseries", "error")) - failures; n != 1 {
+		t.Fatalf("expected one failed query counted, got %g", n)
+	}
+
+	// A bad export is a resource error
+	errors := testutil.ToFloat64(resourceErrors.WithLabelValues("/export"))
+	status, _, _, _ := callResourceRaw(t, ds, "/export?format=nonsense&keyword=test.RAMP")
+	if status != http.StatusBadRequest {
+		t.Fatalf("unexpected status %d", status)
+	}
+	if n := testutil.ToFloat64(resourceErrors.WithLabelValues("/export")) - errors; n != 1 {
+		t.Fatalf("expected one resource error counted, got %g", n)
+	}
+}
@@ -0,0 +1,227 @@
+package plugin
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// ArchiveSchema describes how an archive lays out its tables, so the same plugin can read the legacy KTL
+// archive, the newer archiver schema and the EPICS-derived tables.  Empty fields take the KTL defaults.
+type ArchiveSchema struct {
+	// Table holding a service's samples, {service} is replaced by the service name.  A schema-qualified
+	// name such as "archive.{service}" is allowed.
+	TableTemplate string `json:"tableTemplate"`
+
+	TimeColumn    string `json:"timeColumn"`
+	KeywordColumn string `json:"keywordColumn"`
+
+	// How the time column is stored, one of the TIME_FORMAT_* values
+	TimeFormat string `json:"timeFormat"`
+
+	// Value column(s), the first non-null of these is used for each sample
+	ValueColumns []string `json:"valueColumns"`
+
+	// Columns of the metadata table, the table itself is DatasourceSettings.MetaTable
+	MetaServiceColumn string `json:"metaServiceColumn"`
+	MetaKeywordColumn string `json:"metaKeywordColumn"`
+
+	// Descriptive metadata columns, reported by the metadata lookups
+	MetaUnitsColumn       string `json:"metaUnitsColumn"`
+	MetaDescriptionColumn string `json:"metaDescriptionColumn"`
+}
+
+// How the archive stores sample times
+const (
+	TIME_FORMAT_FLOAT_SECONDS = "float_seconds"
+	TIME_FORMAT_INT_MS        = "int_ms"
+	TIME_FORMAT_INT_US        = "int_us"
+	TIME_FORMAT_TIMESTAMPTZ   = "timestamptz"
+)
+
+// The original KTL archive layout
+const (
+	DEFAULT_META_TABLE = "ktlmeta"
+)
+
+// applyDefaults fills in any part of the schema not given with the KTL archive layout
+func (s *ArchiveSchema) applyDefaults() {
+	if s.TableTemplate == "" {
+		s.TableTemplate = "{service}"
+	}
+	if s.TimeColumn == "" {
+		s.TimeColumn = "time"
+	}
+	if s.KeywordColumn == "" {
+		s.KeywordColumn = "keyword"
+	}
+	if s.TimeFormat == "" {
+		s.TimeFormat = TIME_FORMAT_FLOAT_SECONDS
+	}
+	if len(s.ValueColumns) == 0 {
+		s.ValueColumns = []string{"binvalue"}
+	}
+	if s.MetaServiceColumn == "" {
+		s.MetaServiceColumn = "service"
+	}
+	if s.MetaKeywordColumn == "" {
+		s.MetaKeywordColumn = "keyword"
+	}
+	if s.MetaUnitsColumn == "" {
+		s.MetaUnitsColumn = "units"
+	}
+	if s.MetaDescriptionColumn == "" {
+		s.MetaDescriptionColumn = "description"
+	}
+}
+
+// validate checks a schema that has had its defaults applied
+func (s *ArchiveSchema) validate() error {
+	if !strings.Contains(s.TableTemplate, "{service}") {
+		return fmt.Errorf("schema tableTemplate must contain {service}")
+	}
+
+	switch s.TimeFormat {
+	case TIME_FORMAT_FLOAT_SECONDS, TIME_FORMAT_INT_MS, TIME_FORMAT_INT_US, TIME_FORMAT_TIMESTAMPTZ:
+	default:
+		return fmt.Errorf("schema timeFormat must be one of %s, %s, %s or %s, not %q",
+			TIME_FORMAT_FLOAT_SECONDS, TIME_FORMAT_INT_MS, TIME_FORMAT_INT_US, TIME_FORMAT_TIMESTAMPTZ, s.TimeFormat)
+	}
+
+	for _, column := range s.ValueColumns {
+		if column == "" {
+			return fmt.Errorf("schema valueColumns must not contain an empty name")
+		}
+	}
+
+	return nil
+}
+
+// quoteQualified quotes each dotted part of a possibly schema-qualified name
+func quoteQualified(name string) string {
+	parts := strings.Split(name, ".")
+	for i, part := range parts {
+		parts[i] = pq.QuoteIdentifier(part)
+	}
+	return strings.Join(parts, ".")
+}
+
+// table returns the quoted table name holding a service's samples.  The service is substituted before
+// quoting so that nothing in it can escape the identifier.
+func (s *ArchiveSchema) table(service string) string {
+	parts := strings.Split(s.TableTemplate, ".")
+	for i, part := range parts {
+		parts[i] = pq.QuoteIdentifier(strings.ReplaceAll(part, "{service}", service))
+	}
+	return strings.Join(parts, ".")
+}
+
+// valueExpression selects the sample value as trimmed text, coalescing over several value columns
+func (s *ArchiveSchema) valueExpression() string {
+	exprs := make([]string, len(s.ValueColumns))
+	for i, column := range s.ValueColumns {
+		// 2021-08-30: trim the value so whitespace doesn't affect the float64 conversion
+		exprs[i] = fmt.Sprintf("trim(cast(%s as text))", pq.QuoteIdentifier(column))
+	}
+
+	if len(exprs) == 1 {
+		return exprs[0]
+	}
+	return "coalesce(" + strings.Join(exprs, ", ") + ")"
+}
+
+// countQuery counts a keyword's samples in a time range, the arguments are keyword, from, to
+func (s *ArchiveSchema) countQuery(service string) string {
+	return fmt.Sprintf("select count(%s) from %s where %s = $1 and %s >= $2 and %s <= $3;",
+		pq.QuoteIdentifier(s.TimeColumn), s.table(service), pq.QuoteIdentifier(s.KeywordColumn),
+		pq.QuoteIdentifier(s.TimeColumn), pq.QuoteIdentifier(s.TimeColumn))
+}
+
+// samplesQuery selects a keyword's time and value in a time range, the arguments are keyword, from, to
+func (s *ArchiveSchema) samplesQuery(service string) string {
+	timeColumn := pq.QuoteIdentifier(s.TimeColumn)
+	return fmt.Sprintf("select %s, %s from %s where %s = $1 and %s >= $2 and %s <= $3 order by %s asc;",
+		timeColumn, s.valueExpression(), s.table(service), pq.QuoteIdentifier(s.KeywordColumn),
+		timeColumn, timeColumn, timeColumn)
+}
+
+// latestQuery selects a keyword's last sample at or before a time, the arguments are keyword, time
+func (s *ArchiveSchema) latestQuery(service string) string {
+	timeColumn := pq.QuoteIdentifier(s.TimeColumn)
+	return fmt.Sprintf("select %s, %s from %s where %s = $1 and %s <= $2 order by %s desc limit 1;",
+		timeColumn, s.valueExpression(), s.table(service), pq.QuoteIdentifier(s.KeywordColumn),
+		timeColumn, timeColumn)
+}
+
+// servicesQuery lists the distinct services in the metadata table
+func (s *ArchiveSchema) servicesQuery(metaTable string) string {
+	service := pq.QuoteIdentifier(s.MetaServiceColumn)
+	return fmt.Sprintf("select distinct %s from %s order by %s asc;", service, quoteQualified(metaTable), service)
+}
+
+// keywordsQuery lists a service's keywords in the metadata table, the argument is the service
+func (s *ArchiveSchema) keywordsQuery(metaTable string) string {
+	keyword := pq.QuoteIdentifier(s.MetaKeywordColumn)
+	return fmt.Sprintf("select %s from %s where %s = $1 order by %s asc;",
+		keyword, quoteQualified(metaTable), pq.QuoteIdentifier(s.MetaServiceColumn), keyword)
+}
+
+// metadataQuery describes a service's keywords from the metadata table, the argument is the service
+func (s *ArchiveSchema) metadataQuery(metaTable string) string {
+	keyword := pq.QuoteIdentifier(s.MetaKeywordColumn)
+	return fmt.Sprintf("select %s, coalesce(cast(%s as text), ''), coalesce(cast(%s as text), '') from %s where %s = $1 order by %s asc;",
+		keyword, pq.QuoteIdentifier(s.MetaUnitsColumn), pq.QuoteIdentifier(s.MetaDescriptionColumn),
+		quoteQualified(metaTable), pq.QuoteIdentifier(s.MetaServiceColumn), keyword)
+}
+
+// timeArg converts a time into the representation the time column is compared against
+func (s *ArchiveSchema) timeArg(t time.Time) interface{} {
+	switch s.TimeFormat {
+	case TIME_FORMAT_INT_MS:
+		return t.UnixMilli()
+	case TIME_FORMAT_INT_US:
+		return t.UnixMicro()
+	case TIME_FORMAT_TIMESTAMPTZ:
+		return t
+	default:
+		// Unix time as a floating point
+		return float64(t.UnixNano()) * 1e-9
+	}
+}
+
+// timeFromNumber converts a numeric time column value, as scanned into a float64, into a time.Time
+func (s *ArchiveSchema) timeFromNumber(v float64) time.Time {
+	switch s.TimeFormat {
+	case TIME_FORMAT_INT_MS:
+		return time.UnixMilli(int64(v))
+	case TIME_FORMAT_INT_US:
+		return time.UnixMicro(int64(v))
+	default:
+		// Separate the fractional seconds so we can convert it into a time.Time
+		sec, dec := math.Modf(v)
+		return time.Unix(int64(sec), int64(dec*(1e9)))
+	}
+}
+
+// tableName returns a service's table unquoted, split into its schema (empty if not qualified) and
+// name, as the database catalogs list it
+func (s *ArchiveSchema) tableName(service string) (string, string) {
+	name := strings.ReplaceAll(s.TableTemplate, "{service}", service)
+	if i := strings.LastIndex(name, "."); i >= 0 {
+		return name[:i], name[i+1:]
+	}
+	return "", name
+}
+
+// newestQuery selects the time of a service's newest sample, null when the table is empty
+func (s *ArchiveSchema) newestQuery(service string) string {
+	return fmt.Sprintf("select max(%s) from %s;", pq.QuoteIdentifier(s.TimeColumn), s.table(service))
+}
+
+// keywordCountQuery counts the keywords in the metadata table
+func (s *ArchiveSchema) keywordCountQuery(metaTable string) string {
+	return fmt.Sprintf("select count(*) from %s;", quoteQualified(metaTable))
+}
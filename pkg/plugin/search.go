@@ -0,0 +1,254 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Number of search results returned unless the caller asks for a different number, and the most allowed
+const (
+	SEARCH_DEFAULT_LIMIT = 20
+	SEARCH_MAX_LIMIT     = 200
+)
+
+// Scores for each way a search term can match, the best match of each term counts.  A name match beats a
+// service match, which beats a match in the description or units.
+const (
+	SCORE_EXACT       = 100
+	SCORE_PREFIX      = 60
+	SCORE_SUBSTRING   = 40
+	SCORE_FUZZY       = 20
+	SCORE_SERVICE     = 30
+	SCORE_DESCRIPTION = 15
+	SCORE_UNITS       = 10
+)
+
+// SearchResult is a keyword found by the /search resource
+type SearchResult struct {
+	KeywordMetadata
+	Score int `json:"score"`
+}
+
+// searchEntry is a keyword in the index, with its text lower-cased once when the index is built
+type searchEntry struct {
+	meta        KeywordMetadata
+	key         string
+	keyword     string
+	service     string
+	description []string
+	units       string
+}
+
+// keywordIndex is the in-memory search index over every keyword's metadata, built from the keyword catalog
+// on the first search and again whenever the catalog has been refreshed
+type keywordIndex struct {
+	mu         sync.Mutex
+	entries    []searchEntry
+	generation int
+}
+
+// newSearchEntry lower-cases a keyword's metadata for matching
+func newSearchEntry(meta KeywordMetadata) searchEntry {
+	return searchEntry{
+		meta:        meta,
+		key:         strings.ToLower(meta.Service + "." + meta.Keyword),
+		keyword:     strings.ToLower(meta.Keyword),
+		service:     strings.ToLower(meta.Service),
+		description: strings.Fields(strings.ToLower(meta.Description)),
+		units:       strings.ToLower(meta.Units),
+	}
+}
+
+// load returns the index entries, building them again if the catalog has changed since
+func (idx *keywordIndex) load(ctx context.Context, catalog *keywordCatalog) ([]searchEntry, error) {
+	snapshot, err := catalog.snapshot(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	current := idx.entries != nil && idx.generation == snapshot.generation
+	cacheResult("search", current)
+	if current {
+		return idx.entries, nil
+	}
+
+	entries := make([]searchEntry, 0, snapshot.keywords)
+	for _, service := range snapshot.services {
+		for _, meta := range snapshot.metadata[service] {
+			entries = append(entries, newSearchEntry(meta))
+		}
+	}
+
+	idx.entries = entries
+	idx.generation = snapshot.generation
+	logger(ctx).Debug(fl()+"built the keyword search index", "keywords", len(entries), "generation", snapshot.generation)
+
+	return entries, nil
+}
+
+// matchName scores a term against a name, exact, prefix, substring or within a few edits
+func matchName(term string, name string) int {
+	switch {
+	case name == term:
+		return SCORE_EXACT
+	case strings.HasPrefix(name, term):
+		return SCORE_PREFIX
+	case strings.Contains(name, term):
+		return SCORE_SUBSTRING
+	case fuzzyMatch(term, name):
+		return SCORE_FUZZY
+	}
+	return 0
+}
+
+// fuzzyMatch allows one typing error in short terms and two in longer ones, a term too short to say much
+// is not matched fuzzily at all
+func fuzzyMatch(term string, name string) bool {
+	allowed := 1
+	if len(term) < 3 {
+		return false
+	} else if len(term) > 6 {
+		allowed = 2
+	}
+
+	if d := len(name) - len(term); d > allowed || d < -allowed {
+		return false
+	}
+	return editDistance(term, name) <= allowed
+}
+
+// editDistance is the Levenshtein distance between two strings
+func editDistance(a string, b string) int {
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+
+	return previous[len(b)]
+}
+
+// score rates an entry against a term, 0 if the term does not match it at all
+func (e *searchEntry) score(term string) int {
+	best := max(matchName(term, e.keyword), matchName(term, e.key))
+
+	if strings.HasPrefix(e.service, term) {
+		best = max(best, SCORE_SERVICE)
+	}
+
+	for _, word := range e.description {
+		if strings.HasPrefix(word, term) {
+			best = max(best, SCORE_DESCRIPTION)
+		} else if strings.Contains(word, term) || fuzzyMatch(term, word) {
+			best = max(best, SCORE_DESCRIPTION/2)
+		}
+	}
+
+	if e.units != "" && e.units == term {
+		best = max(best, SCORE_UNITS)
+	}
+
+	return best
+}
+
+// searchEntries ranks the entries against every term of the query, an entry must match each term.  Ties go to
+// the shorter name, then alphabetical order.
+func searchEntries(entries []searchEntry, query string, service string, limit int) []SearchResult {
+	terms := strings.Fields(strings.ToLower(query))
+	service = strings.ToLower(service)
+	results := []SearchResult{}
+
+	for i := range entries {
+		e := &entries[i]
+		if service != "" && e.service != service {
+			continue
+		}
+
+		total := 0
+		for _, term := range terms {
+			s := e.score(term)
+			if s == 0 {
+				total = 0
+				break
+			}
+			total += s
+		}
+
+		if total > 0 {
+			results = append(results, SearchResult{KeywordMetadata: e.meta, Score: total})
+		}
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		a, b := results[i], results[j]
+		if a.Score != b.Score {
+			return a.Score > b.Score
+		}
+		if len(a.Keyword) != len(b.Keyword) {
+			return len(a.Keyword) < len(b.Keyword)
+		}
+		return a.Service+"."+a.Keyword < b.Service+"."+b.Keyword
+	})
+
+	if len(results) > limit {
+		results = results[:limit]
+	}
+	return results
+}
+
+// handleResourceSearch finds keywords across every service, q is the search and limit the number of results.
+// service narrows the search to a single service.
+func (ds *KeywordDatasource) handleResourceSearch(rw http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	_, err := ds.archive()
+	if err != nil {
+		logger(ctx).Error(fl()+"archive unavailable", "error", err)
+		writeResult(rw, "?", nil, withStatus(http.StatusServiceUnavailable, err))
+		return
+	}
+
+	params := req.URL.Query()
+	query := strings.TrimSpace(params.Get("q"))
+	if query == "" {
+		writeResult(rw, "?", nil, fmt.Errorf("the search needs a q parameter"))
+		return
+	}
+
+	limit := SEARCH_DEFAULT_LIMIT
+	if text := params.Get("limit"); text != "" {
+		limit, err = strconv.Atoi(text)
+		if err != nil || limit < 1 || limit > SEARCH_MAX_LIMIT {
+			writeResult(rw, "?", nil, fmt.Errorf("limit must be a number from 1 to %d", SEARCH_MAX_LIMIT))
+			return
+		}
+	}
+
+	entries, err := ds.search.load(ctx, ds.catalog)
+	if err != nil {
+		logger(ctx).Error(fl()+"search index build failure", "error", err)
+		writeResult(rw, "?", nil, withStatus(http.StatusInternalServerError, err))
+		return
+	}
+
+	writeResult(rw, "results", searchEntries(entries, query, params.Get("service"), limit), nil)
+}
@@ -0,0 +1,88 @@
+package plugin
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestSearchRanking(t *testing.T) {
+	entries := []searchEntry{}
+	for _, meta := range []KeywordMetadata{
+		{Service: "dcs", Keyword: "AZ", Units: "deg", Description: "Telescope azimuth"},
+		{Service: "dcs", Keyword: "AZERR", Units: "arcsec", Description: "Azimuth tracking error"},
+		{Service: "dcs", Keyword: "EL", Units: "deg", Description: "Telescope elevation"},
+		{Service: "ao", Keyword: "DTTAZ", Units: "", Description: "Tip tilt azimuth offset"},
+		{Service: "met", Keyword: "TEMPERATURE", Units: "degC", Description: "Outside air temperature"},
+	} {
+		entries = append(entries, newSearchEntry(meta))
+	}
+
+	keys := func(results []SearchResult) []string {
+		list := []string{}
+		for _, r := range results {
+			list = append(list, r.Service+"."+r.Keyword)
+		}
+		return list
+	}
+
+	cases := []struct {
+		query    string
+		service  string
+		expected []string
+	}{
+		// An exact name first, then a prefix, then a substring, then description matches
+		{"az", "", []string{"dcs.AZ", "dcs.AZERR", "ao.DTTAZ"}},
+		{"azimuth", "", []string{"dcs.AZ", "ao.DTTAZ", "dcs.AZERR"}},
+		// Every term must match
+		{"telescope el", "", []string{"dcs.EL"}},
+		// A misspelling still finds the keyword
+		{"temprature", "", []string{"met.TEMPERATURE"}},
+		// The service narrows the search
+		{"az", "ao", []string{"ao.DTTAZ"}},
+		{"arcsec", "", []string{"dcs.AZERR"}},
+		{"nothing", "", []string{}},
+	}
+
+	for _, c := range cases {
+		got := keys(searchEntries(entries, c.query, c.service, SEARCH_DEFAULT_LIMIT))
+		if len(got) < len(c.expected) {
+			t.Fatalf("%q: expected %v, got %v", c.query, c.expected, got)
+		}
+		for i := range c.expected {
+			if got[i] != c.expected[i] {
+				t.Fatalf("%q: expected %v, got %v", c.query, c.expected, got)
+			}
+		}
+		if len(c.expected) == 0 && len(got) != 0 {
+			t.Fatalf("%q: expected nothing, got %v", c.query, got)
+		}
+	}
+
+	if got := searchEntries(entries, "az", "", 1); len(got) != 1 {
+		t.Fatalf("expected the limit to apply, got %v", keys(got))
+	}
+}
+
+func TestSearchResource(t *testing.T) {
+	ds := newTestDatasource(t)
+
+	status, body := callResource(t, ds, "/search?q=azimuth")
+	results, _ := body["results"].([]interface{})
+	if status != http.StatusOK || len(results) != 1 {
+		t.Fatalf("unexpected search results %d: %v", status, body)
+	}
+	result := results[0].(map[string]interface{})
+	if result["service"] != "dcs" || result["keyword"] != "AZ" || result["units"] != "deg" {
+		t.Fatalf("unexpected search result: %v", result)
+	}
+
+	status, _ = callResource(t, ds, "/search")
+	if status != http.StatusBadRequest {
+		t.Fatalf("expected a bad request without a search, got %d", status)
+	}
+
+	status, _ = callResource(t, ds, "/search?q=ramp&limit=0")
+	if status != http.StatusBadRequest {
+		t.Fatalf("expected a bad request for a zero limit, got %d", status)
+	}
+}
@@ -0,0 +1,468 @@
+package plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+// transformWindow is the extent of a rolling window, either a number of samples or a span of time.
+// In the step parameters it is written as a number for samples, or a duration string such as "30s".
+type transformWindow struct {
+	samples  int
+	duration time.Duration
+}
+
+func (w *transformWindow) UnmarshalJSON(b []byte) error {
+	var n float64
+	if json.Unmarshal(b, &n) == nil {
+		if n < 1 || n != math.Trunc(n) {
+			return fmt.Errorf("window sample count must be a positive integer")
+		}
+		w.samples = int(n)
+		return nil
+	}
+
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("window must be a sample count or a duration")
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("window: %s", err.Error())
+	}
+	if d <= 0 {
+		return fmt.Errorf("window duration must be positive")
+	}
+	w.duration = d
+
+	return nil
+}
+
+func (w transformWindow) isSet() bool {
+	return w.samples > 0 || w.duration > 0
+}
+
+// Window alignment, trailing windows end at the sample being computed while centred windows surround it
+const (
+	WINDOW_ALIGN_TRAILING = "trailing"
+	WINDOW_ALIGN_CENTER   = "center"
+)
+
+type rollingParams struct {
+	Window transformWindow `json:"window"`
+	Align  string          `json:"align"`
+}
+
+func (p *rollingParams) validate() error {
+	if !p.Window.isSet() {
+		return fmt.Errorf("a window is required")
+	}
+
+	switch p.Align {
+	case "":
+		p.Align = WINDOW_ALIGN_TRAILING
+	case WINDOW_ALIGN_TRAILING, WINDOW_ALIGN_CENTER:
+	default:
+		return fmt.Errorf("unknown window alignment: %s", p.Align)
+	}
+
+	return nil
+}
+
+// windowBounds returns, for every sample, the inclusive index range [lo, hi] of its window.  Both bounds
+// never decrease from one sample to the next, which the rolling min/max relies on.
+func windowBounds(times []time.Time, w transformWindow, align string) (lo []int, hi []int) {
+	n := len(times)
+	lo = make([]int, n)
+	hi = make([]int, n)
+
+	if w.samples > 0 {
+		for i := 0; i < n; i++ {
+			if align == WINDOW_ALIGN_CENTER {
+				lo[i] = i - (w.samples-1)/2
+				hi[i] = lo[i] + w.samples - 1
+			} else {
+				lo[i] = i - w.samples + 1
+				hi[i] = i
+			}
+			lo[i] = max(lo[i], 0)
+			hi[i] = min(hi[i], n-1)
+		}
+		return lo, hi
+	}
+
+	// Time windows, walk both edges forward with the sample
+	before, after := w.duration, time.Duration(0)
+	if align == WINDOW_ALIGN_CENTER {
+		before, after = w.duration/2, w.duration/2
+	}
+
+	// A trailing window excludes its leading edge, (t - d, t], a centred one includes both edges
+	outside := func(t, start time.Time) bool {
+		if align == WINDOW_ALIGN_CENTER {
+			return t.Before(start)
+		}
+		return !t.After(start)
+	}
+
+	l, h := 0, 0
+	for i := 0; i < n; i++ {
+		for l < i && outside(times[l], times[i].Add(-before)) {
+			l++
+		}
+		h = max(h, i)
+		for h+1 < n && !times[h+1].After(times[i].Add(after)) {
+			h++
+		}
+		lo[i], hi[i] = l, h
+	}
+
+	return lo, hi
+}
+
+func init() {
+	RegisterTransform(TransformDefinition{
+		Name:        "moving_average",
+		Label:       "moving average",
+		Description: `{"window": 10 or "30s", "align": "trailing" or "center"}`,
+		Build:       rollingBuilder(movingAverage),
+	})
+
+	RegisterTransform(TransformDefinition{
+		Name:        "rolling_std",
+		Label:       "rolling standard deviation",
+		Description: `{"window": 10 or "30s", "align": "trailing" or "center"}`,
+		Build:       rollingBuilder(rollingStd),
+	})
+
+	RegisterTransform(TransformDefinition{
+		Name:        "rolling_median",
+		Label:       "rolling median",
+		Description: `{"window": 10 or "30s", "align": "trailing" or "center"}`,
+		Build:       rollingBuilder(rollingMedian),
+	})
+
+	RegisterTransform(TransformDefinition{
+		Name:        "rolling_min",
+		Label:       "rolling minimum",
+		Description: `{"window": 10 or "30s", "align": "trailing" or "center"}`,
+		Build:       rollingBuilder(rollingExtreme(func(a, b float64) bool { return a <= b })),
+	})
+
+	RegisterTransform(TransformDefinition{
+		Name:        "rolling_max",
+		Label:       "rolling maximum",
+		Description: `{"window": 10 or "30s", "align": "trailing" or "center"}`,
+		Build:       rollingBuilder(rollingExtreme(func(a, b float64) bool { return a >= b })),
+	})
+
+	RegisterTransform(TransformDefinition{
+		Name:        "ema",
+		Label:       "exponential moving average",
+		Description: `{"window": 10 for a span in samples, or "30s" for a time constant}, always trailing`,
+		Build:       buildEMATransform,
+	})
+
+	RegisterTransform(TransformDefinition{
+		Name:        "savgol",
+		Label:       "Savitzky-Golay smoothing",
+		Description: `{"window": 11 or "30s", "order": 2}, the window is always centred`,
+		Build:       buildSavitzkyGolayTransform,
+	})
+}
+
+// rollingBuilder wraps a function over window bounds into a transform taking the standard window parameters
+func rollingBuilder(fn func(values []float64, lo, hi []int) []float64) func(json.RawMessage) (transformFunc, error) {
+	return func(params json.RawMessage) (transformFunc, error) {
+		var p rollingParams
+		err := decodeParams(params, &p)
+		if err != nil {
+			return nil, err
+		}
+		err = p.validate()
+		if err != nil {
+			return nil, err
+		}
+
+		return func(times []time.Time, values []float64) ([]time.Time, []float64, error) {
+			lo, hi := windowBounds(times, p.Window, p.Align)
+			return times, fn(values, lo, hi), nil
+		}, nil
+	}
+}
+
+// movingAverage uses a running sum so each window costs O(1)
+func movingAverage(values []float64, lo, hi []int) []float64 {
+	sum := make([]float64, len(values)+1)
+	for i, v := range values {
+		sum[i+1] = sum[i] + v
+	}
+
+	result := make([]float64, len(values))
+	for i := range values {
+		result[i] = (sum[hi[i]+1] - sum[lo[i]]) / float64(hi[i]-lo[i]+1)
+	}
+
+	return result
+}
+
+// rollingStd computes the sample standard deviation of each window.  The running sums are taken about the
+// first value to limit cancellation when the values sit far from zero, which is common for archived data.
+func rollingStd(values []float64, lo, hi []int) []float64 {
+	result := make([]float64, len(values))
+	if len(values) == 0 {
+		return result
+	}
+
+	shift := values[0]
+	sum := make([]float64, len(values)+1)
+	sumSq := make([]float64, len(values)+1)
+	for i, v := range values {
+		d := v - shift
+		sum[i+1] = sum[i] + d
+		sumSq[i+1] = sumSq[i] + d*d
+	}
+
+	for i := range values {
+		n := float64(hi[i] - lo[i] + 1)
+		if n < 2 {
+			result[i] = math.NaN()
+			continue
+		}
+
+		s := sum[hi[i]+1] - sum[lo[i]]
+		ss := sumSq[hi[i]+1] - sumSq[lo[i]]
+		variance := (ss - s*s/n) / (n - 1)
+		result[i] = math.Sqrt(math.Max(variance, 0))
+	}
+
+	return result
+}
+
+// rollingMedian keeps the window in a sorted slice, inserting and removing values as the window slides.
+// NaN samples have no place in the order, so they are left out of the window, one with nothing else in it
+// gives NaN.
+func rollingMedian(values []float64, lo, hi []int) []float64 {
+	result := make([]float64, len(values))
+	var window []float64
+	l, h := 0, -1
+
+	for i := range values {
+		for h < hi[i] {
+			h++
+			if math.IsNaN(values[h]) {
+				continue
+			}
+			j := sort.SearchFloat64s(window, values[h])
+			window = append(window, 0)
+			copy(window[j+1:], window[j:])
+			window[j] = values[h]
+		}
+		for l < lo[i] {
+			if !math.IsNaN(values[l]) {
+				j := sort.SearchFloat64s(window, values[l])
+				window = append(window[:j], window[j+1:]...)
+			}
+			l++
+		}
+
+		m := len(window)
+		switch {
+		case m == 0:
+			result[i] = math.NaN()
+		case m%2 == 1:
+			result[i] = window[m/2]
+		default:
+			result[i] = (window[m/2-1] + window[m/2]) / 2
+		}
+	}
+
+	return result
+}
+
+// rollingExtreme returns a rolling min or max using a monotonic queue of indices, keep decides which of
+// two values survives at the back of the queue
+func rollingExtreme(keep func(a, b float64) bool) func(values []float64, lo, hi []int) []float64 {
+	return func(values []float64, lo, hi []int) []float64 {
+		result := make([]float64, len(values))
+		var queue []int
+		h := -1
+
+		for i := range values {
+			for h < hi[i] {
+				h++
+				for len(queue) > 0 && keep(values[h], values[queue[len(queue)-1]]) {
+					queue = queue[:len(queue)-1]
+				}
+				queue = append(queue, h)
+			}
+			for queue[0] < lo[i] {
+				queue = queue[1:]
+			}
+			result[i] = values[queue[0]]
+		}
+
+		return result
+	}
+}
+
+// buildEMATransform computes an exponential moving average.  A sample window is a span with
+// alpha = 2/(N+1), a time window is a time constant so irregularly spaced samples are weighted correctly.
+func buildEMATransform(params json.RawMessage) (transformFunc, error) {
+	var p rollingParams
+	err := decodeParams(params, &p)
+	if err != nil {
+		return nil, err
+	}
+	if !p.Window.isSet() {
+		return nil, fmt.Errorf("a window is required")
+	}
+	// The average only ever looks back, so rather than quietly ignore an alignment it is refused
+	if p.Align != "" {
+		return nil, fmt.Errorf("the ema is always trailing, remove the align parameter")
+	}
+
+	return func(times []time.Time, values []float64) ([]time.Time, []float64, error) {
+		result := make([]float64, len(values))
+		if len(values) == 0 {
+			return times, result, nil
+		}
+
+		alpha := 2 / (float64(p.Window.samples) + 1)
+		result[0] = values[0]
+
+		for i := 1; i < len(values); i++ {
+			if p.Window.duration > 0 {
+				dt := times[i].Sub(times[i-1]).Seconds()
+				alpha = 1 - math.Exp(-dt/p.Window.duration.Seconds())
+			}
+			result[i] = result[i-1] + alpha*(values[i]-result[i-1])
+		}
+
+		return times, result, nil
+	}, nil
+}
+
+// buildSavitzkyGolayTransform fits a polynomial by least squares over a centred window around each sample
+// and takes its value at the sample.  The fit uses the actual sample times, so for evenly spaced data this
+// is the classic Savitzky–Golay filter and for irregular archive data it remains correct.
+func buildSavitzkyGolayTransform(params json.RawMessage) (transformFunc, error) {
+	p := struct {
+		Window transformWindow `json:"window"`
+		Order  int             `json:"order"`
+	}{Order: 2}
+
+	err := decodeParams(params, &p)
+	if err != nil {
+		return nil, err
+	}
+	if !p.Window.isSet() {
+		return nil, fmt.Errorf("a window is required")
+	}
+	if p.Order < 0 || p.Order > 6 {
+		return nil, fmt.Errorf("order must be between 0 and 6")
+	}
+	if p.Window.samples > 0 && p.Window.samples <= p.Order {
+		return nil, fmt.Errorf("window must be larger than the order")
+	}
+
+	return func(times []time.Time, values []float64) ([]time.Time, []float64, error) {
+		lo, hi := windowBounds(times, p.Window, WINDOW_ALIGN_CENTER)
+		result := make([]float64, len(values))
+
+		for i := range values {
+			result[i] = localPolynomialFit(times, values, lo[i], hi[i], i, p.Order)
+		}
+
+		return times, result, nil
+	}, nil
+}
+
+// localPolynomialFit fits values[lo..hi] against time and returns the fitted value at sample at.  Times are
+// scaled to the window half-width to keep the normal equations well conditioned.  If the window holds too
+// few samples for the order requested, the order is reduced.
+func localPolynomialFit(times []time.Time, values []float64, lo, hi, at, order int) float64 {
+	order = min(order, hi-lo)
+	if order <= 0 {
+		sum := 0.0
+		for j := lo; j <= hi; j++ {
+			sum += values[j]
+		}
+		return sum / float64(hi-lo+1)
+	}
+
+	scale := math.Max(times[hi].Sub(times[at]).Seconds(), times[at].Sub(times[lo]).Seconds())
+	if scale == 0 {
+		scale = 1
+	}
+
+	// Build the normal equations A c = b for the polynomial coefficients c
+	m := order + 1
+	a := make([][]float64, m)
+	for r := range a {
+		a[r] = make([]float64, m+1)
+	}
+
+	powers := make([]float64, 2*m-1)
+	for j := lo; j <= hi; j++ {
+		x := times[j].Sub(times[at]).Seconds() / scale
+		powers[0] = 1
+		for k := 1; k < len(powers); k++ {
+			powers[k] = powers[k-1] * x
+		}
+		for r := 0; r < m; r++ {
+			for c := 0; c < m; c++ {
+				a[r][c] += powers[r+c]
+			}
+			a[r][m] += powers[r] * values[j]
+		}
+	}
+
+	coefficients, ok := solveLinearSystem(a)
+	if !ok {
+		return values[at]
+	}
+
+	// The sample sits at x = 0, so the fitted value is the constant term
+	return coefficients[0]
+}
+
+// solveLinearSystem solves an augmented matrix by Gaussian elimination with partial pivoting
+func solveLinearSystem(a [][]float64) ([]float64, bool) {
+	m := len(a)
+
+	for col := 0; col < m; col++ {
+		pivot := col
+		for r := col + 1; r < m; r++ {
+			if math.Abs(a[r][col]) > math.Abs(a[pivot][col]) {
+				pivot = r
+			}
+		}
+		if math.Abs(a[pivot][col]) < 1e-12 {
+			return nil, false
+		}
+		a[col], a[pivot] = a[pivot], a[col]
+
+		for r := col + 1; r < m; r++ {
+			f := a[r][col] / a[col][col]
+			for c := col; c <= m; c++ {
+				a[r][c] -= f * a[col][c]
+			}
+		}
+	}
+
+	x := make([]float64, m)
+	for r := m - 1; r >= 0; r-- {
+		sum := a[r][m]
+		for c := r + 1; c < m; c++ {
+			sum -= a[r][c] * x[c]
+		}
+		x[r] = sum / a[r][r]
+	}
+
+	return x, true
+}
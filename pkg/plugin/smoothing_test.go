@@ -0,0 +1,106 @@
+package plugin
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+)
+
+func TestSmoothing(t *testing.T) {
+	// Unevenly spaced so that the duration windows differ from the sample count windows
+	times := secondsSeries(0, 1, 2, 5, 6)
+	values := []float64{1, 3, 2, 8, 4}
+	squares := []float64{0, 1, 4, 25, 36}
+	nan := math.NaN()
+
+	cases := []struct {
+		name     string
+		params   string
+		values   []float64
+		expected []float64
+	}{
+		// Three samples trailing: [1] [1 3] [1 3 2] [3 2 8] [2 8 4]
+		{"moving_average", `{"window": 3}`, values, []float64{1, 2, 2, 13.0 / 3, 14.0 / 3}},
+		{"rolling_median", `{"window": 3}`, values, []float64{1, 2, 2, 3, 4}},
+		{"rolling_min", `{"window": 3}`, values, []float64{1, 1, 1, 2, 2}},
+		{"rolling_max", `{"window": 3}`, values, []float64{1, 3, 3, 8, 8}},
+		{"rolling_std", `{"window": 3}`, values,
+			[]float64{nan, math.Sqrt(2), 1, math.Sqrt(93.0 / 9), math.Sqrt(84.0 / 9)}},
+		// Three samples centred: [1 3] [1 3 2] [3 2 8] [2 8 4] [8 4]
+		{"moving_average", `{"window": 3, "align": "center"}`, values, []float64{2, 2, 13.0 / 3, 14.0 / 3, 6}},
+		{"rolling_median", `{"window": 3, "align": "center"}`, values, []float64{2, 2, 3, 4, 6}},
+
+		// Two seconds trailing, (t-2s, t]: [1] [1 3] [3 2] [8] [8 4]
+		{"moving_average", `{"window": "2s"}`, values, []float64{1, 2, 2.5, 8, 6}},
+		{"rolling_median", `{"window": "2s"}`, values, []float64{1, 2, 2.5, 8, 6}},
+		{"rolling_min", `{"window": "2s"}`, values, []float64{1, 1, 2, 8, 4}},
+		{"rolling_max", `{"window": "2s"}`, values, []float64{1, 3, 3, 8, 8}},
+		{"rolling_std", `{"window": "2s"}`, values, []float64{nan, math.Sqrt(2), math.Sqrt(0.5), nan, math.Sqrt(8)}},
+		// Two seconds centred, [t-1s, t+1s]: [1 3] [1 3 2] [3 2] [8 4] [8 4]
+		{"moving_average", `{"window": "2s", "align": "center"}`, values, []float64{2, 2, 2.5, 6, 6}},
+		{"rolling_max", `{"window": "2s", "align": "center"}`, values, []float64{3, 3, 3, 8, 8}},
+
+		// A span of three samples is alpha = 0.5
+		{"ema", `{"window": 3}`, values, []float64{1, 2, 2, 5, 4.5}},
+		// A time constant weights each step by 1 - exp(-dt/tau)
+		{"ema", `{"window": "1s"}`, values,
+			[]float64{1, 2.2642411176571153, 2.097208874698217, 7.70611733468338, 5.363404373999117}},
+
+		// A quadratic fit reproduces a quadratic exactly, whatever the spacing
+		{"savgol", `{"window": 3, "order": 2}`, squares, squares},
+		{"savgol", `{"window": "4s", "order": 2}`, squares, squares},
+		// Order zero is the centred mean
+		{"savgol", `{"window": 3, "order": 0}`, values, []float64{2, 2, 13.0 / 3, 14.0 / 3, 6}},
+	}
+
+	for _, c := range cases {
+		gotTimes, got := runTransform(t, c.name, c.params, times, c.values)
+		if len(gotTimes) != len(times) {
+			t.Fatalf("%s %s: expected %d times, got %d", c.name, c.params, len(times), len(gotTimes))
+		}
+		if !sameValues(got, c.expected, 1e-9) {
+			t.Fatalf("%s %s: expected %v, got %v", c.name, c.params, c.expected, got)
+		}
+	}
+}
+
+func TestSmoothingMedianNaN(t *testing.T) {
+	// "nan" is a valid archived value, a NaN in the window must not upset the sorted window
+	times := secondsSeries(0, 1, 2, 3, 4, 5)
+	values := []float64{1, math.NaN(), 3, math.NaN(), math.NaN(), 5}
+
+	_, got := runTransform(t, "rolling_median", `{"window": 2}`, times, values)
+	expected := []float64{1, 1, 3, 3, math.NaN(), 5}
+	if !sameValues(got, expected, 0) {
+		t.Fatalf("expected %v, got %v", expected, got)
+	}
+
+	_, got = runTransform(t, "rolling_median", `{"window": "10s", "align": "center"}`, times, values)
+	expected = []float64{3, 3, 3, 3, 3, 3}
+	if !sameValues(got, expected, 0) {
+		t.Fatalf("expected %v, got %v", expected, got)
+	}
+}
+
+func TestSmoothingParams(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		params string
+	}{
+		{"moving_average", `{}`},
+		{"moving_average", `{"window": 0}`},
+		{"moving_average", `{"window": 2.5}`},
+		{"moving_average", `{"window": "-5s"}`},
+		{"rolling_std", `{"window": 3, "align": "leading"}`},
+		{"ema", `{}`},
+		{"ema", `{"window": 3, "align": "center"}`},
+		{"ema", `{"window": "30s", "align": "trailing"}`},
+		{"savgol", `{"window": 2, "order": 2}`},
+		{"savgol", `{"window": 11, "order": 7}`},
+	} {
+		_, err := newTransformPipeline([]TransformStep{{Name: c.name, Params: json.RawMessage(c.params)}})
+		if err == nil {
+			t.Fatalf("%s %s: expected an error", c.name, c.params)
+		}
+	}
+}
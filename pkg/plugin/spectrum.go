@@ -0,0 +1,369 @@
+package plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/bits"
+	"math/cmplx"
+	"sort"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// spectrumFunc ends a transform pipeline by turning the series into a frequency spectrum
+type spectrumFunc func(times []time.Time, values []float64) (frequencies []float64, power []float64, err error)
+
+// The largest number of points the series may be resampled to, this bounds the memory used by the FFT
+const SPECTRUM_MAX_POINTS = 1 << 22
+
+// The highest sampleRate accepted, sample times are only kept to the nanosecond so anything faster is meaningless
+const SPECTRUM_MAX_RATE = 1e9
+
+type spectrumParams struct {
+	// "welch" averages windowed segments, "fft" takes the periodogram of the whole series as one segment
+	Method string `json:"method"`
+
+	// Window function applied to each segment: hann, hamming, blackman or rect
+	Window string `json:"window"`
+
+	// Samples per Welch segment, rounded up to a power of two
+	Segment int `json:"segment"`
+
+	// Fraction of each segment that overlaps the next
+	Overlap *float64 `json:"overlap"`
+
+	// Rate in Hz to resample to, by default the median sample rate of the series
+	SampleRate float64 `json:"sampleRate"`
+
+	// "density" gives units²/Hz, "spectrum" gives units²
+	Scaling string `json:"scaling"`
+
+	// Trend removed from each segment: mean, linear or none
+	Detrend string `json:"detrend"`
+}
+
+func init() {
+	RegisterTransform(TransformDefinition{
+		Name:          "spectrum",
+		Label:         "power spectrum",
+		Description:   `{"method": "welch" or "fft", "window": "hann", "segment": 1024, "overlap": 0.5, "sampleRate": 100, "scaling": "density" or "spectrum", "detrend": "mean"}, must be the last step`,
+		BuildSpectrum: buildSpectrumTransform,
+	})
+}
+
+// buildSpectrumTransform resamples the series to a uniform rate and computes its power spectral density
+func buildSpectrumTransform(params json.RawMessage) (spectrumFunc, error) {
+	p := spectrumParams{
+		Method:  "welch",
+		Window:  "hann",
+		Segment: 1024,
+		Scaling: "density",
+		Detrend: "mean",
+	}
+
+	err := decodeParams(params, &p)
+	if err != nil {
+		return nil, err
+	}
+
+	switch p.Method {
+	case "welch", "fft":
+	default:
+		return nil, fmt.Errorf("unknown spectrum method: %s", p.Method)
+	}
+
+	if _, err = windowFunction(p.Window, 8); err != nil {
+		return nil, err
+	}
+
+	if p.Segment < 8 || p.Segment > SPECTRUM_MAX_POINTS {
+		return nil, fmt.Errorf("segment must be between 8 and %d samples", SPECTRUM_MAX_POINTS)
+	}
+	p.Segment = nextPowerOfTwo(p.Segment)
+
+	overlap := 0.5
+	if p.Overlap != nil {
+		overlap = *p.Overlap
+	}
+	if overlap < 0 || overlap >= 1 {
+		return nil, fmt.Errorf("overlap must be at least 0 and less than 1")
+	}
+
+	if p.SampleRate < 0 || p.SampleRate > SPECTRUM_MAX_RATE || math.IsNaN(p.SampleRate) {
+		return nil, fmt.Errorf("sampleRate must be between 0 and %g Hz", float64(SPECTRUM_MAX_RATE))
+	}
+
+	switch p.Scaling {
+	case "density", "spectrum":
+	default:
+		return nil, fmt.Errorf("unknown spectrum scaling: %s", p.Scaling)
+	}
+
+	switch p.Detrend {
+	case "mean", "linear", "none":
+	default:
+		return nil, fmt.Errorf("unknown detrend: %s", p.Detrend)
+	}
+
+	return func(times []time.Time, values []float64) ([]float64, []float64, error) {
+		if len(values) < 2 {
+			return []float64{}, []float64{}, nil
+		}
+
+		rate := p.SampleRate
+		if rate == 0 {
+			rate = medianSampleRate(times)
+			if rate == 0 {
+				return nil, nil, fmt.Errorf("cannot determine a sample rate, give sampleRate explicitly")
+			}
+		}
+
+		uniform, err := resampleUniform(times, values, rate)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		// The periodogram is a single segment covering the whole series
+		segment, step := p.Segment, int(float64(p.Segment)*(1-overlap))
+		if p.Method == "fft" || segment > len(uniform) {
+			segment = nextPowerOfTwo(len(uniform))
+			step = segment
+		}
+		step = max(step, 1)
+
+		return welch(uniform, rate, segment, step, p.Window, p.Detrend, p.Scaling == "density")
+	}, nil
+}
+
+// spectrumFrame builds the frequency versus power frame returned in place of the time series
+func spectrumFrame(qm queryModel, key string, frequencies []float64, power []float64) *data.Frame {
+	frame := data.NewFrame("response")
+	frame.RefID = qm.RefId
+	frame.Name = qm.seriesName(key)
+
+	// Frequency goes first so that panels plot it along the x axis
+	frequency := data.NewField("frequency", nil, frequencies)
+	frequency.Config = &data.FieldConfig{Unit: "hertz"}
+
+	frame.Fields = append(frame.Fields, frequency)
+	frame.Fields = append(frame.Fields, data.NewField("", nil, power))
+
+	return frame
+}
+
+// medianSampleRate estimates the rate of a series from the median spacing of its samples
+func medianSampleRate(times []time.Time) float64 {
+	spacing := make([]float64, 0, len(times)-1)
+	for i := 1; i < len(times); i++ {
+		dt := times[i].Sub(times[i-1]).Seconds()
+		if dt > 0 {
+			spacing = append(spacing, dt)
+		}
+	}
+	if len(spacing) == 0 {
+		return 0
+	}
+
+	sort.Float64s(spacing)
+	return 1 / spacing[len(spacing)/2]
+}
+
+// resampleUniform linearly interpolates the series onto an evenly spaced grid at the given rate
+func resampleUniform(times []time.Time, values []float64, rate float64) ([]float64, error) {
+	span := times[len(times)-1].Sub(times[0]).Seconds()
+
+	// Count the points as a float first, a long span at a high rate would overflow the int
+	points := math.Floor(span*rate) + 1
+	if !(points <= SPECTRUM_MAX_POINTS) {
+		return nil, fmt.Errorf("resampling %.0fs at %gHz needs %.0f points, the limit is %d", span, rate, points,
+			SPECTRUM_MAX_POINTS)
+	}
+	n := int(points)
+
+	uniform := make([]float64, n)
+	j := 0
+	for i := range uniform {
+		t := times[0].Add(time.Duration(float64(i) / rate * 1e9))
+
+		// Advance to the pair of samples straddling t
+		for j+1 < len(times)-1 && times[j+1].Before(t) {
+			j++
+		}
+
+		t0, t1 := times[j], times[j+1]
+		dt := t1.Sub(t0).Seconds()
+		if dt <= 0 {
+			uniform[i] = values[j+1]
+			continue
+		}
+
+		f := math.Min(math.Max(t.Sub(t0).Seconds()/dt, 0), 1)
+		uniform[i] = values[j] + f*(values[j+1]-values[j])
+	}
+
+	return uniform, nil
+}
+
+// welch averages the one-sided power of windowed, overlapping segments.  Segments shorter than the
+// segment length (only possible for the periodogram) are zero padded.
+func welch(x []float64, rate float64, segment, step int, window, detrend string, density bool) ([]float64, []float64, error) {
+	w, err := windowFunction(window, min(segment, len(x)))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Normalisation of the window, either by its power (density) or its coherent gain (spectrum)
+	var sumW, sumW2 float64
+	for _, v := range w {
+		sumW += v
+		sumW2 += v * v
+	}
+	scale := 1 / (sumW * sumW)
+	if density {
+		scale = 1 / (rate * sumW2)
+	}
+
+	bins := segment/2 + 1
+	power := make([]float64, bins)
+	buffer := make([]complex128, segment)
+	segments := 0
+
+	for start := 0; start+len(w) <= len(x); start += step {
+		part := detrendSegment(x[start:start+len(w)], detrend)
+
+		for i := range buffer {
+			buffer[i] = 0
+		}
+		for i, v := range part {
+			buffer[i] = complex(v*w[i], 0)
+		}
+
+		fft(buffer)
+
+		for k := 0; k < bins; k++ {
+			power[k] += real(buffer[k] * cmplx.Conj(buffer[k]))
+		}
+		segments++
+	}
+
+	frequencies := make([]float64, bins)
+	for k := range power {
+		power[k] *= scale / float64(segments)
+
+		// Fold the negative frequencies into the one-sided spectrum, except at DC and Nyquist
+		if k > 0 && !(segment%2 == 0 && k == bins-1) {
+			power[k] *= 2
+		}
+
+		frequencies[k] = float64(k) * rate / float64(segment)
+	}
+
+	return frequencies, power, nil
+}
+
+// detrendSegment returns a copy of the segment with its mean or least-squares line removed
+func detrendSegment(x []float64, detrend string) []float64 {
+	out := append([]float64(nil), x...)
+	n := float64(len(x))
+
+	switch detrend {
+	case "mean":
+		mean := 0.0
+		for _, v := range x {
+			mean += v
+		}
+		mean /= n
+		for i := range out {
+			out[i] -= mean
+		}
+
+	case "linear":
+		var sx, sy, sxx, sxy float64
+		for i, v := range x {
+			fi := float64(i)
+			sx += fi
+			sy += v
+			sxx += fi * fi
+			sxy += fi * v
+		}
+		denominator := n*sxx - sx*sx
+		if denominator == 0 {
+			return out
+		}
+		slope := (n*sxy - sx*sy) / denominator
+		intercept := (sy - slope*sx) / n
+		for i := range out {
+			out[i] -= intercept + slope*float64(i)
+		}
+	}
+
+	return out
+}
+
+// windowFunction returns the named window with n points
+func windowFunction(name string, n int) ([]float64, error) {
+	w := make([]float64, n)
+	if n == 1 {
+		w[0] = 1
+		return w, nil
+	}
+
+	for i := range w {
+		x := 2 * math.Pi * float64(i) / float64(n-1)
+		switch name {
+		case "hann":
+			w[i] = 0.5 - 0.5*math.Cos(x)
+		case "hamming":
+			w[i] = 0.54 - 0.46*math.Cos(x)
+		case "blackman":
+			w[i] = 0.42 - 0.5*math.Cos(x) + 0.08*math.Cos(2*x)
+		case "rect":
+			w[i] = 1
+		default:
+			return nil, fmt.Errorf("unknown window function: %s", name)
+		}
+	}
+
+	return w, nil
+}
+
+// nextPowerOfTwo rounds n up to a power of two
+func nextPowerOfTwo(n int) int {
+	if n <= 1 {
+		return 1
+	}
+	return 1 << bits.Len(uint(n-1))
+}
+
+// fft is an in-place iterative radix-2 Cooley–Tukey transform, the length must be a power of two
+func fft(a []complex128) {
+	n := len(a)
+
+	// Bit reversal permutation
+	for i, j := 1, 0; i < n; i++ {
+		bit := n >> 1
+		for ; j&bit != 0; bit >>= 1 {
+			j ^= bit
+		}
+		j ^= bit
+		if i < j {
+			a[i], a[j] = a[j], a[i]
+		}
+	}
+
+	for size := 2; size <= n; size <<= 1 {
+		step := cmplx.Exp(complex(0, -2*math.Pi/float64(size)))
+		for start := 0; start < n; start += size {
+			w := complex(1, 0)
+			for k := 0; k < size/2; k++ {
+				u := a[start+k]
+				v := a[start+k+size/2] * w
+				a[start+k] = u + v
+				a[start+k+size/2] = u - v
+				w *= step
+			}
+		}
+	}
+}
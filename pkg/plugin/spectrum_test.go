@@ -0,0 +1,201 @@
+package plugin
+
+import (
+	"encoding/json"
+	"math"
+	"math/cmplx"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// runSpectrum builds the spectrum step with the given parameters and runs it over the series
+func runSpectrum(t *testing.T, params string, times []time.Time, values []float64) ([]float64, []float64) {
+	t.Helper()
+
+	fn, err := buildSpectrumTransform(json.RawMessage(params))
+	if err != nil {
+		t.Fatalf("%s: %v", params, err)
+	}
+	frequencies, power, err := fn(times, values)
+	if err != nil {
+		t.Fatalf("%s: %v", params, err)
+	}
+	if len(frequencies) != len(power) {
+		t.Fatalf("%s: %d frequencies for %d powers", params, len(frequencies), len(power))
+	}
+	return frequencies, power
+}
+
+// sampledSeries samples fn at rate Hz for n samples
+func sampledSeries(n int, rate float64, fn func(t float64) float64) ([]time.Time, []float64) {
+	seconds := make([]float64, n)
+	values := make([]float64, n)
+	for i := range seconds {
+		seconds[i] = float64(i) / rate
+		values[i] = fn(seconds[i])
+	}
+	return secondsSeries(seconds...), values
+}
+
+func peakFrequency(frequencies []float64, power []float64) float64 {
+	peak := 0
+	for k := range power {
+		if power[k] > power[peak] {
+			peak = k
+		}
+	}
+	return frequencies[peak]
+}
+
+func TestSpectrumPeak(t *testing.T) {
+	// 12.5Hz falls on a bin of the default 1024 sample segment at 100Hz
+	times, values := sampledSeries(4096, 100, func(t float64) float64 { return 2 + math.Sin(2*math.Pi*12.5*t) })
+
+	for _, params := range []string{
+		`{}`,
+		`{"window": "hamming"}`,
+		`{"window": "blackman"}`,
+		`{"window": "rect"}`,
+		`{"method": "fft"}`,
+		`{"segment": 256, "overlap": 0}`,
+		`{"sampleRate": 50}`,
+	} {
+		frequencies, power := runSpectrum(t, params, times, values)
+		df := frequencies[1] - frequencies[0]
+		if f := peakFrequency(frequencies, power); math.Abs(f-12.5) > df {
+			t.Fatalf("%s: expected the peak at 12.5Hz, got %gHz", params, f)
+		}
+	}
+
+	// The periodogram covers the whole series in one segment
+	frequencies, _ := runSpectrum(t, `{"method": "fft"}`, times, values)
+	if len(frequencies) != 4096/2+1 {
+		t.Fatalf("expected %d periodogram bins, got %d", 4096/2+1, len(frequencies))
+	}
+}
+
+func TestSpectrumScaling(t *testing.T) {
+	// One sample a second, so the resampled series is exactly the input
+	random := rand.New(rand.NewSource(1))
+	times, values := sampledSeries(256, 1, func(float64) float64 { return random.NormFloat64() })
+
+	// Parseval: the density integrates to the mean square of the series
+	frequencies, power := runSpectrum(t, `{"method": "fft", "window": "rect", "detrend": "none"}`, times, values)
+	meanSquare := 0.0
+	for _, v := range values {
+		meanSquare += v * v / float64(len(values))
+	}
+	total := 0.0
+	for _, p := range power {
+		total += p * (frequencies[1] - frequencies[0])
+	}
+	if math.Abs(total-meanSquare) > 1e-9*meanSquare {
+		t.Fatalf("expected the density to integrate to %g, got %g", meanSquare, total)
+	}
+
+	// A sine of amplitude A on a bin has A²/2 of power there on the spectrum scaling
+	times, values = sampledSeries(256, 1, func(t float64) float64 { return 3 * math.Sin(2*math.Pi*16*t/256) })
+	_, power = runSpectrum(t, `{"method": "fft", "window": "rect", "detrend": "none", "scaling": "spectrum"}`,
+		times, values)
+	if math.Abs(power[16]-4.5) > 1e-9 {
+		t.Fatalf("expected 4.5 at the sine's bin, got %g", power[16])
+	}
+}
+
+func TestSpectrumDetrend(t *testing.T) {
+	times, values := sampledSeries(256, 1, func(t float64) float64 { return 10 + 0.5*t })
+
+	// A straight line is removed completely by a linear detrend
+	_, power := runSpectrum(t, `{"method": "fft", "window": "rect", "detrend": "linear"}`, times, values)
+	for k, p := range power {
+		if p > 1e-12 {
+			t.Fatalf("expected no power left after a linear detrend, got %g at bin %d", p, k)
+		}
+	}
+
+	// Removing the mean leaves nothing at DC but the slope remains
+	_, power = runSpectrum(t, `{"method": "fft", "window": "rect", "detrend": "mean"}`, times, values)
+	if power[0] > 1e-12 || power[1] < 1 {
+		t.Fatalf("expected no DC and power at the low bins after removing the mean, got %g and %g", power[0], power[1])
+	}
+
+	_, power = runSpectrum(t, `{"method": "fft", "window": "rect", "detrend": "none"}`, times, values)
+	if power[0] < 1 {
+		t.Fatalf("expected DC power without detrending, got %g", power[0])
+	}
+
+	out := detrendSegment([]float64{1, 2, 3, 4}, "none")
+	if !sameValues(out, []float64{1, 2, 3, 4}, 0) {
+		t.Fatalf("expected none to leave the segment unchanged, got %v", out)
+	}
+}
+
+func TestSpectrumWindows(t *testing.T) {
+	for name, expected := range map[string][]float64{
+		"hann":     {0, 0.5, 1, 0.5, 0},
+		"hamming":  {0.08, 0.54, 1, 0.54, 0.08},
+		"blackman": {0, 0.34, 1, 0.34, 0},
+		"rect":     {1, 1, 1, 1, 1},
+	} {
+		w, err := windowFunction(name, 5)
+		if err != nil || !sameValues(w, expected, 1e-12) {
+			t.Fatalf("%s: expected %v, got %v, %v", name, expected, w, err)
+		}
+	}
+
+	if _, err := windowFunction("kaiser", 5); err == nil {
+		t.Fatalf("expected an unknown window to fail")
+	}
+}
+
+func TestFFT(t *testing.T) {
+	// Compare against the definition of the DFT
+	input := []complex128{1, 2, -1, 0.5, 3, -2, 0, 1}
+	a := append([]complex128(nil), input...)
+	fft(a)
+
+	n := len(input)
+	for k := 0; k < n; k++ {
+		var expected complex128
+		for j, x := range input {
+			expected += x * cmplx.Exp(complex(0, -2*math.Pi*float64(j*k)/float64(n)))
+		}
+		if cmplx.Abs(a[k]-expected) > 1e-9 {
+			t.Fatalf("bin %d: expected %v, got %v", k, expected, a[k])
+		}
+	}
+}
+
+func TestSpectrumParams(t *testing.T) {
+	for _, params := range []string{
+		`{"method": "lombscargle"}`,
+		`{"window": "kaiser"}`,
+		`{"segment": 4}`,
+		`{"overlap": 1}`,
+		`{"sampleRate": -1}`,
+		`{"sampleRate": 1e300}`,
+		`{"scaling": "amplitude"}`,
+		`{"detrend": "quadratic"}`,
+	} {
+		if _, err := buildSpectrumTransform(json.RawMessage(params)); err == nil {
+			t.Fatalf("%s: expected an error", params)
+		}
+	}
+
+	// Too many points is an error rather than an overflow, however large the rate
+	times := secondsSeries(0, 1e6)
+	for _, rate := range []float64{SPECTRUM_MAX_RATE, 1e300, math.Inf(1)} {
+		if _, err := resampleUniform(times, []float64{0, 1}, rate); err == nil {
+			t.Fatalf("%g Hz: expected too many points to fail", rate)
+		}
+	}
+
+	fn, err := buildSpectrumTransform(json.RawMessage(`{"sampleRate": 1e9}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = fn(times, []float64{0, 1}); err == nil {
+		t.Fatalf("expected too many points to fail")
+	}
+}
@@ -0,0 +1,395 @@
+package plugin
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	_ "modernc.org/sqlite"
+)
+
+// sqlStore reads the KTL keyword archive from Postgres, or the same layout in a SQLite file.  The
+// connection pool is opened once per datasource instance rather than per request.
+type sqlStore struct {
+	db        *sql.DB
+	schema    ArchiveSchema
+	metaTable string
+
+	// BACKEND_POSTGRES or BACKEND_SQLITE, for the few queries that differ between them
+	backend string
+
+	// SQLite has no timestamp type, timestamptz columns hold UTC text in SQLite's own format instead
+	textTimes bool
+}
+
+// The text form of times in a SQLite timestamptz column, which sorts in time order
+const SQLITE_TIME_FORMAT = "2006-01-02 15:04:05.999999"
+
+func newPostgresStore(settings *DatasourceSettings) (*sqlStore, error) {
+	// Build the connection string
+	psqlInfo := fmt.Sprintf("host=%s port=%s user=%s dbname=%s sslmode=disable",
+		settings.Server, settings.Port, settings.Role, settings.Database)
+
+	// Open the Postgres interface, this does not connect until the first query
+	db, err := sql.Open("postgres", psqlInfo)
+	if err != nil {
+		return nil, fmt.Errorf("failure to open SQL driver: %w", err)
+	}
+
+	return &sqlStore{
+		db:        db,
+		schema:    settings.Schema,
+		metaTable: settings.MetaTable,
+		backend:   BACKEND_POSTGRES,
+	}, nil
+}
+
+func newSQLiteStore(settings *DatasourceSettings) (*sqlStore, error) {
+	if settings.Path == "" {
+		return nil, fmt.Errorf("the sqlite archive needs a file path")
+	}
+
+	// Check the file is there, otherwise SQLite would quietly create an empty database
+	_, err := os.Stat(settings.Path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open the archive file: %w", err)
+	}
+
+	// The archive is only ever read, and a test stand may still be logging to it
+	dsn := (&url.URL{
+		Scheme:   "file",
+		Path:     settings.Path,
+		RawQuery: "mode=ro&_pragma=busy_timeout(5000)",
+	}).String()
+
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failure to open SQL driver: %w", err)
+	}
+
+	return &sqlStore{
+		db:        db,
+		schema:    settings.Schema,
+		metaTable: settings.MetaTable,
+		backend:   BACKEND_SQLITE,
+		textTimes: true,
+	}, nil
+}
+
+func (s *sqlStore) Services(ctx context.Context) ([]string, error) {
+	// Retrieve the services, all of them, 106 on 2020-06-09
+	return s.queryStrings(ctx, "services", s.schema.servicesQuery(s.metaTable))
+}
+
+func (s *sqlStore) Keywords(ctx context.Context, service string) ([]string, error) {
+	return s.queryStrings(ctx, "keywords", s.schema.keywordsQuery(s.metaTable), service)
+}
+
+// startStatement starts the span of a SQL statement, named for what it reads
+func (s *sqlStore) startStatement(ctx context.Context, name string, statement string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	system := "postgresql"
+	if s.backend == BACKEND_SQLITE {
+		system = "sqlite"
+	}
+
+	return startSpan(ctx, "sql "+name, append(attrs, ATTR_DB_SYSTEM.String(system), ATTR_DB_STATEMENT.String(statement))...)
+}
+
+// queryStrings runs a query returning a single text column
+func (s *sqlStore) queryStrings(ctx context.Context, name string, query string, args ...interface{}) (list []string, err error) {
+	ctx, span := s.startStatement(ctx, name, query)
+	defer func() {
+		span.SetAttributes(ATTR_ROWS.Int(len(list)))
+		endSpan(span, err)
+	}()
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list = []string{}
+	var value string
+	for rows.Next() {
+		err = rows.Scan(&value)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, value)
+	}
+
+	err = rows.Err()
+	return list, err
+}
+
+func (s *sqlStore) Samples(ctx context.Context, service string, keyword string, from time.Time, to time.Time) ([]time.Time, []string, error) {
+	// Retrieve the values from the keyword archiver in the archive's time representation
+	schema := &s.schema
+	from_u := s.timeArg(from)
+	to_u := s.timeArg(to)
+
+	// Build a SQL query for just counting, the schema quotes the table name in case of SQL injection attack
+	sql_count := schema.countQuery(service)
+
+	// Run the query once to see how many we are going to get back
+	attrs := []attribute.KeyValue{ATTR_DB_TABLE.String(schema.table(service)), ATTR_KEYWORD.String(keyword)}
+	countCtx, span := s.startStatement(ctx, "count", sql_count, attrs...)
+	row := s.db.QueryRowContext(countCtx, sql_count, keyword, from_u, to_u)
+
+	// Get the count value out of the query result
+	var count int32
+	err := row.Scan(&count)
+	span.SetAttributes(ATTR_ROWS.Int(int(count)))
+	endSpan(span, err)
+
+	switch err {
+	case sql.ErrNoRows:
+		logger(ctx).Warn(fl()+"count query returned no rows", "table", schema.table(service))
+
+		// Send back an empty series since there's no data to be had
+		return []time.Time{}, []string{}, nil
+
+	case nil:
+		logger(ctx).Debug(fl()+"query yielded rows", "rows", count)
+
+	default:
+		logger(ctx).Error(fl()+"count query failed", "table", schema.table(service), "error", err)
+		return nil, nil, err
+	}
+
+	// Setup and perform the query for the real data set now
+	samplesQuery := schema.samplesQuery(service)
+	ctx, span = s.startStatement(ctx, "samples", samplesQuery, attrs...)
+	defer func() { endSpan(span, err) }()
+
+	rows, err := s.db.QueryContext(ctx, samplesQuery, keyword, from_u, to_u)
+	if err != nil {
+		logger(ctx).Error(fl()+"query retrieval error", "table", schema.table(service), "error", err)
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	// Store times and values here first
+	times := make([]time.Time, 0, count)
+	values := make([]string, 0, count)
+
+	// Iterate only as many rows as predicted, it's possible more rows arrived after the initial query executed!
+	var timestamp time.Time
+	var valtemp string
+	for i := int32(0); i < count && rows.Next(); i++ {
+		timestamp, valtemp, err = s.scanSample(rows)
+		if err != nil {
+			logger(ctx).Error(fl()+"query scan error", "table", schema.table(service), "error", err)
+			return nil, nil, err
+		}
+
+		times = append(times, timestamp)
+		values = append(values, valtemp)
+	}
+
+	// Get any error encountered during iteration of the SQL result
+	err = rows.Err()
+	if err != nil {
+		logger(ctx).Error(fl()+"query row error", "table", schema.table(service), "error", err)
+		return nil, nil, fmt.Errorf("row query error: %w", err)
+	}
+
+	return times, values, nil
+}
+
+// timeArg converts a time into the argument the time column is compared against
+func (s *sqlStore) timeArg(t time.Time) interface{} {
+	if s.textTimes && s.schema.TimeFormat == TIME_FORMAT_TIMESTAMPTZ {
+		return t.UTC().Format(SQLITE_TIME_FORMAT)
+	}
+	return s.schema.timeArg(t)
+}
+
+// scanSample scans a time and value row, the time is scanned according to how the archive stores it
+func (s *sqlStore) scanSample(row interface{ Scan(...interface{}) error }) (time.Time, string, error) {
+	// Temporary variables, the time is scanned as one or the other
+	var timetemp float64
+	var timestamp time.Time
+	var timetext string
+	var valtemp string
+	var err error
+
+	if s.schema.TimeFormat == TIME_FORMAT_TIMESTAMPTZ && s.textTimes {
+		err = row.Scan(&timetext, &valtemp)
+		if err == nil {
+			timestamp, err = time.Parse(SQLITE_TIME_FORMAT, timetext)
+		}
+	} else if s.schema.TimeFormat == TIME_FORMAT_TIMESTAMPTZ {
+		err = row.Scan(&timestamp, &valtemp)
+	} else {
+		err = row.Scan(&timetemp, &valtemp)
+		timestamp = s.schema.timeFromNumber(timetemp)
+	}
+
+	return timestamp, valtemp, err
+}
+
+func (s *sqlStore) Latest(ctx context.Context, service string, keyword string, before time.Time) (time.Time, string, bool, error) {
+	query := s.schema.latestQuery(service)
+	ctx, span := s.startStatement(ctx, "latest", query, ATTR_DB_TABLE.String(s.schema.table(service)), ATTR_KEYWORD.String(keyword))
+	row := s.db.QueryRowContext(ctx, query, keyword, s.timeArg(before))
+
+	t, value, err := s.scanSample(row)
+	if err != sql.ErrNoRows {
+		endSpan(span, err)
+	} else {
+		span.End()
+	}
+
+	switch err {
+	case nil:
+		return t, value, true, nil
+	case sql.ErrNoRows:
+		return time.Time{}, "", false, nil
+	default:
+		return time.Time{}, "", false, err
+	}
+}
+
+func (s *sqlStore) Metadata(ctx context.Context, service string) (list []KeywordMetadata, err error) {
+	query := s.schema.metadataQuery(s.metaTable)
+	ctx, span := s.startStatement(ctx, "metadata", query, ATTR_SERVICE.String(service))
+	defer func() { endSpan(span, err) }()
+
+	rows, err := s.db.QueryContext(ctx, query, service)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list = []KeywordMetadata{}
+	for rows.Next() {
+		meta := KeywordMetadata{Service: service}
+		err = rows.Scan(&meta.Keyword, &meta.Units, &meta.Description)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, meta)
+	}
+
+	err = rows.Err()
+	return list, err
+}
+
+func (s *sqlStore) poolStats() sql.DBStats {
+	return s.db.Stats()
+}
+
+func (s *sqlStore) Ping(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
+func (s *sqlStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *sqlStore) version(ctx context.Context) (string, error) {
+	query := "select version();"
+	if s.backend == BACKEND_SQLITE {
+		query = "select 'SQLite ' || sqlite_version();"
+	}
+
+	var version string
+	err := s.db.QueryRowContext(ctx, query).Scan(&version)
+	return version, err
+}
+
+func (s *sqlStore) keywordCount(ctx context.Context) (int, error) {
+	query := s.schema.keywordCountQuery(s.metaTable)
+	ctx, span := s.startStatement(ctx, "keyword count", query)
+
+	var count int
+	err := s.db.QueryRowContext(ctx, query).Scan(&count)
+	endSpan(span, err)
+	return count, err
+}
+
+// inspectTable reads the newest sample time from a service's table, which also shows the table can be
+// read, and looks in the catalog for an index on the time column.  Without one the max() is a full scan
+// of the table, so the health check's deadline still applies.
+func (s *sqlStore) inspectTable(ctx context.Context, service string) (tableInspection, error) {
+	inspection := tableInspection{}
+	schema := &s.schema
+
+	query := schema.newestQuery(service)
+	newestCtx, span := s.startStatement(ctx, "newest", query, ATTR_DB_TABLE.String(schema.table(service)))
+	defer span.End()
+
+	row := s.db.QueryRowContext(newestCtx, query)
+	switch {
+	case schema.TimeFormat == TIME_FORMAT_TIMESTAMPTZ && s.textTimes:
+		var newest sql.NullString
+		err := row.Scan(&newest)
+		if err != nil {
+			return inspection, err
+		}
+		if newest.Valid {
+			t, err := time.Parse(SQLITE_TIME_FORMAT, newest.String)
+			if err != nil {
+				return inspection, err
+			}
+			inspection.newest = &t
+		}
+
+	case schema.TimeFormat == TIME_FORMAT_TIMESTAMPTZ:
+		var newest sql.NullTime
+		err := row.Scan(&newest)
+		if err != nil {
+			return inspection, err
+		}
+		if newest.Valid {
+			inspection.newest = &newest.Time
+		}
+
+	default:
+		var newest sql.NullFloat64
+		err := row.Scan(&newest)
+		if err != nil {
+			return inspection, err
+		}
+		if newest.Valid {
+			t := schema.timeFromNumber(newest.Float64)
+			inspection.newest = &t
+		}
+	}
+
+	tableSchema, table := schema.tableName(service)
+	var indexed bool
+	if s.backend == BACKEND_SQLITE {
+		var count int
+		err := s.db.QueryRowContext(ctx,
+			"select count(*) from pragma_index_list($1) as l, pragma_index_info(l.name) as i where i.name = $2;",
+			table, schema.TimeColumn).Scan(&count)
+		if err != nil {
+			return inspection, err
+		}
+		indexed = count > 0
+	} else {
+		definitions, err := s.queryStrings(ctx, "indexes",
+			"select indexdef from pg_indexes where tablename = $1 and schemaname = coalesce(nullif($2, ''), current_schema());",
+			table, tableSchema)
+		if err != nil {
+			return inspection, err
+		}
+		for _, definition := range definitions {
+			if strings.Contains(definition, schema.TimeColumn) {
+				indexed = true
+			}
+		}
+	}
+	inspection.indexed = &indexed
+
+	return inspection, nil
+}
@@ -0,0 +1,355 @@
+package plugin
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+// newTestSQLite writes an archive in the KTL layout to a SQLite file and returns its path
+func newTestSQLite(t *testing.T, statements ...string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "archive.sqlite")
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, statement := range statements {
+		_, err = db.Exec(statement)
+		if err != nil {
+			t.Fatalf("%s: %s", statement, err)
+		}
+	}
+
+	return path
+}
+
+func TestSQLiteQuery(t *testing.T) {
+	path := newTestSQLite(t,
+		`create table ktlmeta (service text, keyword text, units text, description text)`,
+		`insert into ktlmeta values ('dcs', 'AZ', 'deg', 'Telescope azimuth'), ('dcs', 'EL', 'deg', null)`,
+		`create table dcs (time real, keyword text, binvalue text)`,
+		`insert into dcs values (1700000000.5, 'AZ', ' 10'), (1700000001.5, 'AZ', '12'), (1700000002.5, 'AZ', '14'), (1700000001, 'EL', '45')`,
+	)
+
+	settings, _ := json.Marshal(map[string]string{"backend": BACKEND_SQLITE, "path": path})
+	instance, err := NewDatasource(context.Background(), backend.DataSourceInstanceSettings{JSONData: settings})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds := instance.(*KeywordDatasource)
+	defer ds.Dispose()
+
+	health, err := ds.CheckHealth(context.Background(), &backend.CheckHealthRequest{})
+	if err != nil || health.Status != backend.HealthStatusOk {
+		t.Fatalf("expected a healthy datasource: %v %v", health, err)
+	}
+
+	_, body := callResource(t, ds, "/keywords?service=dcs")
+	if keywords, _ := body["keywords"].(map[string]interface{}); len(keywords) != 2 {
+		t.Fatalf("unexpected keywords: %v", body)
+	}
+
+	meta, err := keywordMetadata(context.Background(), ds.store, "dcs", "AZ")
+	if err != nil || meta.Units != "deg" {
+		t.Fatalf("unexpected metadata: %+v %v", meta, err)
+	}
+
+	// The last sample is outside the range, the derivative of the other two is 2 per second
+	start := time.Unix(1700000000, 0)
+	resp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+		Queries: []backend.DataQuery{{
+			RefID:     "A",
+			JSON:      json.RawMessage(`{"queryText": "dcs.AZ", "transforms": [{"name": "derivative"}]}`),
+			TimeRange: backend.TimeRange{From: start, To: start.Add(2 * time.Second)},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res := resp.Responses["A"]
+	if res.Error != nil {
+		t.Fatal(res.Error)
+	}
+	values := floatValues(t, res.Frames[0].Fields[0])
+	if len(values) != 1 || values[0] != 2 {
+		t.Fatalf("unexpected derivative: %v", values)
+	}
+}
+
+func TestSQLiteTextTimes(t *testing.T) {
+	path := newTestSQLite(t,
+		`create table ktlmeta (service text, keyword text, units text, description text)`,
+		`create table "archive_acs" (stamp text, name text, value real)`,
+		`insert into "archive_acs" values ('2024-03-01 00:00:00', 'TEMP', 20.5), ('2024-03-01 00:00:01.5', 'TEMP', 21), ('2024-03-02 00:00:00', 'TEMP', 30)`,
+	)
+
+	config, err := parseSettings([]byte(`{"backend": "sqlite", "path": "` + path + `",
+		"schema": {"tableTemplate": "archive_{service}", "timeColumn": "stamp", "keywordColumn": "name", "timeFormat": "timestamptz", "valueColumns": ["value"]}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := newArchiveStore(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	from := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	times, values, err := store.Samples(context.Background(), "acs", "TEMP", from, from.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 2 || values[0] != "20.5" || !times[1].Equal(from.Add(1500*time.Millisecond)) {
+		t.Fatalf("unexpected samples: %v %v", times, values)
+	}
+
+	// The latest sample before the last one
+	latest, value, ok, err := store.Latest(context.Background(), "acs", "TEMP", from.Add(time.Hour))
+	if err != nil || !ok || value != "21.0" || !latest.Equal(from.Add(1500*time.Millisecond)) {
+		t.Fatalf("unexpected latest sample: %v %v %v %v", latest, value, ok, err)
+	}
+	_, _, ok, err = store.Latest(context.Background(), "acs", "TEMP", from.Add(-time.Second))
+	if err != nil || ok {
+		t.Fatalf("expected no sample before the first: %v %v", ok, err)
+	}
+}
+
+func TestSQLiteHealth(t *testing.T) {
+	// The acs service is listed in the metadata but has no table
+	path := newTestSQLite(t,
+		`create table ktlmeta (service text, keyword text, units text, description text)`,
+		`insert into ktlmeta values ('dcs', 'AZ', 'deg', ''), ('dcs', 'EL', 'deg', ''), ('acs', 'TEMP', 'degC', '')`,
+		`create table dcs (time real, keyword text, binvalue text)`,
+		`create index dcs_time on dcs (keyword, time)`,
+		`insert into dcs values (1700000000.5, 'AZ', '10'), (1700000002, 'EL', '45')`,
+	)
+
+	settings, _ := json.Marshal(map[string]string{"backend": BACKEND_SQLITE, "path": path})
+	instance, err := NewDatasource(context.Background(), backend.DataSourceInstanceSettings{JSONData: settings})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds := instance.(*KeywordDatasource)
+	defer ds.Dispose()
+
+	health, err := ds.CheckHealth(context.Background(), &backend.CheckHealthRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if health.Status != backend.HealthStatusError || !strings.Contains(health.Message, "acs") {
+		t.Fatalf("expected the missing table to fail the health check: %s", health.Message)
+	}
+
+	var details healthDetails
+	err = json.Unmarshal(health.JSONDetails, &details)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if details.Metadata.Status != HEALTH_OK || details.Metadata.Services != 2 || details.Metadata.Keywords != 3 {
+		t.Fatalf("unexpected metadata health: %s", health.JSONDetails)
+	}
+	if !strings.HasPrefix(details.Connection.Version, "SQLite") {
+		t.Fatalf("unexpected version: %s", health.JSONDetails)
+	}
+
+	// Services are sorted, acs first
+	acs, dcs := details.Tables[0], details.Tables[1]
+	if acs.Status != HEALTH_ERROR || dcs.Status != HEALTH_OK || dcs.Indexed == nil || !*dcs.Indexed {
+		t.Fatalf("unexpected table health: %s", health.JSONDetails)
+	}
+	if !dcs.NewestSample.Equal(time.Unix(1700000002, 0)) || !details.NewestSample.Equal(*dcs.NewestSample) {
+		t.Fatalf("unexpected newest sample: %s", health.JSONDetails)
+	}
+}
+
+func TestSQLiteStalenessMissingTable(t *testing.T) {
+	// The metadata lists acs, but its table was never made
+	path := newTestSQLite(t,
+		`create table ktlmeta (service text, keyword text, units text, description text)`,
+		`insert into ktlmeta values ('dcs', 'AZ', 'deg', null), ('acs', 'TEMP', 'degC', null)`,
+		`create table dcs (time real, keyword text, binvalue text)`,
+		`insert into dcs values (1700000000, 'AZ', '10')`,
+	)
+
+	settings, _ := json.Marshal(map[string]string{"backend": BACKEND_SQLITE, "path": path})
+	instance, err := NewDatasource(context.Background(), backend.DataSourceInstanceSettings{JSONData: settings})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds := instance.(*KeywordDatasource)
+	defer ds.Dispose()
+
+	resp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+		Queries: []backend.DataQuery{{
+			RefID:     "A",
+			QueryType: QUERY_TYPE_STALENESS,
+			JSON:      json.RawMessage(`{"queryText": "dcs.AZ, acs.*"}`),
+			TimeRange: backend.TimeRange{From: time.Unix(1700000000, 0), To: time.Unix(1700000060, 0)},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := resp.Responses["A"]
+	if res.Error != nil {
+		t.Fatalf("expected the missing table to be reported on its row, got %v", res.Error)
+	}
+
+	// dcs.AZ is answered as usual, acs.TEMP is stale with the reason beside it
+	frame := res.Frames[0]
+	if frame.Rows() != 2 || frame.Fields[0].At(1).(string) != "acs.TEMP" {
+		t.Fatalf("unexpected rows: %v", frame.Fields[0])
+	}
+	if age, _ := frame.Fields[3].ConcreteAt(0); age != 60.0 || frame.Fields[5].At(0).(bool) {
+		t.Fatalf("expected dcs.AZ to be 60s old and fresh, got %v", age)
+	}
+	if _, ok := frame.Fields[6].ConcreteAt(0); ok {
+		t.Fatal("expected no error for dcs.AZ")
+	}
+	if !frame.Fields[5].At(1).(bool) {
+		t.Fatal("expected acs.TEMP to be stale")
+	}
+	if problem, ok := frame.Fields[6].ConcreteAt(1); !ok || !strings.Contains(problem.(string), "acs") {
+		t.Fatalf("expected the missing table on the acs.TEMP row, got %v", problem)
+	}
+}
+
+func TestArchiveSchemaTimes(t *testing.T) {
+	stamp := time.Unix(1700000000, 250000000)
+
+	cases := []struct {
+		format   string
+		expected interface{}
+	}{
+		{TIME_FORMAT_INT_MS, int64(1700000000250)},
+		{TIME_FORMAT_INT_US, int64(1700000000250000)},
+		{TIME_FORMAT_FLOAT_SECONDS, 1700000000.25},
+		// Left to the driver
+		{TIME_FORMAT_TIMESTAMPTZ, stamp},
+	}
+
+	for _, c := range cases {
+		schema := ArchiveSchema{TimeFormat: c.format}
+		schema.applyDefaults()
+
+		arg := schema.timeArg(stamp)
+		if arg != c.expected {
+			t.Fatalf("%s: expected %v (%T), got %v (%T)", c.format, c.expected, c.expected, arg, arg)
+		}
+		if c.format == TIME_FORMAT_TIMESTAMPTZ {
+			continue
+		}
+
+		// A numeric column is scanned as a float64 whatever its type, and converts back to the same time
+		var number float64
+		switch v := arg.(type) {
+		case int64:
+			number = float64(v)
+		case float64:
+			number = v
+		}
+		if got := schema.timeFromNumber(number); got.Sub(stamp).Abs() > time.Microsecond {
+			t.Fatalf("%s: expected %v back, got %v", c.format, stamp, got)
+		}
+	}
+}
+
+func TestArchiveSchemaQuoting(t *testing.T) {
+	schema := ArchiveSchema{}
+	schema.applyDefaults()
+	if got := schema.valueExpression(); got != `trim(cast("binvalue" as text))` {
+		t.Fatalf("unexpected single value expression: %s", got)
+	}
+
+	// The first non-null of several value columns is used
+	schema.ValueColumns = []string{"numvalue", "strvalue"}
+	if got := schema.valueExpression(); got != `coalesce(trim(cast("numvalue" as text)), trim(cast("strvalue" as text)))` {
+		t.Fatalf("unexpected coalesced value expression: %s", got)
+	}
+
+	// Each part of a schema-qualified template is quoted apart, and the service can never add a part or
+	// close the quotes
+	schema.TableTemplate = "archive.kw_{service}"
+	for service, expected := range map[string]string{
+		"dcs":              `"archive"."kw_dcs"`,
+		`dcs"; drop table`: `"archive"."kw_dcs""; drop table"`,
+		"other.dcs":        `"archive"."kw_other.dcs"`,
+	} {
+		if got := schema.table(service); got != expected {
+			t.Fatalf("%s: expected %s, got %s", service, expected, got)
+		}
+	}
+	if prefix, name := schema.tableName("dcs"); prefix != "archive" || name != "kw_dcs" {
+		t.Fatalf("unexpected table name: %s %s", prefix, name)
+	}
+	if got := quoteQualified("archive.ktlmeta"); got != `"archive"."ktlmeta"` {
+		t.Fatalf("unexpected metadata table: %s", got)
+	}
+}
+
+func TestArchiveSchemaValidate(t *testing.T) {
+	cases := []struct {
+		name     string
+		schema   ArchiveSchema
+		expected string
+	}{
+		{"no service", ArchiveSchema{TableTemplate: "archive"}, "must contain {service}"},
+		{"time format", ArchiveSchema{TimeFormat: "int_ns"}, `not "int_ns"`},
+		{"empty value column", ArchiveSchema{ValueColumns: []string{"binvalue", ""}}, "empty name"},
+	}
+
+	for _, c := range cases {
+		c.schema.applyDefaults()
+		err := c.schema.validate()
+		if err == nil || !strings.Contains(err.Error(), c.expected) {
+			t.Fatalf("%s: expected an error containing %q, got %v", c.name, c.expected, err)
+		}
+	}
+
+	schema := ArchiveSchema{}
+	schema.applyDefaults()
+	if err := schema.validate(); err != nil {
+		t.Fatalf("expected the KTL defaults to be valid, got %v", err)
+	}
+}
+
+func TestSQLiteMillisecondTimes(t *testing.T) {
+	// Numbers and text archived to separate columns, times in integer milliseconds
+	path := newTestSQLite(t,
+		`create table ktlmeta (service text, keyword text, units text, description text)`,
+		`create table dcs (ms integer, keyword text, num real, txt text)`,
+		`insert into dcs values (1700000000250, 'AZ', null, '12'), (1700000001000, 'AZ', 10.5, null), (1700000003000, 'AZ', 9, null)`,
+	)
+
+	config, err := parseSettings([]byte(`{"backend": "sqlite", "path": "` + path + `",
+		"schema": {"timeColumn": "ms", "timeFormat": "int_ms", "valueColumns": ["num", "txt"]}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := newArchiveStore(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	from := time.Unix(1700000000, 0)
+	times, values, err := store.Samples(context.Background(), "dcs", "AZ", from, from.Add(2*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 2 || values[0] != "12" || values[1] != "10.5" ||
+		!times[0].Equal(from.Add(250*time.Millisecond)) || !times[1].Equal(from.Add(time.Second)) {
+		t.Fatalf("unexpected samples: %v %v", times, values)
+	}
+}
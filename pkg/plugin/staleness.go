@@ -0,0 +1,159 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// Keywords not archived for this long are stale, unless the query gives its own threshold
+const STALE_DEFAULT_THRESHOLD = 10 * time.Minute
+
+// stalenessOptions are the thresholds for the staleness query type, as durations such as "90s" or "2h"
+type stalenessOptions struct {
+	// Threshold for keywords without one of their own, STALE_DEFAULT_THRESHOLD if empty
+	Threshold string `json:"threshold"`
+
+	// Thresholds for particular keywords, keyed by service.keyword or a pattern such as "dcs.*"
+	Thresholds map[string]string `json:"thresholds"`
+}
+
+// A threshold, a number followed by one of the time shift units
+var thresholdPattern = regexp.MustCompile(`^(\d+(?:\.\d+)?)(s|m|h|d|w)$`)
+
+func parseThreshold(text string) (time.Duration, error) {
+	m := thresholdPattern.FindStringSubmatch(strings.ToLower(strings.ReplaceAll(text, " ", "")))
+	if m == nil {
+		return 0, fmt.Errorf("invalid staleness threshold: %q, expected an amount such as 90s or 2h", text)
+	}
+
+	amount, err := strconv.ParseFloat(m[1], 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid staleness threshold: %q", text)
+	}
+
+	return time.Duration(amount * float64(timeShiftUnits[m[2]])), nil
+}
+
+// threshold finds a keyword's threshold, its own if it has one, otherwise that of the longest pattern
+// matching it, otherwise the default
+func (o *stalenessOptions) threshold(key string) (time.Duration, error) {
+	if text, ok := o.Thresholds[key]; ok {
+		return parseThreshold(text)
+	}
+
+	best := ""
+	for pattern := range o.Thresholds {
+		ok, err := path.Match(pattern, key)
+		if err != nil {
+			return 0, fmt.Errorf("invalid staleness pattern %s: %w", pattern, err)
+		}
+		if ok && (len(pattern) > len(best) || (len(pattern) == len(best) && pattern < best)) {
+			best = pattern
+		}
+	}
+	if best != "" {
+		return parseThreshold(o.Thresholds[best])
+	}
+
+	if o.Threshold != "" {
+		return parseThreshold(o.Threshold)
+	}
+	return STALE_DEFAULT_THRESHOLD, nil
+}
+
+// queryStaleness returns a table with a row per keyword giving how long before the end of the time range
+// it was last archived, and whether that is longer than its threshold.  Patterns among the keywords have
+// already been expanded.  The search for the last sample is not limited to the time range, since a keyword
+// that has stopped is exactly the one with nothing in it, and transforms and time shifts do not apply.
+// A keyword the archive cannot answer for, such as one whose table is missing, is reported stale with the
+// error in its own row rather than failing the whole table.
+func (ds *KeywordDatasource) queryStaleness(ctx context.Context, store ArchiveStore, qm queryModel, keys []string, timeRange backend.TimeRange) (*data.Frame, error) {
+	// Build the table column by column
+	var (
+		keywords   []string
+		lastTimes  []*time.Time
+		lastValues []*string
+		ages       []*float64
+		thresholds []float64
+		stale      []bool
+		problems   []*string
+	)
+
+	for _, key := range keys {
+		threshold, err := qm.Staleness.threshold(key)
+		if err != nil {
+			return nil, err
+		}
+
+		service, keyword, err := splitKeyword(key)
+		if err != nil {
+			return nil, err
+		}
+
+		start := time.Now()
+		t, value, ok, err := store.Latest(ctx, service, keyword, timeRange.To)
+		observeArchive(ds.settings, "latest", start)
+		if err != nil && ctx.Err() != nil {
+			return nil, fmt.Errorf("%s: %w", key, err)
+		}
+		if ok {
+			rowsFetched.WithLabelValues(backendLabel(ds.settings)).Inc()
+		}
+
+		keywords = append(keywords, key)
+		thresholds = append(thresholds, threshold.Seconds())
+
+		var problem *string
+		if err != nil {
+			logger(ctx).Warn(fl()+"cannot find the latest sample", "key", key, "error", err)
+			message := err.Error()
+			problem = &message
+			ok = false
+		}
+		problems = append(problems, problem)
+
+		// A keyword never archived, or that cannot be read, is as stale as can be
+		if !ok {
+			lastTimes = append(lastTimes, nil)
+			lastValues = append(lastValues, nil)
+			ages = append(ages, nil)
+			stale = append(stale, true)
+			continue
+		}
+
+		age := timeRange.To.Sub(t)
+		lastTimes = append(lastTimes, &t)
+		lastValues = append(lastValues, &value)
+		ages = append(ages, floatPtr(age.Seconds()))
+		stale = append(stale, age > threshold)
+	}
+
+	_, span := startSpan(ctx, "build staleness frame", ATTR_KEYWORDS.StringSlice(keys))
+	defer span.End()
+
+	frame := data.NewFrame("staleness")
+	frame.RefID = qm.RefId
+
+	frame.Fields = append(frame.Fields,
+		data.NewField("keyword", nil, keywords),
+		data.NewField("last_time", nil, lastTimes),
+		data.NewField("last_value", nil, lastValues),
+		data.NewField("age", nil, ages).SetConfig(&data.FieldConfig{Unit: "s"}),
+		data.NewField("threshold", nil, thresholds).SetConfig(&data.FieldConfig{Unit: "s"}),
+		data.NewField("stale", nil, stale),
+		data.NewField("error", nil, problems),
+	)
+
+	// Mark this as a table rather than a series so panels do not try to plot it against time
+	frame.Meta = &data.FrameMeta{PreferredVisualization: data.VisTypeTable}
+
+	return frame, nil
+}
@@ -0,0 +1,207 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// seriesStats summarises one keyword over the time range.  Everything but the count is nil when the
+// keyword has no samples in the range.
+type seriesStats struct {
+	Count            int64
+	Min              *float64
+	Max              *float64
+	Mean             *float64
+	Median           *float64
+	StdDev           *float64
+	Percentiles      []*float64
+	First            *float64
+	FirstTime        *time.Time
+	Last             *float64
+	LastTime         *time.Time
+	TimeWeightedMean *float64
+}
+
+// computeStats summarises a series.  The time-weighted mean holds each value until the next sample, and
+// the last value until the end of the range, so that slowly changing keywords are weighted fairly.
+func computeStats(times []time.Time, values []float64, percentiles []float64, end time.Time) seriesStats {
+	s := seriesStats{
+		Count:       int64(len(values)),
+		Percentiles: make([]*float64, len(percentiles)),
+	}
+	if len(values) == 0 {
+		return s
+	}
+
+	n := len(values)
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+
+	sum := 0.0
+	for _, v := range values {
+		sum += v
+	}
+	mean := sum / float64(n)
+
+	// Two-pass variance for accuracy, the sample standard deviation needs at least two values
+	if n > 1 {
+		ss := 0.0
+		for _, v := range values {
+			ss += (v - mean) * (v - mean)
+		}
+		s.StdDev = floatPtr(math.Sqrt(ss / float64(n-1)))
+	}
+
+	s.Min = floatPtr(sorted[0])
+	s.Max = floatPtr(sorted[n-1])
+	s.Mean = floatPtr(mean)
+	s.Median = floatPtr(percentile(sorted, 50))
+	for i, p := range percentiles {
+		s.Percentiles[i] = floatPtr(percentile(sorted, p))
+	}
+
+	s.First = floatPtr(values[0])
+	s.FirstTime = &times[0]
+	s.Last = floatPtr(values[n-1])
+	s.LastTime = &times[n-1]
+
+	// Hold the last value to the end of the range, unless the series somehow runs past it
+	if end.Before(times[n-1]) {
+		end = times[n-1]
+	}
+
+	var weighted, duration float64
+	for i := range values {
+		next := end
+		if i+1 < n {
+			next = times[i+1]
+		}
+		dt := next.Sub(times[i]).Seconds()
+		weighted += values[i] * dt
+		duration += dt
+	}
+
+	if duration > 0 {
+		s.TimeWeightedMean = floatPtr(weighted / duration)
+	} else {
+		s.TimeWeightedMean = floatPtr(values[n-1])
+	}
+
+	return s
+}
+
+// percentile interpolates linearly between the closest ranks of a sorted slice, p is 0 to 100
+func percentile(sorted []float64, p float64) float64 {
+	rank := p / 100 * float64(len(sorted)-1)
+	lo := int(math.Floor(rank))
+	hi := int(math.Ceil(rank))
+
+	return sorted[lo] + (rank-float64(lo))*(sorted[hi]-sorted[lo])
+}
+
+func floatPtr(v float64) *float64 {
+	return &v
+}
+
+// percentileName is the column name used for a percentile, p95 or p99.9 for example
+func percentileName(p float64) string {
+	return "p" + strconv.FormatFloat(p, 'f', -1, 64)
+}
+
+// queryStats returns a table with one row of summary statistics per keyword
+func (ds *KeywordDatasource) queryStats(ctx context.Context, store ArchiveStore, qm queryModel, keys []string, pipeline *transformPipeline, timeRange backend.TimeRange) (*data.Frame, error) {
+	if pipeline.spectrum != nil {
+		return nil, fmt.Errorf("a spectrum cannot be summarised, remove it or use a time series query")
+	}
+
+	for _, p := range qm.Percentiles {
+		if p < 0 || p > 100 {
+			return nil, fmt.Errorf("percentiles must be between 0 and 100: %g", p)
+		}
+	}
+
+	// Build the table column by column
+	var (
+		keywords    []string
+		counts      []int64
+		mins        []*float64
+		maxs        []*float64
+		means       []*float64
+		medians     []*float64
+		stddevs     []*float64
+		firsts      []*float64
+		firstTimes  []*time.Time
+		lasts       []*float64
+		lastTimes   []*time.Time
+		twMeans     []*float64
+		percentiles = make([][]*float64, len(qm.Percentiles))
+	)
+
+	for _, key := range keys {
+		times, values, err := ds.fetchSeries(ctx, store, qm, key, timeRange)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", key, err)
+		}
+
+		times, values, err = pipeline.run(ctx, times, values)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", key, err)
+		}
+
+		s := computeStats(times, values, qm.Percentiles, timeRange.To)
+
+		keywords = append(keywords, qm.seriesName(key))
+		counts = append(counts, s.Count)
+		mins = append(mins, s.Min)
+		maxs = append(maxs, s.Max)
+		means = append(means, s.Mean)
+		medians = append(medians, s.Median)
+		stddevs = append(stddevs, s.StdDev)
+		firsts = append(firsts, s.First)
+		firstTimes = append(firstTimes, s.FirstTime)
+		lasts = append(lasts, s.Last)
+		lastTimes = append(lastTimes, s.LastTime)
+		twMeans = append(twMeans, s.TimeWeightedMean)
+		for i := range qm.Percentiles {
+			percentiles[i] = append(percentiles[i], s.Percentiles[i])
+		}
+	}
+
+	_, span := startSpan(ctx, "build stats frame", ATTR_KEYWORDS.StringSlice(keys))
+	defer span.End()
+
+	frame := data.NewFrame("stats")
+	frame.RefID = qm.RefId
+
+	frame.Fields = append(frame.Fields,
+		data.NewField("keyword", nil, keywords),
+		data.NewField("count", nil, counts),
+		data.NewField("min", nil, mins),
+		data.NewField("max", nil, maxs),
+		data.NewField("mean", nil, means),
+		data.NewField("median", nil, medians),
+		data.NewField("stddev", nil, stddevs),
+	)
+	for i, p := range qm.Percentiles {
+		frame.Fields = append(frame.Fields, data.NewField(percentileName(p), nil, percentiles[i]))
+	}
+	frame.Fields = append(frame.Fields,
+		data.NewField("first", nil, firsts),
+		data.NewField("first_time", nil, firstTimes),
+		data.NewField("last", nil, lasts),
+		data.NewField("last_time", nil, lastTimes),
+		data.NewField("time_weighted_mean", nil, twMeans),
+	)
+
+	// Mark this as a table rather than a series so panels do not try to plot it against time
+	frame.Meta = &data.FrameMeta{PreferredVisualization: data.VisTypeTable}
+
+	return frame, nil
+}
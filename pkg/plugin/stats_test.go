@@ -0,0 +1,81 @@
+package plugin
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// sameStat compares an optional statistic, nil matching only nil
+func sameStat(got *float64, expected *float64) bool {
+	if got == nil || expected == nil {
+		return got == nil && expected == nil
+	}
+	return math.Abs(*got-*expected) < 1e-9
+}
+
+func TestComputeStats(t *testing.T) {
+	times := secondsSeries(0, 1, 3)
+	values := []float64{4, 2, 6}
+
+	// Held for 1s, 2s and then 4s to the end of the range
+	s := computeStats(times, values, []float64{25, 90}, testEpoch.Add(7*time.Second))
+
+	for _, c := range []struct {
+		name     string
+		got      *float64
+		expected float64
+	}{
+		{"min", s.Min, 2},
+		{"max", s.Max, 6},
+		{"mean", s.Mean, 4},
+		{"median", s.Median, 4},
+		{"std", s.StdDev, 2},
+		{"p25", s.Percentiles[0], 3},
+		{"p90", s.Percentiles[1], 5.6},
+		{"first", s.First, 4},
+		{"last", s.Last, 6},
+		{"time-weighted mean", s.TimeWeightedMean, (4*1 + 2*2 + 6*4) / 7.0},
+	} {
+		if !sameStat(c.got, &c.expected) {
+			t.Fatalf("%s: expected %v, got %v", c.name, c.expected, c.got)
+		}
+	}
+	if s.Count != 3 || !s.FirstTime.Equal(times[0]) || !s.LastTime.Equal(times[2]) {
+		t.Fatalf("unexpected count %d or times %v %v", s.Count, s.FirstTime, s.LastTime)
+	}
+
+	// A range ending before the last sample holds nothing past it
+	s = computeStats(times, values, nil, testEpoch)
+	if expected := (4*1 + 2*2) / 3.0; !sameStat(s.TimeWeightedMean, &expected) {
+		t.Fatalf("expected %v, got %v", expected, *s.TimeWeightedMean)
+	}
+
+	// A single sample has no spread, and at the end of the range is its own time-weighted mean
+	s = computeStats(times[:1], values[:1], []float64{50}, testEpoch)
+	if s.StdDev != nil || *s.Median != 4 || *s.Percentiles[0] != 4 || *s.TimeWeightedMean != 4 {
+		t.Fatalf("unexpected single sample stats: %+v", s)
+	}
+
+	// No samples is a count of zero and nothing else
+	s = computeStats(nil, nil, []float64{50}, testEpoch)
+	if s.Count != 0 || s.Min != nil || s.Mean != nil || s.Percentiles[0] != nil || s.TimeWeightedMean != nil {
+		t.Fatalf("unexpected empty stats: %+v", s)
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	sorted := []float64{1, 2, 3, 4, 5}
+
+	for p, expected := range map[float64]float64{0: 1, 100: 5, 50: 3, 25: 2, 10: 1.4, 99: 4.96} {
+		if got := percentile(sorted, p); math.Abs(got-expected) > 1e-9 {
+			t.Fatalf("p%v: expected %v, got %v", p, expected, got)
+		}
+	}
+
+	for p, expected := range map[float64]string{95: "p95", 99.9: "p99.9", 5: "p5"} {
+		if got := percentileName(p); got != expected {
+			t.Fatalf("expected %s, got %s", expected, got)
+		}
+	}
+}
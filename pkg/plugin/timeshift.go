@@ -0,0 +1,94 @@
+package plugin
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+// Named time shifts accepted in addition to amounts such as "-1d", with or without a leading "same time"
+// or "this time" as observers tend to phrase it
+var timeShiftAliases = map[string]string{
+	"yesterday":  "-1d",
+	"last night": "-1d",
+	"last week":  "-7d",
+}
+
+var timeShiftAliasPrefixes = []string{"same time ", "this time "}
+
+// A time shift amount, an optional sign followed by a number and a unit
+var timeShiftPattern = regexp.MustCompile(`^([+-]?)(\d+(?:\.\d+)?)(s|m|h|d|w)$`)
+
+var timeShiftUnits = map[string]time.Duration{
+	"s": time.Second,
+	"m": time.Minute,
+	"h": time.Hour,
+	"d": 24 * time.Hour,
+	"w": 7 * 24 * time.Hour,
+}
+
+// parseTimeShift converts a query time shift into the offset applied to the time range.  As in Grafana's
+// own time shift, an unsigned amount looks back in time so "1d" and "-1d" are the same, and "+1d" looks
+// forward.  The label is the canonical form used to mark the shifted series.
+func parseTimeShift(shift string) (offset time.Duration, label string, err error) {
+	shift = strings.Join(strings.Fields(strings.ToLower(shift)), " ")
+	if shift == "" {
+		return 0, "", nil
+	}
+
+	named := shift
+	for _, prefix := range timeShiftAliasPrefixes {
+		named = strings.TrimPrefix(named, prefix)
+	}
+	if alias, ok := timeShiftAliases[named]; ok {
+		shift = alias
+	}
+
+	m := timeShiftPattern.FindStringSubmatch(strings.ReplaceAll(shift, " ", ""))
+	if m == nil {
+		return 0, "", fmt.Errorf("invalid time shift: %q, expected an amount such as -1d or 12h", shift)
+	}
+
+	amount, err := strconv.ParseFloat(m[2], 64)
+	if err != nil {
+		return 0, "", fmt.Errorf("invalid time shift: %q", shift)
+	}
+
+	offset = -time.Duration(amount * float64(timeShiftUnits[m[3]]))
+	sign := "-"
+	if m[1] == "+" {
+		offset = -offset
+		sign = "+"
+	}
+
+	return offset, sign + m[2] + m[3], nil
+}
+
+// shiftTimeRange moves a time range by the offset
+func shiftTimeRange(timeRange backend.TimeRange, offset time.Duration) backend.TimeRange {
+	return backend.TimeRange{
+		From: timeRange.From.Add(offset),
+		To:   timeRange.To.Add(offset),
+	}
+}
+
+// restampTimes moves sample times back into the requested range after a shifted fetch
+func restampTimes(times []time.Time, offset time.Duration) {
+	for i := range times {
+		times[i] = times[i].Add(-offset)
+	}
+}
+
+// seriesName is the name given to a keyword's series, marked with the time shift if there is one
+func (qm *queryModel) seriesName(key string) string {
+	_, label, err := parseTimeShift(qm.TimeShift)
+	if err != nil || label == "" {
+		return key
+	}
+
+	return key + " (" + label + ")"
+}
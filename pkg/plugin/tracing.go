@@ -0,0 +1,51 @@
+package plugin
+
+import (
+	"context"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Span attribute names, the db.* ones follow the OpenTelemetry database conventions
+const (
+	ATTR_SERVICE      = attribute.Key("keyword.service")
+	ATTR_KEYWORD      = attribute.Key("keyword.keyword")
+	ATTR_KEYWORDS     = attribute.Key("keyword.keywords")
+	ATTR_QUERIES      = attribute.Key("keyword.queries")
+	ATTR_REF_ID       = attribute.Key("keyword.ref_id")
+	ATTR_QUERY_TYPE   = attribute.Key("keyword.query_type")
+	ATTR_TIME_FROM    = attribute.Key("keyword.time_from")
+	ATTR_TIME_TO      = attribute.Key("keyword.time_to")
+	ATTR_ROWS         = attribute.Key("keyword.rows")
+	ATTR_ROWS_OUT     = attribute.Key("keyword.rows_out")
+	ATTR_TRANSFORMS   = attribute.Key("keyword.transforms")
+	ATTR_DB_SYSTEM    = attribute.Key("db.system")
+	ATTR_DB_TABLE     = attribute.Key("db.sql.table")
+	ATTR_DB_STATEMENT = attribute.Key("db.statement")
+)
+
+// startSpan starts a span with the SDK's tracer, which Grafana configures so that spans join the trace of
+// the request that reached the plugin.  Without tracing configured the span does nothing.
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracing.DefaultTracer().Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// endSpan records any error on the span and ends it
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		_ = tracing.Error(span, err)
+	}
+	span.End()
+}
+
+// timeRangeAttributes describes a time range on a span
+func timeRangeAttributes(timeRange backend.TimeRange) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		ATTR_TIME_FROM.String(timeRange.From.UTC().Format(time.RFC3339Nano)),
+		ATTR_TIME_TO.String(timeRange.To.UTC().Format(time.RFC3339Nano)),
+	}
+}
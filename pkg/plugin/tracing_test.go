@@ -0,0 +1,72 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestTracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	previous := tracing.DefaultTracer()
+	tracing.InitDefaultTracer(provider.Tracer("test"))
+	defer tracing.InitDefaultTracer(previous)
+
+	path := newTestSQLite(t,
+		`create table ktlmeta (service text, keyword text, units text, description text)`,
+		`insert into ktlmeta values ('dcs', 'AZ', 'deg', 'Telescope azimuth')`,
+		`create table dcs (time real, keyword text, binvalue text)`,
+		`insert into dcs values (1700000000, 'AZ', '10'), (1700000001, 'AZ', '12')`,
+	)
+	settings, _ := json.Marshal(map[string]string{"backend": BACKEND_SQLITE, "path": path})
+	instance, err := NewDatasource(context.Background(), backend.DataSourceInstanceSettings{JSONData: settings})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds := instance.(*KeywordDatasource)
+	defer ds.Dispose()
+
+	start := time.Unix(1700000000, 0)
+	_, err = ds.QueryData(context.Background(), &backend.QueryDataRequest{
+		Queries: []backend.DataQuery{{
+			RefID:     "A",
+			JSON:      json.RawMessage(`{"queryText": "dcs.AZ", "transforms": [{"name": "derivative"}]}`),
+			TimeRange: backend.TimeRange{From: start, To: start.Add(time.Minute)},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = span
+	}
+	for _, name := range []string{"QueryData", "query", "fetch keyword", "sql count", "sql samples", "transform pipeline", "build frame"} {
+		if _, ok := spans[name]; !ok {
+			t.Fatalf("no %s span among %v", name, spans)
+		}
+	}
+
+	// Each span is a child of the one above it
+	if spans["sql samples"].Parent().SpanID() != spans["fetch keyword"].SpanContext().SpanID() ||
+		spans["fetch keyword"].Parent().SpanID() != spans["query"].SpanContext().SpanID() {
+		t.Fatal("spans are not nested")
+	}
+
+	attrs := map[attribute.Key]attribute.Value{}
+	for _, kv := range append(spans["sql samples"].Attributes(), spans["fetch keyword"].Attributes()...) {
+		attrs[kv.Key] = kv.Value
+	}
+	if attrs[ATTR_DB_TABLE].AsString() != `"dcs"` || attrs[ATTR_SERVICE].AsString() != "dcs" || attrs[ATTR_ROWS].AsInt64() != 2 {
+		t.Fatalf("unexpected attributes: %v", attrs)
+	}
+}
@@ -0,0 +1,327 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// TransformStep is one stage of a query's transform pipeline, the parameters are decoded by the transform itself
+type TransformStep struct {
+	Name   string          `json:"name"`
+	Params json.RawMessage `json:"params,omitempty"`
+}
+
+// transformFunc operates on the time/value slices of a series and returns the transformed slices
+type transformFunc func(times []time.Time, values []float64) ([]time.Time, []float64, error)
+
+// TransformDefinition describes a registered transform, these are served to the query editor via /transforms
+type TransformDefinition struct {
+	Name        string `json:"name"`
+	Label       string `json:"label"`
+	Description string `json:"description"`
+
+	// Pointwise transforms work on each sample alone, so a series may be transformed a piece at a time
+	Pointwise bool `json:"pointwise,omitempty"`
+
+	// Build decodes the step parameters and returns the function to run
+	Build func(params json.RawMessage) (transformFunc, error) `json:"-"`
+
+	// BuildSpectrum is set instead of Build for transforms that produce a spectrum, these end the pipeline
+	BuildSpectrum func(params json.RawMessage) (spectrumFunc, error) `json:"-"`
+}
+
+var (
+	transformsMu sync.RWMutex
+	transforms   = map[string]*TransformDefinition{}
+)
+
+// Define the data transforms, this maps onto the transformOptions list in QueryEditor.tsx.  These are the
+// original single transform codes, they are migrated into the pipeline by queryModel.transformSteps.
+const (
+	TRANSFORM_NONE                  = iota
+	TRANSFORM_FIRST_DERIVATVE       = iota
+	TRANSFORM_FIRST_DERIVATVE_1HZ   = iota
+	TRANSFORM_FIRST_DERIVATVE_10HZ  = iota
+	TRANSFORM_FIRST_DERIVATVE_100HZ = iota
+	TRANSFORM_DELTA                 = iota
+)
+
+func init() {
+	RegisterTransform(TransformDefinition{
+		Name:        "convert",
+		Label:       "unit conversion",
+		Description: `{"conversion": "rad_to_arcsec", "scale": 1, "offset": 0}, scale and offset only apply to scale_offset`,
+		Build:       buildConvertTransform,
+		Pointwise:   true,
+	})
+
+	RegisterTransform(TransformDefinition{
+		Name:        "derivative",
+		Label:       "1st derivative",
+		Description: `{"round": 10} rounds the result to 1/round, omit for no rounding`,
+		Build:       buildDerivativeTransform,
+	})
+
+	RegisterTransform(TransformDefinition{
+		Name:        "delta",
+		Label:       "delta",
+		Description: "difference between successive values, no parameters",
+		Build: func(_ json.RawMessage) (transformFunc, error) {
+			return deltaTransform, nil
+		},
+	})
+}
+
+// RegisterTransform adds a transform to the registry, replacing any existing transform of the same name
+func RegisterTransform(t TransformDefinition) {
+	transformsMu.Lock()
+	defer transformsMu.Unlock()
+
+	transforms[t.Name] = &t
+}
+
+// Transforms returns every registered transform ordered by name
+func Transforms() []TransformDefinition {
+	transformsMu.RLock()
+	defer transformsMu.RUnlock()
+
+	list := make([]TransformDefinition, 0, len(transforms))
+	for _, t := range transforms {
+		list = append(list, *t)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+
+	return list
+}
+
+// transformPipeline is a compiled list of transform steps, optionally ending in a spectrum
+type transformPipeline struct {
+	steps    []transformFunc
+	spectrum spectrumFunc
+
+	// Every step is pointwise, see TransformDefinition.Pointwise
+	pointwise bool
+
+	// Names of the steps in order, for tracing
+	names []string
+}
+
+// newTransformPipeline looks up and builds each step in turn
+func newTransformPipeline(steps []TransformStep) (*transformPipeline, error) {
+	pipeline := &transformPipeline{pointwise: true}
+
+	for i, step := range steps {
+		transformsMu.RLock()
+		t, ok := transforms[step.Name]
+		transformsMu.RUnlock()
+
+		if !ok {
+			return nil, fmt.Errorf("transform step %d: unknown transform: %s", i+1, step.Name)
+		}
+
+		if pipeline.spectrum != nil {
+			return nil, fmt.Errorf("transform step %d (%s): nothing may follow a spectrum", i+1, step.Name)
+		}
+
+		pipeline.pointwise = pipeline.pointwise && t.Pointwise
+		pipeline.names = append(pipeline.names, step.Name)
+
+		var err error
+		if t.BuildSpectrum != nil {
+			pipeline.spectrum, err = t.BuildSpectrum(step.Params)
+		} else {
+			var fn transformFunc
+			fn, err = t.Build(step.Params)
+			pipeline.steps = append(pipeline.steps, fn)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("transform step %d (%s): %w", i+1, step.Name, err)
+		}
+	}
+
+	return pipeline, nil
+}
+
+// run passes the series through each step in order, any spectrum is left to the caller
+func (p *transformPipeline) run(ctx context.Context, times []time.Time, values []float64) ([]time.Time, []float64, error) {
+	if len(p.steps) == 0 {
+		return times, values, nil
+	}
+
+	_, span := startSpan(ctx, "transform pipeline", ATTR_TRANSFORMS.StringSlice(p.names), ATTR_ROWS.Int(len(values)))
+	var err error
+	defer func() { endSpan(span, err) }()
+
+	for _, fn := range p.steps {
+		times, values, err = fn(times, values)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	span.SetAttributes(ATTR_ROWS_OUT.Int(len(values)))
+
+	return times, values, nil
+}
+
+// decodeParams unmarshals the step parameters, an absent parameter block leaves the defaults in place
+func decodeParams(params json.RawMessage, v interface{}) error {
+	if len(params) == 0 || string(params) == "null" {
+		return nil
+	}
+
+	err := json.Unmarshal(params, v)
+	if err != nil {
+		return fmt.Errorf("invalid parameters: %s", err.Error())
+	}
+
+	return nil
+}
+
+// transformSteps returns the full pipeline for the query.  Queries saved before the pipeline existed carry
+// a unit conversion and a single transform code, these become the leading steps ahead of any listed ones.
+func (qm *queryModel) transformSteps() ([]TransformStep, error) {
+	var steps []TransformStep
+
+	// The named conversion takes precedence over the legacy conversion code
+	conversion := qm.Conversion
+	if conversion == "" {
+		var err error
+		conversion, err = legacyUnitConversionName(qm.UnitConversion)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if conversion != "" {
+		params, _ := json.Marshal(convertParams{
+			Conversion: conversion,
+			Scale:      qm.ConversionScale,
+			Offset:     qm.ConversionOffset,
+		})
+		steps = append(steps, TransformStep{Name: "convert", Params: params})
+	}
+
+	switch qm.Transform {
+	case TRANSFORM_NONE:
+	case TRANSFORM_FIRST_DERIVATVE:
+		steps = append(steps, TransformStep{Name: "derivative"})
+	case TRANSFORM_FIRST_DERIVATVE_1HZ:
+		steps = append(steps, TransformStep{Name: "derivative", Params: json.RawMessage(`{"round": 1}`)})
+	case TRANSFORM_FIRST_DERIVATVE_10HZ:
+		steps = append(steps, TransformStep{Name: "derivative", Params: json.RawMessage(`{"round": 10}`)})
+	case TRANSFORM_FIRST_DERIVATVE_100HZ:
+		steps = append(steps, TransformStep{Name: "derivative", Params: json.RawMessage(`{"round": 100}`)})
+	case TRANSFORM_DELTA:
+		steps = append(steps, TransformStep{Name: "delta"})
+	default:
+		return nil, fmt.Errorf("Unknown transform: %d", qm.Transform)
+	}
+
+	return append(steps, qm.Transforms...), nil
+}
+
+type convertParams struct {
+	Conversion string  `json:"conversion"`
+	Scale      float64 `json:"scale,omitempty"`
+	Offset     float64 `json:"offset,omitempty"`
+}
+
+// buildConvertTransform applies a conversion from the unit registry to every value
+func buildConvertTransform(params json.RawMessage) (transformFunc, error) {
+	var p convertParams
+	err := decodeParams(params, &p)
+	if err != nil {
+		return nil, err
+	}
+
+	conversion, err := LookupUnitConversion(p.Conversion, p.Scale, p.Offset)
+	if err != nil {
+		return nil, err
+	}
+	if conversion == nil {
+		return nil, fmt.Errorf("no conversion given")
+	}
+
+	return func(times []time.Time, values []float64) ([]time.Time, []float64, error) {
+		converted := make([]float64, len(values))
+		for i, v := range values {
+			converted[i] = conversion.Convert(v)
+		}
+		return times, converted, nil
+	}, nil
+}
+
+// buildDerivativeTransform computes the first derivative of the data, optionally rounded
+func buildDerivativeTransform(params json.RawMessage) (transformFunc, error) {
+	var p struct {
+		Round float64 `json:"round"`
+	}
+	err := decodeParams(params, &p)
+	if err != nil {
+		return nil, err
+	}
+	if p.Round < 0 {
+		return nil, fmt.Errorf("round must not be negative")
+	}
+
+	return func(times []time.Time, values []float64) ([]time.Time, []float64, error) {
+		count := len(values)
+		if count < 2 {
+			return []time.Time{}, []float64{}, nil
+		}
+
+		// Compute the first derivative of the data.
+		dtimes := make([]time.Time, 0, count-1)
+		dvalues := make([]float64, 0, count-1)
+
+		for i := 1; i < count; i++ {
+			// Calculate the dt, samples sharing a timestamp with the previous one have no defined slope
+			var dt, dvdt float64
+			dt = (times[i].Sub(times[i-1])).Seconds()
+			if dt <= 0 {
+				continue
+			}
+
+			// Calculate the dy/dt
+			dvdt = (values[i] - values[i-1]) / dt
+
+			if p.Round > 0 {
+				dvdt = math.Round(dvdt*p.Round) / p.Round
+			}
+
+			dtimes = append(dtimes, times[i])
+			dvalues = append(dvalues, dvdt)
+		}
+
+		return dtimes, dvalues, nil
+	}, nil
+}
+
+// deltaTransform computes the deltas of the data.  This algorithm replicates what numpy diff() does in Python,
+// to the extent that it disregards the time series data.  The resultant arrays have one fewer element,
+// we drop the 0th element of time and value.  It's like a first derivative where dt is always 1.
+// See https://numpy.org/doc/stable/reference/generated/numpy.diff.html
+func deltaTransform(times []time.Time, values []float64) ([]time.Time, []float64, error) {
+	count := len(values)
+	if count < 2 {
+		return []time.Time{}, []float64{}, nil
+	}
+
+	dtimes := make([]time.Time, count-1)
+	dvalues := make([]float64, count-1)
+
+	for i := 1; i < count; i++ {
+		// Bring the time val straight across, shifted by one
+		dtimes[i-1] = times[i]
+
+		// Calculate the dx/dt and assume dt is always 1
+		dvalues[i-1] = values[i] - values[i-1]
+	}
+
+	return dtimes, dvalues, nil
+}
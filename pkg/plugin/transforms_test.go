@@ -0,0 +1,188 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The series in the tests start at this time
+var testEpoch = time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+
+// runTransform builds a single transform step and runs it over the series
+func runTransform(t *testing.T, name string, params string, times []time.Time, values []float64) ([]time.Time, []float64) {
+	t.Helper()
+
+	pipeline, err := newTransformPipeline([]TransformStep{{Name: name, Params: json.RawMessage(params)}})
+	if err != nil {
+		t.Fatalf("%s %s: %v", name, params, err)
+	}
+	times, values, err = pipeline.run(context.Background(), times, values)
+	if err != nil {
+		t.Fatalf("%s %s: %v", name, params, err)
+	}
+	return times, values
+}
+
+// secondsSeries makes sample times the given number of seconds after the test epoch
+func secondsSeries(seconds ...float64) []time.Time {
+	times := make([]time.Time, len(seconds))
+	for i, s := range seconds {
+		times[i] = testEpoch.Add(time.Duration(s * float64(time.Second)))
+	}
+	return times
+}
+
+// sameValues compares two series, NaN matching NaN
+func sameValues(got []float64, expected []float64, tolerance float64) bool {
+	if len(got) != len(expected) {
+		return false
+	}
+	for i := range got {
+		if math.IsNaN(expected[i]) {
+			if !math.IsNaN(got[i]) {
+				return false
+			}
+		} else if math.Abs(got[i]-expected[i]) > tolerance {
+			return false
+		}
+	}
+	return true
+}
+
+// sameTimes compares the times of a series
+func sameTimes(got []time.Time, expected []time.Time) bool {
+	if len(got) != len(expected) {
+		return false
+	}
+	for i := range got {
+		if !got[i].Equal(expected[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func TestTransformPipeline(t *testing.T) {
+	times := secondsSeries(0, 1, 3)
+	values := []float64{0, 2, 8}
+
+	cases := []struct {
+		steps    string
+		seconds  []float64
+		expected []float64
+	}{
+		{`[]`, []float64{0, 1, 3}, []float64{0, 2, 8}},
+		{`[{"name": "convert", "params": {"conversion": "deg_to_arcmin"}}]`, []float64{0, 1, 3}, []float64{0, 120, 480}},
+		{`[{"name": "convert", "params": {"conversion": "scale_offset", "scale": 2, "offset": 1}}]`,
+			[]float64{0, 1, 3}, []float64{1, 5, 17}},
+		// The derivative and delta drop the first sample, the derivative divides by the spacing
+		{`[{"name": "derivative"}]`, []float64{1, 3}, []float64{2, 3}},
+		{`[{"name": "delta"}]`, []float64{1, 3}, []float64{2, 6}},
+		// Steps run in order
+		{`[{"name": "convert", "params": {"conversion": "scale_offset", "scale": 2}}, {"name": "derivative"}]`,
+			[]float64{1, 3}, []float64{4, 6}},
+		{`[{"name": "delta"}, {"name": "delta"}]`, []float64{3}, []float64{4}},
+	}
+
+	for _, c := range cases {
+		var steps []TransformStep
+		err := json.Unmarshal([]byte(c.steps), &steps)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pipeline, err := newTransformPipeline(steps)
+		if err != nil {
+			t.Fatalf("%s: %v", c.steps, err)
+		}
+		gotTimes, got, err := pipeline.run(context.Background(), times, values)
+		if err != nil {
+			t.Fatalf("%s: %v", c.steps, err)
+		}
+		if !sameTimes(gotTimes, secondsSeries(c.seconds...)) || !sameValues(got, c.expected, 1e-9) {
+			t.Fatalf("%s: expected %v at %v, got %v at %v", c.steps, c.expected, c.seconds, got, gotTimes)
+		}
+	}
+
+	// The derivative rounds to 1/round
+	_, got := runTransform(t, "derivative", `{"round": 10}`, secondsSeries(0, 3, 6), []float64{0, 1, 2.5})
+	if !sameValues(got, []float64{0.3, 0.5}, 1e-12) {
+		t.Fatalf("expected the rounded derivative, got %v", got)
+	}
+
+	// A series too short to difference gives nothing rather than an error
+	gotTimes, got := runTransform(t, "derivative", ``, secondsSeries(0), []float64{1})
+	if len(gotTimes) != 0 || len(got) != 0 {
+		t.Fatalf("expected an empty derivative, got %v", got)
+	}
+
+	for _, steps := range []string{
+		`[{"name": "nonsense"}]`,
+		`[{"name": "convert"}]`,
+		`[{"name": "convert", "params": {"conversion": "furlongs"}}]`,
+		`[{"name": "derivative", "params": {"round": -1}}]`,
+		`[{"name": "derivative", "params": "fast"}]`,
+	} {
+		var list []TransformStep
+		err := json.Unmarshal([]byte(steps), &list)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = newTransformPipeline(list); err == nil {
+			t.Fatalf("%s: expected an error", steps)
+		}
+	}
+}
+
+func TestTransformSteps(t *testing.T) {
+	names := func(steps []TransformStep) string {
+		list := []string{}
+		for _, step := range steps {
+			list = append(list, step.Name+string(step.Params))
+		}
+		return strings.Join(list, " ")
+	}
+
+	cases := []struct {
+		qm       queryModel
+		expected string
+	}{
+		{queryModel{}, ""},
+		// Queries saved before the pipeline lead with their conversion and transform codes
+		{queryModel{UnitConversion: UNIT_CONVERT_K_TO_C, Transform: TRANSFORM_FIRST_DERIVATVE_10HZ},
+			`convert{"conversion":"k_to_c"} derivative{"round": 10}`},
+		{queryModel{Transform: TRANSFORM_DELTA, Transforms: []TransformStep{{Name: "derivative"}}}, "delta derivative"},
+		// A named conversion takes precedence over the code
+		{queryModel{Conversion: "deg_to_rad", UnitConversion: UNIT_CONVERT_K_TO_C},
+			`convert{"conversion":"deg_to_rad"}`},
+		{queryModel{Conversion: "scale_offset", ConversionScale: 2},
+			`convert{"conversion":"scale_offset","scale":2}`},
+	}
+
+	for _, c := range cases {
+		steps, err := c.qm.transformSteps()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := names(steps); got != c.expected {
+			t.Fatalf("expected %q, got %q", c.expected, got)
+		}
+	}
+
+	for _, qm := range []queryModel{{Transform: 99}, {UnitConversion: 99}} {
+		if _, err := qm.transformSteps(); err == nil {
+			t.Fatalf("%+v: expected an unknown code to fail", qm)
+		}
+	}
+
+	// The registry is listed in name order for the query editor
+	list := Transforms()
+	for i := 1; i < len(list); i++ {
+		if list[i-1].Name >= list[i].Name {
+			t.Fatalf("transforms out of order: %s, %s", list[i-1].Name, list[i].Name)
+		}
+	}
+}
@@ -0,0 +1,264 @@
+package plugin
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// UnitConversion describes a single named conversion that can be applied to each archived value.
+// The registry of these is served to the query editor via the /conversions resource so that the
+// editor no longer needs to hard-code a list that must match the backend.
+type UnitConversion struct {
+	Name     string `json:"name"`
+	Label    string `json:"label"`
+	Category string `json:"category"`
+
+	// Custom conversions take their scale and offset from the query rather than the registry
+	Custom bool `json:"custom,omitempty"`
+
+	// The integer code older saved queries use for this conversion, zero if it never had one
+	Legacy int `json:"legacy,omitempty"`
+
+	// Convert performs the conversion on a single value
+	Convert func(float64) float64 `json:"-"`
+}
+
+// unitDefinition places a unit on a common scale within its category, such that
+// base = value * scale + offset.  Conversions between any two units of a category are derived from these.
+type unitDefinition struct {
+	id     string
+	label  string
+	scale  float64
+	offset float64
+}
+
+// The name of the free-form conversion whose scale and offset are supplied with the query
+const UNIT_CONVERSION_SCALE_OFFSET = "scale_offset"
+
+var (
+	unitConversionsMu sync.RWMutex
+	unitConversions   = map[string]*UnitConversion{}
+)
+
+// The original unit conversions were integer codes, these are retained so that saved dashboards continue to work
+const (
+	UNIT_CONVERT_NONE          = iota
+	UNIT_CONVERT_DEG_TO_RAD    = iota
+	UNIT_CONVERT_RAD_TO_DEG    = iota
+	UNIT_CONVERT_RAD_TO_ARCSEC = iota
+	UNIT_CONVERT_K_TO_C        = iota
+	UNIT_CONVERT_C_TO_K        = iota
+)
+
+// legacyUnitConversions maps the old integer codes onto the names in the registry
+var legacyUnitConversions = map[int]string{
+	UNIT_CONVERT_NONE:          "",
+	UNIT_CONVERT_DEG_TO_RAD:    "deg_to_rad",
+	UNIT_CONVERT_RAD_TO_DEG:    "rad_to_deg",
+	UNIT_CONVERT_RAD_TO_ARCSEC: "rad_to_arcsec",
+	UNIT_CONVERT_K_TO_C:        "k_to_c",
+	UNIT_CONVERT_C_TO_K:        "c_to_k",
+}
+
+func init() {
+	// Angles are placed on a radian scale.  Sexagesimal values (D:M:S or H:M:S) in the archive are parsed
+	// into decimal degrees or hours when read, so the degrees and hours entries cover them as well.
+	registerUnitFamily("Angle", []unitDefinition{
+		{"deg", "degrees", math.Pi / 180, 0},
+		{"rad", "radians", 1, 0},
+		{"arcmin", "arcminutes", math.Pi / (180 * 60), 0},
+		{"arcsec", "arcseconds", math.Pi / (180 * 3600), 0},
+		{"mas", "milliarcseconds", math.Pi / (180 * 3600 * 1000), 0},
+		{"hours", "hours (angle)", math.Pi / 12, 0},
+	})
+
+	// Temperatures are placed on the Kelvin scale
+	registerUnitFamily("Temperature", []unitDefinition{
+		{"k", "Kelvin", 1, 0},
+		{"c", "Celsius", 1, 273.15},
+		{"f", "Fahrenheit", 5.0 / 9.0, 273.15 - 32*5.0/9.0},
+	})
+
+	// Pressures are placed on the Pascal scale
+	registerUnitFamily("Pressure", []unitDefinition{
+		{"pa", "Pa", 1, 0},
+		{"hpa", "hPa", 100, 0},
+		{"kpa", "kPa", 1000, 0},
+		{"mbar", "mbar", 100, 0},
+		{"bar", "bar", 100000, 0},
+		{"torr", "Torr", 101325.0 / 760.0, 0},
+		{"inhg", "inHg", 3386.389, 0},
+		{"atm", "atm", 101325, 0},
+	})
+
+	// Lengths are placed on the metre scale
+	registerUnitFamily("Length", []unitDefinition{
+		{"m", "m", 1, 0},
+		{"mm", "mm", 1e-3, 0},
+		{"um", "µm", 1e-6, 0},
+		{"nm", "nm", 1e-9, 0},
+	})
+
+	// Durations are placed on the seconds scale
+	registerUnitFamily("Time", []unitDefinition{
+		{"ns", "nanoseconds", 1e-9, 0},
+		{"us", "microseconds", 1e-6, 0},
+		{"ms", "milliseconds", 1e-3, 0},
+		{"s", "seconds", 1, 0},
+		{"min", "minutes", 60, 0},
+		{"hr", "hours", 3600, 0},
+		{"day", "days", 86400, 0},
+	})
+
+	// The free-form conversion, the scale and offset come in with the query
+	RegisterUnitConversion(UnitConversion{
+		Name:     UNIT_CONVERSION_SCALE_OFFSET,
+		Label:    "scale and offset (value × scale + offset)",
+		Category: "Custom",
+		Custom:   true,
+	})
+
+	// Tag the conversions older queries name by code, so the query editor can show them without its own copy
+	for code, name := range legacyUnitConversions {
+		if c, ok := unitConversions[name]; ok {
+			c.Legacy = code
+		}
+	}
+}
+
+// RegisterUnitConversion adds a conversion to the registry, replacing any existing conversion of the same name
+func RegisterUnitConversion(c UnitConversion) {
+	unitConversionsMu.Lock()
+	defer unitConversionsMu.Unlock()
+
+	unitConversions[c.Name] = &c
+}
+
+// registerUnitFamily registers a conversion between every pair of units in a category
+func registerUnitFamily(category string, units []unitDefinition) {
+	for _, from := range units {
+		for _, to := range units {
+			if from.id == to.id {
+				continue
+			}
+
+			// Collapse the two affine steps (into the base unit, then out of it) into a single one
+			scale := from.scale / to.scale
+			offset := (from.offset - to.offset) / to.scale
+
+			RegisterUnitConversion(UnitConversion{
+				Name:     from.id + "_to_" + to.id,
+				Label:    from.label + " to " + to.label,
+				Category: category,
+				Convert:  linearConversion(scale, offset),
+			})
+		}
+	}
+}
+
+// linearConversion returns a function computing value × scale + offset
+func linearConversion(scale, offset float64) func(float64) float64 {
+	if offset == 0 {
+		return func(v float64) float64 { return v * scale }
+	}
+	return func(v float64) float64 { return v*scale + offset }
+}
+
+// UnitConversions returns every registered conversion, ordered by category and then label
+func UnitConversions() []UnitConversion {
+	unitConversionsMu.RLock()
+	defer unitConversionsMu.RUnlock()
+
+	list := make([]UnitConversion, 0, len(unitConversions))
+	for _, c := range unitConversions {
+		list = append(list, *c)
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Category != list[j].Category {
+			return list[i].Category < list[j].Category
+		}
+		return list[i].Label < list[j].Label
+	})
+
+	return list
+}
+
+// LookupUnitConversion finds a conversion by name.  For the free-form conversion the scale and offset
+// supplied are used, a zero scale is treated as unset and becomes 1.  An empty name returns nil, nil.
+func LookupUnitConversion(name string, scale, offset float64) (*UnitConversion, error) {
+	if name == "" {
+		return nil, nil
+	}
+
+	unitConversionsMu.RLock()
+	c, ok := unitConversions[name]
+	unitConversionsMu.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("unknown unit conversion: %s", name)
+	}
+
+	if c.Custom {
+		if scale == 0 {
+			scale = 1
+		}
+		custom := *c
+		custom.Convert = linearConversion(scale, offset)
+		return &custom, nil
+	}
+
+	return c, nil
+}
+
+// legacyUnitConversionName translates an original integer unit conversion code into a registry name
+func legacyUnitConversionName(code int) (string, error) {
+	name, ok := legacyUnitConversions[code]
+	if !ok {
+		return "", fmt.Errorf("Unknown unit conversion: %d", code)
+	}
+	return name, nil
+}
+
+// parseArchivedValue converts the text stored in the archive into a float.  Plain numbers are the norm,
+// but sexagesimal values such as "-12:34:56.7" or "12 34 56.7" are also accepted and returned in the
+// leading unit (degrees or hours), so that they can be fed through the angle conversions.
+func parseArchivedValue(s string) (float64, error) {
+	s = strings.TrimSpace(s)
+
+	v, err := strconv.ParseFloat(s, 64)
+	if err == nil {
+		return v, nil
+	}
+
+	// Only try sexagesimal if there are separators to split on
+	fields := strings.FieldsFunc(s, func(r rune) bool { return r == ':' || r == ' ' })
+	if len(fields) < 2 || len(fields) > 3 {
+		return 0, err
+	}
+
+	// The sign applies to the whole value, not just the leading field
+	negative := strings.HasPrefix(fields[0], "-")
+	fields[0] = strings.TrimLeft(fields[0], "+-")
+
+	var total float64
+	divisor := 1.0
+	for i, f := range fields {
+		part, perr := strconv.ParseFloat(f, 64)
+		if perr != nil || part < 0 || (i > 0 && part >= 60) {
+			return 0, fmt.Errorf("invalid sexagesimal value: %q", s)
+		}
+		total += part / divisor
+		divisor *= 60
+	}
+
+	if negative {
+		total = -total
+	}
+
+	return total, nil
+}
@@ -0,0 +1,78 @@
+package plugin
+
+import (
+	"math"
+	"testing"
+)
+
+func TestUnitConversions(t *testing.T) {
+	cases := []struct {
+		name     string
+		scale    float64
+		offset   float64
+		value    float64
+		expected float64
+	}{
+		// Temperatures carry an offset as well as a scale
+		{"k_to_c", 0, 0, 273.15, 0},
+		{"k_to_c", 0, 0, 300, 26.85},
+		{"c_to_k", 0, 0, -273.15, 0},
+		{"c_to_f", 0, 0, 100, 212},
+		{"f_to_c", 0, 0, 32, 0},
+		// An hour of angle is fifteen degrees
+		{"hours_to_deg", 0, 0, 1, 15},
+		{"deg_to_hours", 0, 0, 180, 12},
+		{"hours_to_rad", 0, 0, 12, math.Pi},
+		{"mas_to_arcsec", 0, 0, 1000, 1},
+		{"deg_to_mas", 0, 0, 1, 3600000},
+		{"rad_to_arcsec", 0, 0, math.Pi / 180, 3600},
+		// The free-form conversion takes its scale and offset from the query, a zero scale means unset
+		{UNIT_CONVERSION_SCALE_OFFSET, 2, 1, 3, 7},
+		{UNIT_CONVERSION_SCALE_OFFSET, -0.5, 10, 4, 8},
+		{UNIT_CONVERSION_SCALE_OFFSET, 0, 5, 3, 8},
+	}
+
+	for _, c := range cases {
+		conversion, err := LookupUnitConversion(c.name, c.scale, c.offset)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		got := conversion.Convert(c.value)
+		if math.Abs(got-c.expected) > 1e-9*math.Max(1, math.Abs(c.expected)) {
+			t.Fatalf("%s(%v) with scale %v offset %v: expected %v, got %v", c.name, c.value, c.scale, c.offset,
+				c.expected, got)
+		}
+	}
+
+	if conversion, err := LookupUnitConversion("", 0, 0); conversion != nil || err != nil {
+		t.Fatalf("an empty name should be no conversion, got %v, %v", conversion, err)
+	}
+	if _, err := LookupUnitConversion("furlongs_to_parsecs", 0, 0); err == nil {
+		t.Fatalf("expected an unknown conversion to fail")
+	}
+}
+
+func TestLegacyUnitConversions(t *testing.T) {
+	// Every legacy code names a registered conversion, and the registry reports the code back for the editor
+	for code, name := range legacyUnitConversions {
+		got, err := legacyUnitConversionName(code)
+		if err != nil || got != name {
+			t.Fatalf("code %d: expected %q, got %q, %v", code, name, got, err)
+		}
+		if name == "" {
+			continue
+		}
+
+		conversion, err := LookupUnitConversion(name, 0, 0)
+		if err != nil {
+			t.Fatalf("code %d: %v", code, err)
+		}
+		if conversion.Legacy != code {
+			t.Fatalf("%s: expected legacy code %d, got %d", name, code, conversion.Legacy)
+		}
+	}
+
+	if _, err := legacyUnitConversionName(99); err == nil {
+		t.Fatalf("expected an unknown code to fail")
+	}
+}
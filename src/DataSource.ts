@@ -1,21 +1,93 @@
-import { DataSourceInstanceSettings, SelectableValue } from '@grafana/data';
+import { DataSourceInstanceSettings, SelectableValue, TimeRange } from '@grafana/data';
 import { DataSourceWithBackend } from '@grafana/runtime';
-import { KeywordDataSourceOptions, KeywordQuery } from './types';
+import {
+  CatalogStatus,
+  KeywordDataSourceOptions,
+  KeywordMetadata,
+  KeywordQuery,
+  SearchResult,
+  ServiceSummary,
+  TransformDefinition,
+  UnitConversion,
+} from './types';
+
+// The backend's versioned resource API, and how many items to ask for at a time
+const API_PREFIX = 'api/v1';
+const API_PAGE_SIZE = 1000;
 
 export class DataSource extends DataSourceWithBackend<KeywordQuery, KeywordDataSourceOptions> {
   constructor(instanceSettings: DataSourceInstanceSettings<KeywordDataSourceOptions>) {
     super(instanceSettings);
   }
 
+  /**
+   * Every item of a list from the versioned resource API, following the pages
+   */
+  private async getList<T>(path: string, params: Record<string, any> = {}): Promise<T[]> {
+    const items: T[] = [];
+    for (;;) {
+      const { data, page } = await this.getResource(`${API_PREFIX}/${path}`, {
+        ...params,
+        offset: items.length,
+        limit: API_PAGE_SIZE,
+      });
+      items.push(...(data ?? []));
+      if (!data?.length || !page || items.length >= page.total) {
+        return items;
+      }
+    }
+  }
+
   async getServices(): Promise<Array<SelectableValue<string>>> {
-    return this.getResource('services').then(({ services }) =>
-      services ? Object.entries(services).map(([value, label]) => ({ label, value } as SelectableValue<string>)) : []
+    return this.getList<ServiceSummary>('services').then((services) =>
+      services.map((s) => ({ label: s.name, value: s.name }))
     );
   }
 
   async getKeywords(service: string): Promise<Array<SelectableValue<string>>> {
-    return this.getResource('keywords', { service: service }).then(({ keywords }) =>
-      keywords ? Object.entries(keywords).map(([value, label]) => ({ label, value } as SelectableValue<string>)) : []
+    if (!service) {
+      return [];
+    }
+    return this.getList<KeywordMetadata>(`services/${encodeURIComponent(service)}/keywords`).then((keywords) =>
+      keywords.map((k) => ({ label: `${k.service}.${k.keyword}`, value: k.keyword, description: k.description }))
     );
   }
+
+  /**
+   * Keywords of any service matching a search of their names, descriptions and units, best first
+   */
+  async searchKeywords(q: string, limit = 20): Promise<SearchResult[]> {
+    if (!q || !q.trim()) {
+      return [];
+    }
+    return this.getResource(`${API_PREFIX}/search`, { q, limit }).then(({ data }) => data ?? []);
+  }
+
+  /**
+   * Read the archive's services and keywords again rather than waiting for the next catalog refresh
+   */
+  async refreshCatalog(): Promise<CatalogStatus> {
+    return this.postResource(`${API_PREFIX}/catalog`).then(({ data }) => data);
+  }
+
+  async getUnitConversions(): Promise<UnitConversion[]> {
+    return this.getList<UnitConversion>('conversions');
+  }
+
+  async getTransforms(): Promise<TransformDefinition[]> {
+    return this.getList<TransformDefinition>('transforms');
+  }
+
+  /**
+   * URL that downloads the raw data behind a query, format is csv, ndjson, arrow or fits
+   */
+  getExportUrl(query: KeywordQuery, range: TimeRange, format = 'csv'): string {
+    const params = new URLSearchParams({
+      query: JSON.stringify(query),
+      from: String(range.from.valueOf()),
+      to: String(range.to.valueOf()),
+      format,
+    });
+    return `/api/datasources/uid/${this.uid}/resources/${API_PREFIX}/export?${params.toString()}`;
+  }
 }
@@ -1,15 +1,20 @@
 import React, { ChangeEvent, PureComponent } from 'react';
-import { LegacyForms } from '@grafana/ui';
+import { InlineFormLabel, LegacyForms, Select, TextArea } from '@grafana/ui';
 import { DataSourcePluginOptionsEditorProps } from '@grafana/data';
-import { KeywordDataSourceOptions } from '../types';
+import { ArchiveSchema, KeywordDataSourceOptions } from '../types';
 
 const { FormField } = LegacyForms;
 
 interface Props extends DataSourcePluginOptionsEditorProps<KeywordDataSourceOptions> {}
 
-interface State {}
+interface State {
+  calibrationsError?: string;
+  archivesError?: string;
+}
 
 export class ConfigEditor extends PureComponent<Props, State> {
+  state: State = {};
+
   onServerChange = (event: ChangeEvent<HTMLInputElement>) => {
     const { onOptionsChange, options } = this.props;
     const jsonData = {
@@ -55,60 +60,362 @@ export class ConfigEditor extends PureComponent<Props, State> {
     onOptionsChange({ ...options, jsonData });
   };
 
+  onCatalogRefreshChange = (event: ChangeEvent<HTMLInputElement>) => {
+    const { onOptionsChange, options } = this.props;
+    const jsonData = {
+      ...options.jsonData,
+      catalogRefresh: event.target.value.trim() || undefined,
+    };
+    onOptionsChange({ ...options, jsonData });
+  };
+
+  onBackendChange = (backend?: string) => {
+    const { onOptionsChange, options } = this.props;
+    const jsonData = {
+      ...options.jsonData,
+      backend,
+    };
+    onOptionsChange({ ...options, jsonData });
+  };
+
+  onPathChange = (event: ChangeEvent<HTMLInputElement>) => {
+    const { onOptionsChange, options } = this.props;
+    const jsonData = {
+      ...options.jsonData,
+      path: event.target.value,
+    };
+    onOptionsChange({ ...options, jsonData });
+  };
+
+  onCalibrationsChange = (event: React.FocusEvent<HTMLTextAreaElement>) => {
+    const { onOptionsChange, options } = this.props;
+    const text = event.currentTarget.value.trim();
+
+    // Only store the catalog once it parses, the backend validates the content itself
+    let calibrations;
+    try {
+      calibrations = text ? JSON.parse(text) : undefined;
+    } catch (e) {
+      this.setState({ calibrationsError: String(e) });
+      return;
+    }
+
+    this.setState({ calibrationsError: undefined });
+    const jsonData = {
+      ...options.jsonData,
+      calibrations,
+    };
+    onOptionsChange({ ...options, jsonData });
+  };
+
+  onArchivesChange = (event: React.FocusEvent<HTMLTextAreaElement>) => {
+    const { onOptionsChange, options } = this.props;
+    const text = event.currentTarget.value.trim();
+
+    // Only store the list once it parses, the backend checks each connection when the datasource is saved
+    let archives;
+    try {
+      archives = text ? JSON.parse(text) : undefined;
+    } catch (e) {
+      this.setState({ archivesError: String(e) });
+      return;
+    }
+    if (archives !== undefined && !Array.isArray(archives)) {
+      this.setState({ archivesError: 'Archives must be a JSON list' });
+      return;
+    }
+
+    this.setState({ archivesError: undefined });
+    const jsonData = {
+      ...options.jsonData,
+      archives,
+    };
+    onOptionsChange({ ...options, jsonData });
+  };
+
+  onSchemaChange = (field: keyof ArchiveSchema, value: string | string[] | undefined) => {
+    const { onOptionsChange, options } = this.props;
+    const jsonData = {
+      ...options.jsonData,
+      schema: { ...options.jsonData.schema, [field]: value },
+    };
+    onOptionsChange({ ...options, jsonData });
+  };
+
+  backendOptions = [
+    { label: 'Postgres', value: 'postgres' },
+    { label: 'Files (CSV, TSV, Parquet)', value: 'files' },
+    { label: 'SQLite', value: 'sqlite' },
+    { label: 'Federated (several archives)', value: 'federated' },
+  ];
+
+  timeFormatOptions = [
+    { label: 'float seconds', value: 'float_seconds' },
+    { label: 'integer milliseconds', value: 'int_ms' },
+    { label: 'integer microseconds', value: 'int_us' },
+    { label: 'timestamptz', value: 'timestamptz' },
+  ];
+
   render() {
     const { options } = this.props;
     const { jsonData } = options;
+    const backend = jsonData.backend || (jsonData.archives?.length ? 'federated' : 'postgres');
 
     return (
       <div className="gf-form-group">
+        <div className="gf-form">
+          <InlineFormLabel width={10}>Archive</InlineFormLabel>
+          <Select
+            width={40}
+            options={this.backendOptions}
+            value={backend}
+            onChange={(item) => this.onBackendChange(item.value)}
+          />
+        </div>
+        {backend === 'files' && (
+          <div className="gf-form">
+            <FormField
+              label="Directory"
+              labelWidth={10}
+              inputWidth={20}
+              onChange={this.onPathChange}
+              value={jsonData.path || ''}
+              placeholder="/data/archive-extract"
+              tooltip="Directory of archive export files on the Grafana server, one file per service"
+            />
+          </div>
+        )}
+        {backend === 'sqlite' && (
+          <div className="gf-form">
+            <FormField
+              label="Database file"
+              labelWidth={10}
+              inputWidth={20}
+              onChange={this.onPathChange}
+              value={jsonData.path || ''}
+              placeholder="/data/teststand.sqlite"
+              tooltip="SQLite file on the Grafana server with the same tables as the Postgres archive"
+            />
+          </div>
+        )}
+        {backend === 'federated' && (
+          <>
+            <div className="gf-form">
+              <InlineFormLabel
+                width={10}
+                tooltip={
+                  <p>
+                    JSON list of archives, each with a name and the fields of a single archive. Each service is read
+                    from the first archive whose meta table lists it. The meta table and schema below apply to any
+                    archive without its own.
+                  </p>
+                }
+              >
+                Archives
+              </InlineFormLabel>
+              <TextArea
+                rows={8}
+                cols={60}
+                defaultValue={jsonData.archives ? JSON.stringify(jsonData.archives, null, 2) : ''}
+                placeholder={
+                  '[{ "name": "keck1", "server": "k1db", "port": "5432", "role": "grafana", "database": "keywordlog" }]'
+                }
+                onBlur={this.onArchivesChange}
+                invalid={!!this.state.archivesError}
+              />
+            </div>
+            {this.state.archivesError && <div className="gf-form">{this.state.archivesError}</div>}
+          </>
+        )}
+        {backend === 'postgres' && (
+          <>
+            <div className="gf-form">
+              <FormField
+                label="Database server"
+                labelWidth={10}
+                inputWidth={20}
+                onChange={this.onServerChange}
+                value={jsonData.server || ''}
+                placeholder="vm-history-1"
+              />
+              <FormField
+                label="Port"
+                labelWidth={3}
+                inputWidth={4}
+                onChange={this.onPortChange}
+                value={jsonData.port || ''}
+                placeholder="5432"
+              />
+            </div>
+            <div className="gf-form">
+              <FormField
+                label="Role"
+                labelWidth={10}
+                inputWidth={20}
+                onChange={this.onRoleChange}
+                value={jsonData.role || ''}
+                placeholder="turk"
+              />
+            </div>
+            <div className="gf-form">
+              <FormField
+                label="Database"
+                labelWidth={10}
+                inputWidth={20}
+                onChange={this.onDatabaseChange}
+                value={jsonData.database || ''}
+                placeholder="keywordlog"
+              />
+            </div>
+          </>
+        )}
         <div className="gf-form">
           <FormField
-            label="Database server"
+            label="Meta table"
             labelWidth={10}
             inputWidth={20}
-            onChange={this.onServerChange}
-            value={jsonData.server || ''}
-            placeholder="vm-history-1"
+            onChange={this.onMetatableChange}
+            value={jsonData.metatable || ''}
+            placeholder="ktlmeta"
           />
+        </div>
+        <div className="gf-form">
           <FormField
-            label="Port"
-            labelWidth={3}
-            inputWidth={4}
-            onChange={this.onPortChange}
-            value={jsonData.port || ''}
-            placeholder="5432"
+            label="Catalog refresh"
+            labelWidth={10}
+            inputWidth={20}
+            onChange={this.onCatalogRefreshChange}
+            value={jsonData.catalogRefresh || ''}
+            placeholder="10m"
+            tooltip="How often the list of services and keywords is read again, 0 to read it only when asked"
           />
         </div>
+        <h3 className="page-heading">Archive schema</h3>
         <div className="gf-form">
           <FormField
-            label="Role"
+            label="Table template"
             labelWidth={10}
             inputWidth={20}
-            onChange={this.onRoleChange}
-            value={jsonData.role || ''}
-            placeholder="turk"
+            onChange={(event: ChangeEvent<HTMLInputElement>) => this.onSchemaChange('tableTemplate', event.target.value)}
+            value={jsonData.schema?.tableTemplate || ''}
+            placeholder="{service}"
+            tooltip="Table holding a service's samples, {service} is replaced by the service name"
           />
         </div>
         <div className="gf-form">
           <FormField
-            label="Database"
+            label="Time column"
             labelWidth={10}
             inputWidth={20}
-            onChange={this.onDatabaseChange}
-            value={jsonData.database || ''}
-            placeholder="keywordlog"
+            onChange={(event: ChangeEvent<HTMLInputElement>) => this.onSchemaChange('timeColumn', event.target.value)}
+            value={jsonData.schema?.timeColumn || ''}
+            placeholder="time"
+          />
+          <InlineFormLabel width={8}>Time format</InlineFormLabel>
+          <Select
+            width={25}
+            options={this.timeFormatOptions}
+            value={jsonData.schema?.timeFormat || 'float_seconds'}
+            onChange={(item) => this.onSchemaChange('timeFormat', item.value)}
           />
         </div>
         <div className="gf-form">
           <FormField
-            label="Meta table"
+            label="Keyword column"
             labelWidth={10}
             inputWidth={20}
-            onChange={this.onMetatableChange}
-            value={jsonData.metatable || ''}
-            placeholder="ktlmeta"
+            onChange={(event: ChangeEvent<HTMLInputElement>) => this.onSchemaChange('keywordColumn', event.target.value)}
+            value={jsonData.schema?.keywordColumn || ''}
+            placeholder="keyword"
+          />
+        </div>
+        <div className="gf-form">
+          <FormField
+            label="Value columns"
+            labelWidth={10}
+            inputWidth={20}
+            onChange={(event: ChangeEvent<HTMLInputElement>) =>
+              this.onSchemaChange(
+                'valueColumns',
+                event.target.value
+                  .split(',')
+                  .map((column) => column.trim())
+                  .filter((column) => column !== '')
+              )
+            }
+            value={(jsonData.schema?.valueColumns ?? []).join(', ')}
+            placeholder="binvalue"
+            tooltip="Comma separated, the first non-null column is used"
+          />
+        </div>
+        <div className="gf-form">
+          <FormField
+            label="Meta service column"
+            labelWidth={10}
+            inputWidth={20}
+            onChange={(event: ChangeEvent<HTMLInputElement>) =>
+              this.onSchemaChange('metaServiceColumn', event.target.value)
+            }
+            value={jsonData.schema?.metaServiceColumn || ''}
+            placeholder="service"
+          />
+        </div>
+        <div className="gf-form">
+          <FormField
+            label="Meta keyword column"
+            labelWidth={10}
+            inputWidth={20}
+            onChange={(event: ChangeEvent<HTMLInputElement>) =>
+              this.onSchemaChange('metaKeywordColumn', event.target.value)
+            }
+            value={jsonData.schema?.metaKeywordColumn || ''}
+            placeholder="keyword"
+          />
+        </div>
+        <div className="gf-form">
+          <FormField
+            label="Meta units column"
+            labelWidth={10}
+            inputWidth={20}
+            onChange={(event: ChangeEvent<HTMLInputElement>) => this.onSchemaChange('metaUnitsColumn', event.target.value)}
+            value={jsonData.schema?.metaUnitsColumn || ''}
+            placeholder="units"
+          />
+        </div>
+        <div className="gf-form">
+          <FormField
+            label="Meta description column"
+            labelWidth={10}
+            inputWidth={20}
+            onChange={(event: ChangeEvent<HTMLInputElement>) =>
+              this.onSchemaChange('metaDescriptionColumn', event.target.value)
+            }
+            value={jsonData.schema?.metaDescriptionColumn || ''}
+            placeholder="description"
+          />
+        </div>
+        <div className="gf-form">
+          <InlineFormLabel
+            width={10}
+            tooltip={
+              <p>
+                JSON object keyed by service.keyword, each with one of polynomial, table or conversion, and an
+                automatic flag.
+              </p>
+            }
+          >
+            Calibrations
+          </InlineFormLabel>
+          <TextArea
+            rows={6}
+            cols={60}
+            defaultValue={jsonData.calibrations ? JSON.stringify(jsonData.calibrations, null, 2) : ''}
+            placeholder={'{ "dcs.TUBETEMP": { "polynomial": [-40, 12.5], "automatic": true } }'}
+            onBlur={this.onCalibrationsChange}
+            invalid={!!this.state.calibrationsError}
           />
         </div>
+        {this.state.calibrationsError && <div className="gf-form">{this.state.calibrationsError}</div>}
       </div>
     );
   }
@@ -1,14 +1,34 @@
 import defaults from 'lodash/defaults';
 
 import React, { PureComponent } from 'react';
-import { InlineFormLabel, SegmentAsync, Select } from '@grafana/ui';
-import { QueryEditorProps } from '@grafana/data';
+import { Button, InlineFormLabel, InlineSwitch, Input, SegmentAsync, Select } from '@grafana/ui';
+import { QueryEditorProps, SelectableValue } from '@grafana/data';
 import { DataSource } from '../DataSource';
-import { defaultQuery, KeywordDataSourceOptions, KeywordQuery } from '../types';
+import {
+  defaultQuery,
+  KeywordDataSourceOptions,
+  KeywordQuery,
+  TransformDefinition,
+  TransformStep,
+  UnitConversion,
+} from '../types';
 
 type Props = QueryEditorProps<DataSource, KeywordQuery, KeywordDataSourceOptions>;
 
-export class QueryEditor extends PureComponent<Props> {
+interface State {
+  conversions: UnitConversion[];
+  transforms: TransformDefinition[];
+}
+
+export class QueryEditor extends PureComponent<Props, State> {
+  state: State = { conversions: [], transforms: [] };
+
+  componentDidMount() {
+    // The conversion and transform lists are served by the backend so they can never drift out of sync
+    this.props.datasource.getUnitConversions().then((conversions) => this.setState({ conversions }));
+    this.props.datasource.getTransforms().then((transforms) => this.setState({ transforms }));
+  }
+
   onServiceChange = (item: any) => {
     const { onChange, query } = this.props;
     // Repopulate the keyword list based on the service selected
@@ -28,18 +48,126 @@ export class QueryEditor extends PureComponent<Props> {
     onRunQuery();
   };
 
-  unitConversionOptions = [
-    { label: '(none)', value: 0 },
-    { label: 'degrees to radians', value: 1 },
-    { label: 'radians to degrees', value: 2 },
-    { label: 'radians to arcseconds', value: 3 },
-    { label: 'Kelvin to Celcius', value: 4 },
-    { label: 'Celcius to Kelvin', value: 5 },
+  searchKeywords = (q?: string) =>
+    this.props.datasource.searchKeywords(q ?? '').then((results) =>
+      results.map((r) => ({
+        label: r.service + '.' + r.keyword,
+        value: r.service + '.' + r.keyword,
+        description: [r.description, r.units].filter(Boolean).join(', '),
+      }))
+    );
+
+  onSearchChange = (item: any) => {
+    const { query, onRunQuery, onChange } = this.props;
+
+    if (!item.value) {
+      return;
+    }
+
+    const [service, keyword] = item.value.split('.');
+    onChange({ ...query, service, keyword, queryText: item.value });
+    onRunQuery();
+  };
+
+  queryTypeOptions = [
+    { label: 'Time series', value: '' },
+    { label: 'Statistics', value: 'stats' },
+    { label: 'Histogram', value: 'histogram' },
+    { label: 'Staleness', value: 'staleness' },
   ];
 
+  onQueryTypeChange = (item: any) => {
+    const { onChange, query, onRunQuery } = this.props;
+    onChange({ ...query, queryType: item.value });
+    onRunQuery();
+  };
+
+  // Split a comma separated input into its non-empty parts
+  splitList(text: string): string[] {
+    return text
+      .split(',')
+      .map((part) => part.trim())
+      .filter((part) => part !== '');
+  }
+
+  onKeywordsChange = (event: React.FocusEvent<HTMLInputElement>) => {
+    const { onChange, query, onRunQuery } = this.props;
+    onChange({ ...query, keywords: this.splitList(event.currentTarget.value) });
+    onRunQuery();
+  };
+
+  onTimeShiftChange = (event: React.FocusEvent<HTMLInputElement>) => {
+    const { onChange, query, onRunQuery } = this.props;
+    onChange({ ...query, timeShift: event.currentTarget.value.trim() });
+    onRunQuery();
+  };
+
+  onPercentilesChange = (event: React.FocusEvent<HTMLInputElement>) => {
+    const { onChange, query, onRunQuery } = this.props;
+    const percentiles = this.splitList(event.currentTarget.value)
+      .map(parseFloat)
+      .filter((p) => !isNaN(p));
+    onChange({ ...query, percentiles });
+    onRunQuery();
+  };
+
+  onHistogramNumberChange = (option: 'binWidth' | 'bins' | 'min' | 'max', event: React.FocusEvent<HTMLInputElement>) => {
+    const { onChange, query, onRunQuery } = this.props;
+    const value = parseFloat(event.currentTarget.value);
+    onChange({ ...query, histogram: { ...query.histogram, [option]: isNaN(value) ? undefined : value } });
+    onRunQuery();
+  };
+
+  onStalenessThresholdChange = (event: React.FocusEvent<HTMLInputElement>) => {
+    const { onChange, query, onRunQuery } = this.props;
+    onChange({ ...query, staleness: { ...query.staleness, threshold: event.currentTarget.value.trim() } });
+    onRunQuery();
+  };
+
+  onHistogramTimeWeightedChange = (event: React.FormEvent<HTMLInputElement>) => {
+    const { onChange, query, onRunQuery } = this.props;
+    onChange({ ...query, histogram: { ...query.histogram, timeWeighted: event.currentTarget.checked } });
+    onRunQuery();
+  };
+
+  unitConversionOptions(): Array<SelectableValue<string>> {
+    // Group the conversions by category for the dropdown
+    const groups: { [category: string]: Array<SelectableValue<string>> } = {};
+    for (const c of this.state.conversions) {
+      (groups[c.category] = groups[c.category] ?? []).push({ label: c.label, value: c.name });
+    }
+
+    return [
+      { label: '(none)', value: '' },
+      ...Object.entries(groups).map(([label, options]) => ({ label, options })),
+    ];
+  }
+
+  // Queries saved before the conversion registry carry an integer code, the backend says which name it stands for
+  legacyConversion(code?: number): string {
+    return (code && this.state.conversions.find((c) => c.legacy === code)?.name) || '';
+  }
+
+  isCustomConversion(name?: string): boolean {
+    return this.state.conversions.some((c) => c.name === name && c.custom);
+  }
+
   onUnitConversionChange = (item: any) => {
     const { onChange, query, onRunQuery } = this.props;
-    onChange({ ...query, unitConversion: item.value });
+    // The named conversion supersedes the legacy code, so clear it out
+    onChange({ ...query, conversion: item.value, unitConversion: 0 });
+    onRunQuery();
+  };
+
+  onConversionScaleChange = (event: React.FormEvent<HTMLInputElement>) => {
+    const { onChange, query, onRunQuery } = this.props;
+    onChange({ ...query, conversionScale: parseFloat(event.currentTarget.value) });
+    onRunQuery();
+  };
+
+  onConversionOffsetChange = (event: React.FormEvent<HTMLInputElement>) => {
+    const { onChange, query, onRunQuery } = this.props;
+    onChange({ ...query, conversionOffset: parseFloat(event.currentTarget.value) });
     onRunQuery();
   };
 
@@ -52,15 +180,64 @@ export class QueryEditor extends PureComponent<Props> {
     { label: 'delta', value: 5 },
   ];
 
+  calibrateOptions = [
+    { label: 'automatic', value: '' },
+    { label: 'always', value: 'always' },
+    { label: 'never', value: 'never' },
+  ];
+
+  onCalibrateChange = (item: any) => {
+    const { onChange, query, onRunQuery } = this.props;
+    onChange({ ...query, calibrate: item.value });
+    onRunQuery();
+  };
+
   onTransformChange = (item: any) => {
     const { onChange, query, onRunQuery } = this.props;
     onChange({ ...query, transform: item.value });
     onRunQuery();
   };
 
+  updateTransformSteps(steps: TransformStep[]) {
+    const { onChange, query, onRunQuery } = this.props;
+    onChange({ ...query, transforms: steps });
+    onRunQuery();
+  }
+
+  onAddTransformStep = () => {
+    // Nothing to run until a transform has been picked for the new step
+    const { onChange, query } = this.props;
+    onChange({ ...query, transforms: [...(query.transforms ?? []), { name: '' }] });
+  };
+
+  onRemoveTransformStep = (index: number) => {
+    const steps = this.props.query.transforms ?? [];
+    this.updateTransformSteps(steps.filter((_, i) => i !== index));
+  };
+
+  onTransformStepNameChange = (index: number, item: any) => {
+    const steps = [...(this.props.query.transforms ?? [])];
+    steps[index] = { name: item.value };
+    this.updateTransformSteps(steps);
+  };
+
+  onTransformStepParamsChange = (index: number, event: React.FocusEvent<HTMLInputElement>) => {
+    const steps = [...(this.props.query.transforms ?? [])];
+    const text = event.currentTarget.value.trim();
+
+    // Ignore parameters that do not parse, the backend reports bad values for the ones that do
+    try {
+      steps[index] = { ...steps[index], params: text ? JSON.parse(text) : undefined };
+    } catch (e) {
+      return;
+    }
+    this.updateTransformSteps(steps);
+  };
+
   render() {
     const datasource = this.props.datasource;
     const query = defaults(this.props.query, defaultQuery);
+    const conversion = query.conversion || this.legacyConversion(query.unitConversion);
 
     // noinspection CheckTagEmptyBody
     return (
@@ -83,6 +260,122 @@ export class QueryEditor extends PureComponent<Props> {
             allowCustomValue={false}
             onChange={this.onKeywordChange}
           ></SegmentAsync>
+          <SegmentAsync
+            loadOptions={this.searchKeywords}
+            placeholder="(search)"
+            allowCustomValue={false}
+            onChange={this.onSearchChange}
+          ></SegmentAsync>
+        </div>
+        <div className="gf-form-inline">
+          <InlineFormLabel
+            width={10}
+            className="query-keywords"
+            tooltip={<p>More keywords to query alongside the one selected, as service.keyword separated by commas.</p>}
+          >
+            More keywords
+          </InlineFormLabel>
+          <Input
+            width={60}
+            placeholder="dcs.AZ, dcs.EL"
+            defaultValue={(query.keywords ?? []).join(', ')}
+            onBlur={this.onKeywordsChange}
+          />
+        </div>
+        <div className="gf-form-inline">
+          <InlineFormLabel
+            width={10}
+            className="time-shift"
+            tooltip={
+              <p>
+                Show another period in this time range: an amount such as -1d, 12h or +30m (unsigned looks back), or
+                yesterday, last night or last week, optionally starting &quot;same time&quot; or &quot;this time&quot;.
+              </p>
+            }
+          >
+            Time shift
+          </InlineFormLabel>
+          <Input width={20} placeholder="-1d" defaultValue={query.timeShift ?? ''} onBlur={this.onTimeShiftChange} />
+        </div>
+        <div className="gf-form-inline">
+          <InlineFormLabel width={10} className="query-type" tooltip={<p>Return a series or one row per keyword.</p>}>
+            Query type
+          </InlineFormLabel>
+          <Select
+            width={30}
+            defaultValue={''}
+            options={this.queryTypeOptions}
+            value={query.queryType ?? ''}
+            allowCustomValue={false}
+            onChange={this.onQueryTypeChange}
+          />
+          {query.queryType === 'stats' && (
+            <>
+              <InlineFormLabel width={8}>Percentiles</InlineFormLabel>
+              <Input
+                width={20}
+                placeholder="5, 95"
+                defaultValue={(query.percentiles ?? []).join(', ')}
+                onBlur={this.onPercentilesChange}
+              />
+            </>
+          )}
+          {query.queryType === 'staleness' && (
+            <>
+              <InlineFormLabel
+                width={8}
+                tooltip={<p>Keywords not archived for longer than this are stale, 10m if left empty.</p>}
+              >
+                Threshold
+              </InlineFormLabel>
+              <Input
+                width={10}
+                placeholder="10m"
+                defaultValue={query.staleness?.threshold ?? ''}
+                onBlur={this.onStalenessThresholdChange}
+              />
+            </>
+          )}
+          {query.queryType === 'histogram' && (
+            <>
+              <InlineFormLabel width={6} tooltip={<p>Leave bin width and buckets empty to choose automatically.</p>}>
+                Bin width
+              </InlineFormLabel>
+              <Input
+                width={10}
+                type="number"
+                defaultValue={query.histogram?.binWidth}
+                onBlur={(event) => this.onHistogramNumberChange('binWidth', event)}
+              />
+              <InlineFormLabel width={6}>Buckets</InlineFormLabel>
+              <Input
+                width={10}
+                type="number"
+                defaultValue={query.histogram?.bins}
+                onBlur={(event) => this.onHistogramNumberChange('bins', event)}
+              />
+              <InlineFormLabel width={6}>Min</InlineFormLabel>
+              <Input
+                width={10}
+                type="number"
+                defaultValue={query.histogram?.min}
+                onBlur={(event) => this.onHistogramNumberChange('min', event)}
+              />
+              <InlineFormLabel width={6}>Max</InlineFormLabel>
+              <Input
+                width={10}
+                type="number"
+                defaultValue={query.histogram?.max}
+                onBlur={(event) => this.onHistogramNumberChange('max', event)}
+              />
+              <InlineSwitch
+                label="Time weighted"
+                showLabel={true}
+                value={query.histogram?.timeWeighted ?? false}
+                onChange={this.onHistogramTimeWeightedChange}
+              />
+            </>
+          )}
         </div>
         <div className="gf-form-inline">
           <InlineFormLabel width={10} className="convert-units" tooltip={<p>Convert units.</p>}>
@@ -91,12 +384,47 @@ export class QueryEditor extends PureComponent<Props> {
           <Select
             width={30}
             placeholder={'(none)'}
-            defaultValue={0}
-            options={this.unitConversionOptions}
-            value={query.unitConversion}
+            defaultValue={''}
+            options={this.unitConversionOptions()}
+            value={conversion}
             allowCustomValue={false}
             onChange={this.onUnitConversionChange}
           />
+          {this.isCustomConversion(conversion) && (
+            <>
+              <InlineFormLabel width={5}>Scale</InlineFormLabel>
+              <Input
+                width={12}
+                type="number"
+                defaultValue={query.conversionScale ?? 1}
+                onBlur={this.onConversionScaleChange}
+              />
+              <InlineFormLabel width={5}>Offset</InlineFormLabel>
+              <Input
+                width={12}
+                type="number"
+                defaultValue={query.conversionOffset ?? 0}
+                onBlur={this.onConversionOffsetChange}
+              />
+            </>
+          )}
+        </div>
+        <div className="gf-form-inline">
+          <InlineFormLabel
+            width={10}
+            className="calibrate"
+            tooltip={<p>Apply the calibration configured for this keyword in the datasource settings.</p>}
+          >
+            Calibration
+          </InlineFormLabel>
+          <Select
+            width={30}
+            defaultValue={''}
+            options={this.calibrateOptions}
+            value={query.calibrate ?? ''}
+            allowCustomValue={false}
+            onChange={this.onCalibrateChange}
+          />
         </div>
         <div className="gf-form-inline">
           <InlineFormLabel width={10} className="transform" tooltip={<p>Transform data.</p>}>
@@ -112,6 +440,33 @@ export class QueryEditor extends PureComponent<Props> {
             onChange={this.onTransformChange}
           />
         </div>
+        {(query.transforms ?? []).map((step, index) => (
+          <div className="gf-form-inline" key={index}>
+            <InlineFormLabel width={10} className="transform-step">
+              Step {index + 1}
+            </InlineFormLabel>
+            <Select
+              width={30}
+              placeholder={'(select a transform)'}
+              options={this.state.transforms.map((t) => ({ label: t.label, value: t.name, description: t.description }))}
+              value={step.name}
+              allowCustomValue={false}
+              onChange={(item) => this.onTransformStepNameChange(index, item)}
+            />
+            <Input
+              width={40}
+              placeholder={this.state.transforms.find((t) => t.name === step.name)?.description ?? 'parameters (JSON)'}
+              defaultValue={step.params ? JSON.stringify(step.params) : ''}
+              onBlur={(event) => this.onTransformStepParamsChange(index, event)}
+            />
+            <Button variant="secondary" icon="trash-alt" onClick={() => this.onRemoveTransformStep(index)} />
+          </div>
+        ))}
+        <div className="gf-form-inline">
+          <Button variant="secondary" icon="plus" onClick={this.onAddTransformStep}>
+            Add transform step
+          </Button>
+        </div>
       </>
     );
   }
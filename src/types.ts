@@ -6,6 +6,100 @@ export interface KeywordQuery extends DataQuery {
   keyword: string;
   unitConversion: number;
   transform: number;
+  conversion?: string;
+  conversionScale?: number;
+  conversionOffset?: number;
+  calibrate?: string;
+  transforms?: TransformStep[];
+  keywords?: string[];
+  percentiles?: number[];
+  histogram?: HistogramOptions;
+  staleness?: StalenessOptions;
+  timeShift?: string;
+}
+
+/**
+ * Bucketing for the histogram query type, with neither binWidth nor bins the backend picks the buckets
+ */
+export interface HistogramOptions {
+  binWidth?: number;
+  bins?: number;
+  min?: number;
+  max?: number;
+  timeWeighted?: boolean;
+}
+
+/**
+ * Thresholds for the staleness query type as durations such as 90s or 2h, keyed by service.keyword or
+ * a pattern such as dcs.*
+ */
+export interface StalenessOptions {
+  threshold?: string;
+  thresholds?: { [key: string]: string };
+}
+
+/**
+ * One stage of the transform pipeline, params are specific to each transform
+ */
+export interface TransformStep {
+  name: string;
+  params?: { [key: string]: any };
+}
+
+/**
+ * A transform as served by the backend /transforms resource
+ */
+export interface TransformDefinition {
+  name: string;
+  label: string;
+  description: string;
+}
+
+/**
+ * A unit conversion as served by the backend /conversions resource
+ */
+export interface UnitConversion {
+  name: string;
+  label: string;
+  category: string;
+  custom?: boolean;
+  legacy?: number;
+}
+
+/**
+ * A service from the backend api/v1/services resource
+ */
+export interface ServiceSummary {
+  name: string;
+  keywords: number;
+}
+
+/**
+ * What the archive's metadata table says about a keyword
+ */
+export interface KeywordMetadata {
+  service: string;
+  keyword: string;
+  units?: string;
+  description?: string;
+}
+
+/**
+ * A keyword found by the backend api/v1/search resource
+ */
+export interface SearchResult extends KeywordMetadata {
+  score: number;
+}
+
+/**
+ * State of the backend's keyword catalog, from the api/v1/catalog resource
+ */
+export interface CatalogStatus {
+  loaded?: string;
+  refreshSeconds: number;
+  services: number;
+  keywords: number;
+  lastChanges: { added: string[]; removed: string[] };
 }
 
 export const defaultQuery: Partial<KeywordQuery> = {
@@ -17,9 +111,56 @@ export const defaultQuery: Partial<KeywordQuery> = {
  * These are options configured for each DataSource instance
  */
 export interface KeywordDataSourceOptions extends DataSourceJsonData {
+  backend?: string;
+  path?: string;
   server: string;
   port: string;
   role: string;
   database: string;
   metatable: string;
+  calibrations?: { [key: string]: Calibration };
+  schema?: ArchiveSchema;
+  catalogRefresh?: string;
+  archives?: ArchiveConnection[];
+}
+
+/**
+ * One of the archives of a federated datasource, the meta table and schema default to the datasource's
+ */
+export interface ArchiveConnection {
+  name?: string;
+  backend?: string;
+  path?: string;
+  server?: string;
+  port?: string;
+  role?: string;
+  database?: string;
+  metatable?: string;
+  schema?: ArchiveSchema;
+}
+
+/**
+ * Layout of the archive tables, anything left out takes the KTL archive defaults
+ */
+export interface ArchiveSchema {
+  tableTemplate?: string;
+  timeColumn?: string;
+  keywordColumn?: string;
+  timeFormat?: string;
+  valueColumns?: string[];
+  metaServiceColumn?: string;
+  metaKeywordColumn?: string;
+  metaUnitsColumn?: string;
+  metaDescriptionColumn?: string;
+}
+
+/**
+ * Calibration of a raw sensor keyword, exactly one of polynomial, table or conversion is set
+ */
+export interface Calibration {
+  polynomial?: number[];
+  table?: Array<[number, number]>;
+  conversion?: string;
+  automatic: boolean;
+  units?: string;
 }